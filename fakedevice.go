@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sofia-go/sofia/sofiatest"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Simulated camera streaming an elementary stream file to monitor claims
+//
+//	sofia-go fakedevice [-listen :34567] [-width 1920 -height 1080 -fps 25] video.h264
+func fakeDeviceCmd(args []string, logger *logrus.Logger) int {
+	flags := flag.NewFlagSet("fakedevice", flag.ExitOnError)
+	listen := flags.String("listen", ":34567", "DVRIP address to listen on")
+	discovery := flags.String("discovery", "", "UDP address to answer discovery on, e.g. :34569")
+	user := flags.String("user", "admin", "Accepted user")
+	pass := flags.String("pass", "", "Accepted password")
+	fixtures := flags.String("fixtures", "", "Directory of <command name>.json responses")
+	width := flags.Int("width", sofiatest.VideoWidth, "Video width announced in I-frames")
+	height := flags.Int("height", sofiatest.VideoHeight, "Video height announced in I-frames")
+	fps := flags.Int("fps", sofiatest.VideoFPS, "Frame rate of metadata and pacing")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s fakedevice [flags] file.{h264,h265}\n", os.Args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+
+	video, err := sofiatest.LoadVideo(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+	video.Width, video.Height, video.FPS = *width, *height, *fps
+
+	if err := video.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+
+	config := sofiatest.Config{
+		User:     *user,
+		Password: *pass,
+		Video:    video,
+		Logger:   logger,
+	}
+
+	if len(*fixtures) > 0 {
+		if config.Fixtures, err = sofiatest.LoadFixtures(*fixtures); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 2
+		}
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	server := sofiatest.NewServer(config)
+
+	if len(*discovery) > 0 {
+		if err := server.StartDiscovery(*discovery); err != nil {
+			listener.Close()
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+	}
+
+	logger.Infof("Streaming %d frames of %s at %dx%d, %d fps on %s", video.Frames(), flags.Arg(0),
+		video.Width, video.Height, video.FPS, listener.Addr())
+
+	// Serve until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	go server.Serve(listener)
+
+	<-ctx.Done()
+	server.Close()
+
+	return 0
+}
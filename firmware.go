@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sofia-go/sofia"
+	"sofia-go/sofia/firmware"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Inspect a firmware package and optionally check it against a device
+//
+//	sofia-go firmware [-host addr [-port port] [-user user] [-pass password]] package.bin
+func firmwareCmd(args []string, logger *logrus.Logger) int {
+	flags := flag.NewFlagSet("firmware", flag.ExitOnError)
+	host := flags.String("host", "", "Device to check compatibility against")
+	port := flags.String("port", "34567", "Device port")
+	user := flags.String("user", "admin", "Username")
+	pass := flags.String("pass", "", "Password")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s firmware [flags] package.bin\n", os.Args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+
+	// Inspect package
+	image, err := firmware.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("Package   : %s\n", image.Path)
+	fmt.Printf("Version   : %s\n", image.Version)
+	fmt.Printf("Hardware  : %s\n", image.Manifest.Hardware)
+	fmt.Printf("Vendor    : %s\n", image.Manifest.Vendor)
+	fmt.Printf("DevID     : %s\n", image.Manifest.DevID)
+	if image.Manifest.OEMID != nil {
+		fmt.Printf("OEMID     : %d\n", *image.Manifest.OEMID)
+	}
+	fmt.Printf("Partitions:\n")
+	for _, part := range image.Partitions {
+		fmt.Printf("  %-24s %10d burn=%-5t", part.FileName, part.Size, part.Burn)
+		if part.UImage {
+			fmt.Printf(" name=%q load=0x%08X entry=0x%08X crc=0x%08X", part.Name, part.Load, part.Entry, part.DataCRC)
+			if !part.CRCValid {
+				fmt.Printf(" CORRUPT")
+			}
+		}
+		fmt.Printf("\n")
+	}
+
+	if len(*host) == 0 {
+		return 0
+	}
+
+	// Fetch device info
+	var info sofia.SystemInfo
+	var oem *sofia.OEMInfo
+	{
+		device, err := sofia.NewDevice(*host, *port, 5, 3, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+
+		if err := device.Connect(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to connect [%s]\n", err.Error())
+			return 1
+		}
+		defer device.Close()
+
+		session, err := device.NewSession(*user, sofia.SofiaHash(*pass))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+
+		if err := session.Login(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to login [%s]\n", err.Error())
+			return 1
+		}
+
+		if info, err = session.SystemInfo(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to get system info [%s]\n", err.Error())
+			return 1
+		}
+
+		if oemInfo, err := session.OEMInfo(); err != nil {
+			logger.Warn("Unable to get OEM info ", err.Error())
+		} else {
+			oem = &oemInfo
+		}
+	}
+
+	// Compare
+	report := image.Check(info, oem)
+
+	fmt.Printf("Device %s:\n", *host)
+	for _, check := range report.Checks {
+		fmt.Printf("  %-10s image=%-32q device=%-32q %s\n", check.Name, check.Image, check.Device, check.Status)
+	}
+
+	if report.SameVersion {
+		fmt.Printf("Device already runs %s\n", image.Version)
+	}
+
+	if !report.Compatible() {
+		fmt.Printf("Package is NOT compatible with device\n")
+		return 1
+	}
+
+	fmt.Printf("Package is compatible with device\n")
+	return 0
+}
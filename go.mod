@@ -2,9 +2,12 @@ module sofia-go
 
 go 1.18
 
-require github.com/sirupsen/logrus v1.9.0
+require (
+	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/text v0.14.0
+)
 
 require (
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,38 +1,105 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"sofia-go/sofia"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	wg := sync.WaitGroup{}
-
 	// Create a global logger instance
 	newLogger := logrus.New()
 	newLogger.SetFormatter(&logrus.TextFormatter{})
 	newLogger.SetOutput(os.Stdout)
 	newLogger.SetLevel(logrus.DebugLevel)
 
+	// Subcommands, default is discovery
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fakedevice":
+			os.Exit(fakeDeviceCmd(os.Args[2:], newLogger))
+		case "firmware":
+			os.Exit(firmwareCmd(os.Args[2:], newLogger))
+		case "pcap":
+			os.Exit(pcapCmd(os.Args[2:], newLogger))
+		case "proxy":
+			os.Exit(proxyCmd(os.Args[2:], newLogger))
+		case "provision":
+			os.Exit(provisionCmd(os.Args[2:], newLogger))
+		case "scan":
+			os.Exit(scanCmd(os.Args[2:], newLogger))
+		}
+	}
+
+	discoveryCmd(os.Args[1:], newLogger)
+}
+
+func discoveryCmd(args []string, newLogger *logrus.Logger) {
+	wg := sync.WaitGroup{}
+
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	ifaces := flags.String("iface", "", "Comma separated interfaces to discover on (default any)")
+	hosts := flags.String("probe", "", "Comma separated hosts to probe by unicast, host or host:port")
+	passive := flags.Bool("passive", false, "Only listen (also on device UDP port 34568), never send probes")
+	flags.Parse(args)
+
 	// Create a new discovery context
 	discovery, err := sofia.NewDiscovery(34569, 10, newLogger)
 	if err == nil {
-		// Begin discovery
-		discovery.Start()
+		if len(*ifaces) > 0 {
+			err = discovery.SetInterfaces(strings.Split(*ifaces, ","))
+		}
 	}
-
-	// Message
-	var msg sofia.DeviceMessage
-	for {
-		select {
-		case msg = <-*discovery.MQ():
-			newLogger.Infof("Rx message %d of len %d bytes\n", msg.ID(), msg.DataLen())
+	if err == nil {
+		if len(*hosts) > 0 {
+			err = discovery.SetProbeHosts(strings.Split(*hosts, ","))
 		}
 	}
+	if err != nil {
+		newLogger.Fatal(err)
+	}
+
+	if *passive {
+		discovery.SetPassive([]uint16{34568})
+
+		go func() {
+			for frame := range *discovery.FrameQ() {
+				newLogger.Infof("Frame %d of len %d bytes from %s on [%s:%d]", frame.Message.ID(), frame.Message.DataLen(),
+					frame.Source, frame.Interface, frame.Port)
+			}
+		}()
+	}
+
+	// Begin discovery, until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := discovery.Start(ctx); err != nil {
+		newLogger.Fatal(err)
+	}
+
+	// Track devices, forget them after 3 missed rounds
+	registry, err := sofia.NewRegistry(discovery, 3, newLogger)
+	if err != nil {
+		newLogger.Fatal(err)
+	}
+	registry.Start()
+
+	// Registry events
+	var event sofia.RegistryEvent
+	for event = range *registry.EventQ() {
+		device := event.Entry
+		newLogger.Infof("%s %s (%s) at %s/%s on [%s], MAC %s, firmware %s", event.Type, device.HostName, device.SerialNo,
+			device.HostIP, net.IP(device.Submask), device.Interface, device.MAC, device.Version)
+	}
 
 	/*
 		go func(pwg *sync.WaitGroup) {
@@ -78,7 +145,6 @@ func main() {
 
 	fmt.Printf("Waiting for other tasks to complete...\n")
 	wg.Wait()
-	fmt.Scanln()
 }
 
 /*
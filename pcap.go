@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sofia-go/sofia/pcap"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Decode DVRIP frames of a tcpdump capture
+//
+//	sofia-go pcap [-tcp 34567] [-udp 34568,34569] capture.pcapng
+func pcapCmd(args []string, logger *logrus.Logger) int {
+	flags := flag.NewFlagSet("pcap", flag.ExitOnError)
+	tcpPorts := flags.String("tcp", "34567", "Comma separated DVRIP TCP ports")
+	udpPorts := flags.String("udp", "34568,34569", "Comma separated discovery UDP ports")
+	summary := flags.Bool("summary", false, "Only print a line per frame")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s pcap [flags] capture\n", os.Args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+
+	tcp, err := parsePorts(*tcpPorts)
+	if err == nil {
+		var udp []uint16
+		if udp, err = parsePorts(*udpPorts); err == nil {
+			dissector := pcap.NewDissector()
+			dissector.SetPorts(tcp, udp)
+
+			err = dissectFile(dissector, flags.Arg(0), *summary)
+
+			stats := dissector.Stats()
+			logger.Debugf("%d packets, %d frames, %d ignored, %d fragments, %d truncated, %d gaps, %d bytes skipped",
+				stats.Packets, stats.Frames, stats.Ignored, stats.Fragments, stats.Truncated, stats.Gaps, stats.Skipped)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// Print the frames of a capture file
+func dissectFile(dissector *pcap.Dissector, name string, summary bool) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := pcap.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	return dissector.Dissect(reader, func(frame pcap.Frame) error {
+		if summary {
+			_, err := fmt.Println(frame.String())
+			return err
+		}
+
+		return frame.Format(os.Stdout)
+	})
+}
+
+// Parse comma separated ports, empty for none
+func parsePorts(list string) ([]uint16, error) {
+	ports := []uint16{}
+
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); len(field) == 0 {
+			continue
+		}
+
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+
+		ports = append(ports, uint16(port))
+	}
+
+	return ports, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sofia-go/sofia"
+	"sofia-go/sofia/provision"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Provision factory reset devices found by discovery
+//
+//	sofia-go provision -pool 10.0.0.100-10.0.0.199 -mask 255.255.255.0 -gw 10.0.0.1 [flags]
+func provisionCmd(args []string, logger *logrus.Logger) int {
+	flags := flag.NewFlagSet("provision", flag.ExitOnError)
+	pool := flags.String("pool", "", "Address pool, first-last")
+	mask := flags.String("mask", "255.255.255.0", "Subnet mask to assign")
+	gateway := flags.String("gw", "", "Gateway to assign")
+	user := flags.String("user", "admin", "Factory username")
+	defPass := flags.String("default-pass", "", "Factory password")
+	password := flags.String("password", "", "New admin password (default keep)")
+	template := flags.String("template", "", "Configuration template (JSON-per-section backup)")
+	inventory := flags.String("inventory", "inventory.json", "Inventory file")
+	syncClock := flags.Bool("sync-clock", true, "Set device clock to host clock")
+	ifaces := flags.String("iface", "", "Comma separated interfaces to discover on (default any)")
+	flags.Parse(args)
+
+	// Configuration
+	config := provision.Config{
+		Mask:      net.IPMask(net.ParseIP(*mask).To4()),
+		Gateway:   net.ParseIP(*gateway),
+		Default:   sofia.Credentials{User: *user, Password: *defPass},
+		Password:  *password,
+		SyncClock: *syncClock,
+		Inventory: *inventory,
+	}
+
+	if first, last, ok := strings.Cut(*pool, "-"); ok {
+		config.PoolStart = net.ParseIP(first)
+		config.PoolEnd = net.ParseIP(last)
+	}
+
+	if len(*template) > 0 {
+		var err error
+		if config.Template, err = provision.LoadTemplate(*template); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+	}
+
+	// Discovery
+	discovery, err := sofia.NewDiscovery(34569, 10, logger)
+	if err == nil && len(*ifaces) > 0 {
+		err = discovery.SetInterfaces(strings.Split(*ifaces, ","))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	engine, err := provision.NewEngine(config, discovery, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		flags.PrintDefaults()
+		return 2
+	}
+
+	// Run until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := discovery.Start(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	engine.Run(ctx, *discovery.MQ())
+
+	for _, entry := range engine.Inventory().Entries() {
+		fmt.Printf("%-20s %-17s %-15s %s\n", entry.Key, entry.MAC, entry.IP, entry.State)
+	}
+
+	return 0
+}
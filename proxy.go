@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sofia-go/sofia"
+	"sofia-go/sofia/proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Relay clients to a device, printing every decoded message
+//
+//	sofia-go proxy [-listen :34567] [-record session.pcap] 192.168.1.10:34567
+func proxyCmd(args []string, logger *logrus.Logger) int {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := flags.String("listen", ":34567", "Address to accept clients on")
+	record := flags.String("record", "", "Record relayed traffic to a pcap file")
+	summary := flags.Bool("summary", false, "Only print a line per message")
+	useTLS := flags.Bool("tls", false, "Connect to the device over TLS")
+	caFile := flags.String("ca", "", "PEM file of CAs to trust for TLS")
+	pin := flags.String("pin", "", "SHA-256 pin of the device certificate for TLS")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s proxy [flags] host:port\n", os.Args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+
+	relay, err := proxy.NewProxy(flags.Arg(0), logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+	relay.SetOutput(os.Stdout, *summary)
+
+	if *useTLS || len(*caFile) > 0 || len(*pin) > 0 {
+		dialer, err := sofia.TLSDialer(sofia.TLSConfig{CAFile: *caFile, Pin: *pin})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 2
+		}
+
+		relay.SetDialer(dialer)
+	}
+
+	if len(*record) > 0 {
+		file, err := os.Create(*record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		defer file.Close()
+
+		if err := relay.Record(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	// Relay until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	go relay.Serve(listener)
+
+	<-ctx.Done()
+	relay.Close()
+
+	return 0
+}
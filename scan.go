@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sofia-go/sofia"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Scan address ranges for devices
+//
+//	sofia-go scan [-port 34567] [-user admin -pass password] 10.1.0.0/24 10.2.0.0/24
+func scanCmd(args []string, logger *logrus.Logger) int {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	port := flags.Uint("port", 34567, "DVRIP port")
+	timeout := flags.Uint("timeout", 2, "Connect and handshake timeout, seconds")
+	concurrency := flags.Int("concurrency", 64, "Hosts probed in parallel")
+	user := flags.String("user", "", "Login to fetch details")
+	pass := flags.String("pass", "", "Password")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s scan [flags] cidr...\n", os.Args[0])
+		flags.PrintDefaults()
+		return 2
+	}
+
+	scanner, err := sofia.NewScanner(uint16(*port), uint16(*timeout), *concurrency, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+
+	if len(*user) > 0 {
+		scanner.SetCredentials(sofia.Credentials{User: *user, Password: *pass})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	results, err := scanner.Scan(ctx, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+
+	for device := range results {
+		fmt.Printf("%-15s %5d %-20s %-17s %s\n", device.HostIP, device.TCPPort, device.SerialNo, device.MAC, device.Version)
+	}
+
+	return 0
+}
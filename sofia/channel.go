@@ -0,0 +1,242 @@
+package sofia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+/*
+Channel titles, one per channel including extra (digital) channels
+{
+	"ChannelTitle" : [ "CAM01", "CAM02" ],
+	"Name" : "ChannelTitle",
+	"Ret" : 100,
+	"SessionID" : "0x0000000B"
+}
+
+Firmware for some markets stores titles in a legacy (GB2312) encoding and
+sends the raw bytes unescaped inside JSON strings. Such titles are decoded
+to UTF-8, and titles written to a device that sent legacy titles are
+encoded the same way. The encoding is learned from ChannelTitles, devices
+whose titles are all ASCII get UTF-8.
+*/
+
+// Channel title encodings
+const (
+	titleEncUnknown = iota // Titles not read yet
+	titleEncUTF8           // UTF-8
+	titleEncGB             // GB2312, handled as its GBK superset
+)
+
+// Number of channels reported at login
+func (session *Session) ChannelCount() int {
+	session.stateMutex.RLock()
+	defer session.stateMutex.RUnlock()
+
+	return session.channelNum + session.extraChan
+}
+
+// Get channel titles
+func (session *Session) ChannelTitles() ([]string, error) {
+	var resData struct {
+		ChannelTitle []json.RawMessage
+	}
+
+	if err := session.command(CHANNELTITLE_GET_REQ, CmdReqData{Name: "ChannelTitle", SessionID: session.sessionID()}, &resData); err != nil {
+		return nil, err
+	}
+
+	enc := titleEncUTF8
+	titles := make([]string, 0, len(resData.ChannelTitle))
+	for _, raw := range resData.ChannelTitle {
+		title, legacy, err := decodeTitle(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if legacy {
+			enc = titleEncGB
+		}
+
+		titles = append(titles, title)
+	}
+
+	session.stateMutex.Lock()
+	session.titleEnc = enc
+	session.stateMutex.Unlock()
+
+	// Size from login response
+	if count := session.ChannelCount(); count > 0 && len(titles) > count {
+		titles = titles[:count]
+	}
+
+	return titles, nil
+}
+
+// Set channel titles, fewer titles than channels keep the remaining titles
+func (session *Session) SetChannelTitles(titles []string) error {
+	count := session.ChannelCount()
+	if count > 0 && len(titles) > count {
+		return fmt.Errorf("%d titles for %d channels", len(titles), count)
+	}
+
+	session.stateMutex.RLock()
+	enc := session.titleEnc
+	session.stateMutex.RUnlock()
+
+	// Keep current titles of the remaining channels, the current titles
+	// also tell the encoding
+	if len(titles) < count || enc == titleEncUnknown {
+		current, err := session.ChannelTitles()
+		if err != nil {
+			return err
+		}
+
+		for idx := len(titles); idx < count && idx < len(current); idx++ {
+			titles = append(titles, current[idx])
+		}
+
+		session.stateMutex.RLock()
+		enc = session.titleEnc
+		session.stateMutex.RUnlock()
+	}
+
+	// Build data by hand so legacy encoded titles survive
+	buf := new(bytes.Buffer)
+	{
+		name, _ := json.Marshal("ChannelTitle")
+		sessionId, _ := json.Marshal(session.sessionID())
+
+		buf.WriteString(`{"ChannelTitle":[`)
+		for idx, title := range titles {
+			if idx > 0 {
+				buf.WriteByte(',')
+			}
+
+			if err := encodeTitle(buf, title, enc == titleEncGB); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(`],"Name":`)
+		buf.Write(name)
+		buf.WriteString(`,"SessionID":`)
+		buf.Write(sessionId)
+		buf.WriteString(`}`)
+	}
+
+	resMsg, err := session.requestRaw(CHANNELTITLE_SET_REQ, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	var resData CmdResData2
+	if err := json.Unmarshal(resMsg.data, &resData); err != nil {
+		return err
+	}
+
+	return CheckRet(resData.Ret)
+}
+
+// Decode a title, a title that isn't valid UTF-8 is decoded as GB2312 and
+// reported as legacy
+func decodeTitle(raw json.RawMessage) (string, bool, error) {
+	if utf8.Valid(raw) {
+		var title string
+		err := json.Unmarshal(raw, &title)
+
+		return strings.TrimRight(title, "\x00 "), false, err
+	}
+
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return "", false, errors.New("malformed channel title")
+	}
+
+	// Unescape by hand, json would replace invalid bytes
+	out := make([]byte, 0, len(raw))
+	for idx := 1; idx < len(raw)-1; idx++ {
+		ch := raw[idx]
+		if ch != '\\' || idx+1 >= len(raw)-1 {
+			out = append(out, ch)
+			continue
+		}
+
+		idx++
+		switch raw[idx] {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'u':
+			if idx+4 >= len(raw)-1 {
+				return "", false, errors.New("malformed channel title")
+			}
+
+			code, err := strconv.ParseUint(string(raw[idx+1:idx+5]), 16, 16)
+			if err != nil || code >= 0x80 {
+				return "", false, errors.New("malformed channel title")
+			}
+
+			out = append(out, byte(code))
+			idx += 4
+		default:
+			out = append(out, raw[idx])
+		}
+	}
+
+	title, err := simplifiedchinese.GBK.NewDecoder().Bytes(out)
+	if err != nil {
+		return "", false, fmt.Errorf("malformed channel title [%w]", err)
+	}
+
+	return strings.TrimRight(string(title), "\x00 "), true, nil
+}
+
+// Encode a title as JSON string, in GB2312 if legacy. HTML characters aren't
+// escaped, firmware doesn't unescape them.
+func encodeTitle(buf *bytes.Buffer, title string, legacy bool) error {
+	if !legacy {
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(title); err != nil {
+			return err
+		}
+
+		// Encode adds a newline
+		buf.Truncate(buf.Len() - 1)
+		return nil
+	}
+
+	data, err := simplifiedchinese.GBK.NewEncoder().String(title)
+	if err != nil {
+		return fmt.Errorf("channel title %q can't be encoded for this device", title)
+	}
+
+	buf.WriteByte('"')
+	for idx := 0; idx < len(data); idx++ {
+		switch ch := data[idx]; {
+		case ch == '"' || ch == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		case ch < 0x20:
+			fmt.Fprintf(buf, `\u%04x`, ch)
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	buf.WriteByte('"')
+
+	return nil
+}
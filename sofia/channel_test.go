@@ -0,0 +1,102 @@
+package sofia
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// 前门 in GB2312
+var gbTitle = []byte{0xC7, 0xB0, 0xC3, 0xC5}
+
+func TestDecodeTitle(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        []byte
+		want       string
+		wantLegacy bool
+		wantErr    bool
+	}{
+		{name: "ASCII", raw: []byte(`"CAM01"`), want: "CAM01"},
+		{name: "padding", raw: []byte(`"CAM01\u0000\u0000  "`), want: "CAM01"},
+		{name: "UTF-8", raw: []byte(`"前门"`), want: "前门"},
+		{name: "HTML escapes", raw: []byte(`"<gate> & yard"`), want: "<gate> & yard"},
+		{name: "GB2312", raw: append(append([]byte(`"`), gbTitle...), '"'), want: "前门", wantLegacy: true},
+		{name: "GB2312 with escapes", raw: append(append([]byte(`"\"`), gbTitle...), []byte(`\t1\u0000"`)...), want: "\"前门\t1", wantLegacy: true},
+		{name: "GB2312 unquoted", raw: gbTitle, wantErr: true},
+		{name: "GB2312 bad escape", raw: append(append([]byte(`"`), gbTitle...), []byte(`\u12"`)...), wantErr: true},
+		{name: "GB2312 non-ASCII escape", raw: append(append([]byte(`"`), gbTitle...), []byte(`\u00e9"`)...), wantErr: true},
+		{name: "malformed UTF-8 JSON", raw: []byte(`CAM01`), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, legacy, err := decodeTitle(test.raw)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v", err)
+			}
+
+			if err == nil && (got != test.want || legacy != test.wantLegacy) {
+				t.Errorf("%q legacy %v, want %q legacy %v", got, legacy, test.want, test.wantLegacy)
+			}
+		})
+	}
+}
+
+func TestEncodeTitle(t *testing.T) {
+	tests := []struct {
+		name    string
+		title   string
+		legacy  bool
+		want    []byte
+		wantErr bool
+	}{
+		{name: "ASCII", title: "CAM01", want: []byte(`"CAM01"`)},
+		{name: "UTF-8", title: "前门", want: []byte(`"前门"`)},
+		{name: "HTML characters", title: "<gate> & yard", want: []byte(`"<gate> & yard"`)},
+		{name: "quotes", title: `"A"\B`, want: []byte(`"\"A\"\\B"`)},
+		{name: "GB2312", title: "前门", legacy: true, want: append(append([]byte(`"`), gbTitle...), '"')},
+		{name: "GB2312 ASCII", title: "<CAM01>", legacy: true, want: []byte(`"<CAM01>"`)},
+		{name: "GB2312 escapes", title: "\"前门\t", legacy: true, want: append(append([]byte(`"\"`), gbTitle...), []byte(`\u0009"`)...)},
+		{name: "not in GB2312", title: "cam 📷", legacy: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := encodeTitle(&buf, test.title, test.legacy)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v", err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if !bytes.Equal(buf.Bytes(), test.want) {
+				t.Fatalf("%q, want %q", buf.Bytes(), test.want)
+			}
+
+			// Decodes to the same title in the same encoding, UTF-8 is
+			// valid JSON
+			got, legacy, err := decodeTitle(buf.Bytes())
+			if err != nil || got != test.title || legacy != (test.legacy && !isASCII(test.title)) {
+				t.Errorf("decoded %q legacy %v [%v]", got, legacy, err)
+			}
+
+			if !test.legacy && !json.Valid(buf.Bytes()) {
+				t.Errorf("invalid JSON %s", buf.Bytes())
+			}
+		})
+	}
+}
+
+func isASCII(s string) bool {
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
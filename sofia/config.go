@@ -0,0 +1,262 @@
+package sofia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Time allowed for a bulk configuration export, firmware without it may
+// not answer at all
+const ConfigExportTimeout = 20 * time.Second
+
+// Format tag of JSON-per-section configuration backups
+const ConfigBackupFormat = "sofia-go/config-sections"
+
+// Configuration sections saved by the JSON-per-section fallback
+var ConfigSections = []string{
+	"General.General",
+	"General.Location",
+	"General.AutoMaintain",
+	"NetWork.NetCommon",
+	"NetWork.NetDHCP",
+	"NetWork.NetDNS",
+	"NetWork.NetNTP",
+	"NetWork.Upnp",
+	"NetWork.RTSP",
+	"NetWork.Wifi",
+	"NetWork.NetEmail",
+	"NetWork.NetFTP",
+	"Camera.Param",
+	"Camera.ParamEx",
+	"Simplify.Encode",
+	"AVEnc.VideoWidget",
+	"Detect.MotionDetect",
+	"Detect.BlindDetect",
+	"Detect.LossDetect",
+	"Alarm.LocalAlarm",
+	"Record",
+	"Storage.StorageNotExist",
+	"Storage.StorageLowSpace",
+	"Storage.StorageFailure",
+	"Uart.PTZ",
+	"fVideo.OsdInfo",
+}
+
+// Sections that can re-address the device, restored last
+var configAddressSections = []string{
+	"NetWork.NetDHCP",
+	"NetWork.NetCommon",
+}
+
+// JSON-per-section configuration backup
+type ConfigBackup struct {
+	Format   string                     // Always ConfigBackupFormat
+	Sections map[string]json.RawMessage // Section name to section value
+}
+
+// Get a configuration section, raw JSON value
+func (session *Session) GetConfig(name string) (json.RawMessage, error) {
+	var res map[string]json.RawMessage
+	if err := session.command(CONFIG_GET_REQ, CmdReqData{Name: name, SessionID: session.sessionID()}, &res); err != nil {
+		return nil, err
+	}
+
+	value, ok := res[name]
+	if !ok {
+		return nil, fmt.Errorf("config %s missing from response", name)
+	}
+
+	return value, nil
+}
+
+// Set a configuration section from a raw JSON value
+func (session *Session) SetConfig(name string, value json.RawMessage) error {
+	data := map[string]interface{}{
+		"Name":      name,
+		"SessionID": session.sessionID(),
+		name:        value,
+	}
+
+	return session.command(CONFIG_SET_REQ, data, nil)
+}
+
+// Export the full configuration, uses the bulk export command and falls back
+// to JSON-per-section if firmware doesn't support it. The bulk export must fit
+// a single CONFIG_EXPORT_RSP frame, a device splitting it across several
+// frames isn't supported and only the first one is saved.
+func (session *Session) ExportConfig(w io.Writer) error {
+	// Try bulk export
+	data, _ := json.Marshal(CmdReqData{Name: "", SessionID: session.sessionID()})
+
+	resMsg, err := session.exchange(CONFIG_EXPORT_REQ, data, ConfigExportTimeout, func(resId uint16) bool {
+		return resId == CONFIG_EXPORT_RSP
+	})
+	if errors.Is(err, ErrTimeout) {
+		session.device.logger.Info("Bulk config export not answered, using sections")
+
+		return session.ExportConfigSections(w, ConfigSections)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A JSON reply means the device didn't send a configuration file
+	var resData CmdResData2
+	if err := json.Unmarshal(resMsg.data, &resData); err == nil {
+		reason := CheckRet(resData.Ret)
+		if reason == nil {
+			reason = errors.New("no configuration data")
+		}
+
+		session.device.logger.Info("Bulk config export not available, using sections [", reason.Error(), "]")
+
+		return session.ExportConfigSections(w, ConfigSections)
+	}
+
+	_, err = w.Write(resMsg.data)
+
+	return err
+}
+
+// Export the given configuration sections as a JSON document, sections not
+// supported by the device are skipped
+func (session *Session) ExportConfigSections(w io.Writer, sections []string) error {
+	backup := ConfigBackup{
+		Format:   ConfigBackupFormat,
+		Sections: make(map[string]json.RawMessage),
+	}
+
+	for _, name := range sections {
+		value, err := session.GetConfig(name)
+		if err != nil {
+			var retErr RetError
+			if errors.As(err, &retErr) {
+				session.device.logger.Debug("Skipping config ", name, " [", err.Error(), "]")
+				continue
+			}
+
+			return err
+		}
+
+		backup.Sections[name] = value
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(&backup)
+}
+
+// Import a configuration previously saved by ExportConfig, either format. A
+// bulk configuration is sent in a single CONFIG_IMPORT_REQ frame, so at most
+// DeviceMessageMaxDataLen bytes.
+func (session *Session) ImportConfig(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// JSON-per-section backup
+	var backup ConfigBackup
+	if err := json.Unmarshal(data, &backup); err == nil && backup.Format == ConfigBackupFormat {
+		return session.ImportConfigSections(&backup)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return errors.New("empty configuration")
+	}
+
+	if len(data) > DeviceMessageMaxDataLen {
+		return fmt.Errorf("configuration of %d bytes doesn't fit a frame", len(data))
+	}
+
+	// Bulk import
+	resMsg, err := session.requestRaw(CONFIG_IMPORT_REQ, data)
+	if err != nil {
+		return err
+	}
+
+	var resData CmdResData2
+	if err := json.Unmarshal(resMsg.data, &resData); err != nil {
+		return err
+	}
+
+	return CheckRet(resData.Ret)
+}
+
+// Import a JSON-per-section backup, all sections are attempted and the first
+// error is returned. Sections are applied in ConfigSections order with the
+// network sections last, those that re-address the device at the very end.
+func (session *Session) ImportConfigSections(backup *ConfigBackup) error {
+	var firstErr error
+
+	for _, name := range ConfigSectionOrder(backup.Sections) {
+		value := backup.Sections[name]
+		if err := session.SetConfig(name, value); err != nil {
+			session.device.logger.Error("Unable to restore config ", name, " [", err.Error(), "]")
+
+			if firstErr == nil {
+				firstErr = fmt.Errorf("config %s: %w", name, err)
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// Order in which the sections of a backup are restored: ConfigSections order
+// (unknown sections sorted by name after the known ones), network sections
+// after all others and addressing sections last
+func ConfigSectionOrder(sections map[string]json.RawMessage) []string {
+	index := make(map[string]int, len(ConfigSections))
+	for idx, name := range ConfigSections {
+		index[name] = idx
+	}
+
+	// Group, then position within the group
+	rank := func(name string) (int, int) {
+		for idx, addr := range configAddressSections {
+			if name == addr {
+				return 2, idx
+			}
+		}
+
+		group := 0
+		if strings.HasPrefix(name, "NetWork.") {
+			group = 1
+		}
+
+		if idx, ok := index[name]; ok {
+			return group, idx
+		}
+
+		return group, len(ConfigSections)
+	}
+
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		gi, pi := rank(names[i])
+		gj, pj := rank(names[j])
+
+		switch {
+		case gi != gj:
+			return gi < gj
+		case pi != pj:
+			return pi < pj
+		}
+
+		return names[i] < names[j]
+	})
+
+	return names
+}
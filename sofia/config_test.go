@@ -0,0 +1,135 @@
+package sofia_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+func TestConfigSectionOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		sections []string
+		want     []string
+	}{
+		{
+			name:     "known sections",
+			sections: []string{"Record", "Camera.Param", "General.General"},
+			want:     []string{"General.General", "Camera.Param", "Record"},
+		},
+		{
+			name:     "network last",
+			sections: []string{"NetWork.NetNTP", "Record", "NetWork.NetDNS", "General.Location"},
+			want:     []string{"General.Location", "Record", "NetWork.NetDNS", "NetWork.NetNTP"},
+		},
+		{
+			name:     "addressing at the very end",
+			sections: []string{"NetWork.NetCommon", "NetWork.NetDHCP", "NetWork.RTSP", "Uart.PTZ", "General.General"},
+			want:     []string{"General.General", "Uart.PTZ", "NetWork.RTSP", "NetWork.NetDHCP", "NetWork.NetCommon"},
+		},
+		{
+			name:     "unknown sections after known ones of their group",
+			sections: []string{"Zeta.Custom", "NetWork.OnvifPwdCheckout", "Alpha.Custom", "fVideo.OsdInfo", "NetWork.Wifi", "NetWork.NetCommon"},
+			want:     []string{"fVideo.OsdInfo", "Alpha.Custom", "Zeta.Custom", "NetWork.Wifi", "NetWork.OnvifPwdCheckout", "NetWork.NetCommon"},
+		},
+		{
+			name: "empty",
+			want: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sections := make(map[string]json.RawMessage)
+			for _, name := range test.sections {
+				sections[name] = json.RawMessage(`{}`)
+			}
+
+			// Map order is random, any run must give the same order
+			for run := 0; run < 10; run++ {
+				if got := sofia.ConfigSectionOrder(sections); !reflect.DeepEqual(got, test.want) {
+					t.Fatalf("order %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+// Binary configuration file, not ending in a trailer
+var testConfigFile = append([]byte("PK\x03\x04"), bytes.Repeat([]byte{0x00, 0x7F, 0xFF, 0x0A}, 1000)...)
+
+func TestExportConfigBulk(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+	server.Handle(sofia.CONFIG_EXPORT_REQ, func(conn *sofiatest.Conn, req sofiatest.Frame) error {
+		return conn.Send(sofiatest.Frame{SessionID: req.SessionID, SeqNum: req.SeqNum, MsgID: sofia.CONFIG_EXPORT_RSP, Data: testConfigFile})
+	})
+
+	var imported []byte
+	server.Handle(sofia.CONFIG_IMPORT_REQ, func(conn *sofiatest.Conn, req sofiatest.Frame) error {
+		imported = req.Data
+		return conn.Reply(req, map[string]interface{}{"Name": "", "Ret": sofia.RetOK})
+	})
+
+	session := loginSession(t, connectDevice(t, server, nil, nil))
+
+	var backup bytes.Buffer
+	if err := session.ExportConfig(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(backup.Bytes(), testConfigFile) {
+		t.Fatalf("exported %d bytes, want the %d bytes of the device", backup.Len(), len(testConfigFile))
+	}
+
+	if err := session.ImportConfig(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(imported, testConfigFile) {
+		t.Errorf("imported %d bytes, want %d", len(imported), len(testConfigFile))
+	}
+
+	if n := countRequests(server, sofia.CONFIG_GET_REQ); n != 0 {
+		t.Errorf("%d sections requested", n)
+	}
+}
+
+func TestExportConfigRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		ret  int
+	}{
+		{name: "error code", ret: sofia.RetIllegalRequest},
+		{name: "success without data", ret: sofia.RetOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startServer(t, sofiatest.Config{})
+			server.Handle(sofia.CONFIG_EXPORT_REQ, func(conn *sofiatest.Conn, req sofiatest.Frame) error {
+				return conn.Reply(req, map[string]interface{}{"Name": "", "Ret": test.ret})
+			})
+
+			session := loginSession(t, connectDevice(t, server, nil, nil))
+
+			// Sections are exported instead
+			var backup bytes.Buffer
+			if err := session.ExportConfig(&backup); err != nil {
+				t.Fatal(err)
+			}
+
+			var exported sofia.ConfigBackup
+			if err := json.Unmarshal(backup.Bytes(), &exported); err != nil || exported.Format != sofia.ConfigBackupFormat {
+				t.Fatalf("export [%v] %s", err, backup.Bytes())
+			}
+
+			if _, ok := exported.Sections["NetWork.NetCommon"]; !ok {
+				t.Errorf("exported sections %v", exported.Sections)
+			}
+		})
+	}
+}
@@ -3,9 +3,12 @@ package sofia
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -15,31 +18,66 @@ import (
  *
  */
 type Device struct {
-	logger         *logrus.Entry   // Device scoped logger
-	txBuf          *bytes.Buffer   // Transmit buffer
-	host           string          // Host, IP address or hostname
-	port           string          // Port
-	connectTimeout time.Duration   // Connect timeout
-	connectRetries uint8           // Connect retries
-	transport      net.Conn        // Transport connection
-	sequence       *Sequence       // Sequence of indices
-	sessions       []*Session      // Actual sessions
-	tmpSessions    []*Session      // Temporary sessions (discarded after LOGIN_RSP)
-	wg             *sync.WaitGroup // Wait groups for sessions
-	rxChan         chan error      // Device receive channel
+	logger         *logrus.Entry         // Device scoped logger
+	txBuf          *bytes.Buffer         // Transmit buffer
+	txMutex        sync.Mutex            // Serializes transmits, protects txBuf
+	writeTimeout   time.Duration         // Write deadline per message
+	host           string                // Host, IP address or hostname
+	port           string                // Port
+	connectTimeout time.Duration         // Connect timeout
+	connectRetries uint8                 // Connect retries
+	transport      net.Conn              // Transport connection
+	dialer         Dialer                // Opens transport connections
+	sequence       *Sequence             // Sequence of indices
+	sessions       []*Session            // Actual sessions
+	tmpSessions    []*Session            // Temporary sessions (discarded after LOGIN_RSP)
+	wg             *sync.WaitGroup       // Wait group for the worker
+	rxChan         chan error            // Device receive channel, signaled once when the device stops
+	stopOnce       sync.Once             // Signals rxChan once
+	closed         bool                  // Closed by Close
+	closing        chan struct{}         // Closed by Close, fails pending requests and interrupts reconnect delays
+	mutex          sync.Mutex            // Protects transport, connection state and sessions
+	state          DeviceState           // Connection state
+	stateQ         chan DeviceStateEvent // Connection state events
+	policy         *ReconnectPolicy      // Reconnect policy, nil if not supervised
+	lost           chan struct{}         // Closed when the transport connection is lost
+	queueLen       int                   // Queue length of new sessions
+	queuePolicy    QueuePolicy           // Queue overflow policy of new sessions
 }
 
+// Errors
+var (
+	ErrNotConnected  = errors.New("device not connected")
+	ErrTimeout       = errors.New("no response from device")
+	ErrDeviceClosed  = errors.New("device closed")
+	ErrTooManyLogins = errors.New("too many pending logins")
+	ErrBadHeader     = errors.New("invalid message header")
+)
+
+// Local ids of logins not answered within are reclaimed
+const PendingLoginTimeout = 30 * time.Second
+
 /*
- *
+ * Receives the reason the device stopped (nil after Close) once, then is
+ * closed. A supervised device only stops on Close or when reconnecting gives up.
  */
 func (device *Device) WorkerChan() *chan error {
 	return &device.rxChan
 }
 
+/*
+ * Time allowed to write a message, 0 for none. Defaults to the connect timeout.
+ */
+func (device *Device) SetWriteTimeout(timeout time.Duration) {
+	device.txMutex.Lock()
+	device.writeTimeout = timeout
+	device.txMutex.Unlock()
+}
+
 /*
  *
  */
-func NewDevice(host string, port string, timeout uint16, retries uint8, logger *logrus.Logger) (*Device, error) {
+func NewDevice(host string, port string, timeout uint16, retries uint8, logger *logrus.Logger, options ...DeviceOption) (*Device, error) {
 	// Allocate a new device
 	var device *Device = new(Device)
 
@@ -53,7 +91,9 @@ func NewDevice(host string, port string, timeout uint16, retries uint8, logger *
 		device.host = host
 		device.port = port
 		device.connectTimeout = time.Second * time.Duration(timeout)
+		device.writeTimeout = device.connectTimeout
 		device.connectRetries = retries
+		device.dialer = TCPDialer()
 	}
 
 	// Initialize and setup device logger
@@ -64,14 +104,23 @@ func NewDevice(host string, port string, timeout uint16, retries uint8, logger *
 	// Initialize sessions
 	{
 		device.sequence = NewSequence(0xFF)
-		device.sessions = make([]*Session, 0xFF)
-		device.tmpSessions = make([]*Session, 0xFF)
+		device.sessions = make([]*Session, 0x100)
+		device.tmpSessions = make([]*Session, 0x100)
 	}
 
 	// Setup worker channel
 	{
 		device.wg = new(sync.WaitGroup)
-		device.rxChan = make(chan error)
+		device.rxChan = make(chan error, 1)
+		device.stateQ = make(chan DeviceStateEvent, 16)
+		device.closing = make(chan struct{})
+	}
+
+	// Apply options
+	for _, option := range options {
+		if err := option(device); err != nil {
+			return nil, err
+		}
 	}
 
 	return device, nil
@@ -81,22 +130,75 @@ func NewDevice(host string, port string, timeout uint16, retries uint8, logger *
  *
  */
 func DeleteDevice(device *Device) {
+	device.Close()
+}
+
+/*
+ * Fail pending requests, logout idle sessions, close the transport
+ * connection and stop the worker
+ */
+func (device *Device) Close() error {
+	device.mutex.Lock()
+	if device.closed {
+		device.mutex.Unlock()
+		return nil
+	}
+	device.closed = true
+	device.policy = nil
+	close(device.closing)
+
+	var sessions []*Session
+	for _, list := range [][]*Session{device.sessions, device.tmpSessions} {
+		for _, session := range list {
+			if session != nil {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	transport := device.transport
+	device.mutex.Unlock()
+
+	// Logout sessions, pending requests failed when closing was closed
+	for _, session := range sessions {
+		session.abandon()
+	}
+
+	// Stop worker
+	if transport != nil {
+		device.detach(transport, nil)
+	}
+	device.wg.Wait()
 
+	device.stop(nil)
+
+	return nil
+}
+
+/*
+ * Signal the device stopped, only the first call has an effect
+ */
+func (device *Device) stop(err error) {
+	device.stopOnce.Do(func() {
+		device.rxChan <- err
+		close(device.rxChan)
+	})
 }
 
 /*
  *
  */
 func (device *Device) Connect() error {
+	device.setState(DeviceConnecting, nil, 0)
+
 	// Try to connect to device
 	var err error
 	{
 		for try := 1; try <= int(device.connectRetries); try++ {
-			if device.transport, err = net.DialTimeout("tcp", device.host+":"+device.port, device.connectTimeout); err == nil {
+			var transport net.Conn
+			if transport, err = device.dial(); err == nil {
 				device.logger.Debug("Connected successfully in try ", try)
 
-				// Start worker
-				go device.worker()
+				err = device.attach(transport)
 
 				break
 			}
@@ -105,47 +207,183 @@ func (device *Device) Connect() error {
 		}
 	}
 
+	if err != nil {
+		device.setState(DeviceDisconnected, err, 0)
+	}
+
 	return err
 }
 
+/*
+ * Use a new transport connection and start its worker
+ */
+func (device *Device) attach(transport net.Conn) error {
+	lost := make(chan struct{})
+
+	device.mutex.Lock()
+	if device.closed {
+		device.mutex.Unlock()
+		transport.Close()
+		return ErrDeviceClosed
+	}
+	device.transport = transport
+	device.lost = lost
+	device.wg.Add(1)
+	device.mutex.Unlock()
+
+	device.setState(DeviceConnected, nil, 0)
+
+	// Start worker
+	go device.worker(transport)
+
+	return nil
+}
+
+/*
+ * Transport connection lost, reconnect if supervised
+ */
+func (device *Device) detach(transport net.Conn, err error) {
+	device.mutex.Lock()
+	if device.transport != transport {
+		// Already replaced
+		device.mutex.Unlock()
+		return
+	}
+	device.transport = nil
+	close(device.lost)
+	policy := device.policy
+	device.mutex.Unlock()
+
+	transport.Close()
+	device.setState(DeviceDisconnected, err, 0)
+
+	if policy != nil {
+		go device.reconnect(*policy)
+	} else if err != nil {
+		device.stop(err)
+	}
+}
+
+/*
+ * Drop the transport connection, e.g. when the device stopped answering
+ */
+func (device *Device) Fail(err error) {
+	device.mutex.Lock()
+	transport := device.transport
+	device.mutex.Unlock()
+
+	if transport != nil {
+		device.logger.Error("Dropping connection [", err.Error(), "]")
+		device.detach(transport, err)
+	}
+}
+
 /*
  *
  */
-func (device *Device) NewSession(user string, password string) *Session {
+func (device *Device) NewSession(user string, password string) (*Session, error) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	// Get new session
+	session := NewSession(device, 0, user, password)
+
 	// Generate a new local session id
+	if err := device.register(session); err != nil {
+		return nil, err
+	}
+
+	device.logger.Info("Created new session with local ID ", session.opaqueId)
+
+	return session, nil
+}
+
+/*
+ * Add a temporary session under a new local id, ids of logins abandoned
+ * for PendingLoginTimeout are reclaimed first. Must be called with mutex held.
+ */
+func (device *Device) register(session *Session) error {
+	for _, localId := range device.sequence.Reclaim(PendingLoginTimeout) {
+		if abandoned := device.tmpSessions[localId]; abandoned != nil {
+			device.logger.Info("Reclaimed local ID ", localId, " of abandoned login")
+			abandoned.stateMutex.Lock()
+			abandoned.opaqueId = 0
+			abandoned.stateMutex.Unlock()
+			device.tmpSessions[localId] = nil
+		}
+	}
+
 	localId := device.sequence.GetIndex()
 	if localId == 0 {
-		return nil
+		return ErrTooManyLogins
 	}
 
-	// Get new session
-	session := NewSession(device, localId, user, password)
-
-	device.logger.Info("Created new session with local ID ", localId)
+	session.stateMutex.Lock()
+	session.opaqueId = localId
+	session.stateMutex.Unlock()
 
-	// Add an entry
 	device.tmpSessions[localId] = session
 
-	return session
+	return nil
+}
+
+/*
+ * Prepare a session to login, registers it again if its local id was reclaimed
+ */
+func (device *Device) pendingLogin(session *Session) error {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	if session.opaqueId == 0 || device.tmpSessions[session.opaqueId] != session {
+		return device.register(session)
+	}
+
+	device.sequence.Touch(session.opaqueId)
+
+	return nil
 }
 
 /*
  *
  */
-func (device *Device) DeleteSession() {
+func (device *Device) DeleteSession(session *Session) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
 
+	if device.tmpSessions[session.opaqueId] == session {
+		device.tmpSessions[session.opaqueId] = nil
+		device.sequence.FreeIndex(session.opaqueId)
+	}
+
+	if device.sessions[session.id] == session {
+		device.sessions[session.id] = nil
+	}
 }
 
 /*
  *
  */
-func (device *Device) worker() {
+func (device *Device) worker(transport net.Conn) {
+	var err error
+	defer func() {
+		device.detach(transport, err)
+		device.wg.Done()
+	}()
+
 	for {
 		// Read message header
 		hbuf := make([]byte, DeviceMessageHeaderLen)
-		hrlen, err := io.ReadFull(device.transport, hbuf)
+		var hrlen, drlen int
+		hrlen, err = io.ReadFull(transport, hbuf)
 		if err != nil {
-			device.logger.Error("Connection closed [reading header] ", err.Error())
+			device.readError(transport, "reading header", err)
+			break
+		}
+
+		// Stream is out of sync or corrupt, nothing to resync on
+		if !ValidMessageHeader(hbuf) {
+			err = ErrBadHeader
+			device.logger.Error("Connection closed [invalid header] ", hex.EncodeToString(hbuf))
 			break
 		}
 
@@ -154,9 +392,9 @@ func (device *Device) worker() {
 
 		// Read rest of message
 		dbuf := make([]byte, hdr.dataLen)
-		drlen, err := io.ReadFull(device.transport, dbuf)
+		drlen, err = io.ReadFull(transport, dbuf)
 		if err != nil {
-			device.logger.Error("Connection closed [reading data] ", err.Error())
+			device.readError(transport, "reading data", err)
 			break
 		}
 
@@ -169,7 +407,7 @@ func (device *Device) worker() {
 			sessionId: hdr.sessionId,
 			seqNum:    hdr.seqNum,
 			dataLen:   hdr.dataLen,
-			data:      dbuf[:hdr.dataLen-DeviceMessageTrailerLen],
+			data:      TrimMessagePayload(hdr.msgId, dbuf),
 		}
 
 		// All messages for device require a valid session ID that we receive
@@ -178,16 +416,22 @@ func (device *Device) worker() {
 
 		var session *Session
 		{
+			device.mutex.Lock()
+
 			if msg.msgId == LOGIN_RSP {
 				// Find session using the internal id
 				if session = device.tmpSessions[msg.opaqueId]; session == nil {
+					device.mutex.Unlock()
 					device.logger.Info("Unexpected local session ID ", msg.opaqueId)
 					continue
 				}
 
 				// Update actual session ID, session and release temporary session
 				{
+					session.stateMutex.Lock()
 					session.id = msg.sessionId
+					session.stateMutex.Unlock()
+
 					device.sessions[session.id] = session
 					device.tmpSessions[msg.opaqueId] = nil
 					device.sequence.FreeIndex(msg.opaqueId)
@@ -195,36 +439,86 @@ func (device *Device) worker() {
 			} else {
 				// Find session using device session id
 				if session = device.sessions[msg.sessionId]; session == nil {
+					device.mutex.Unlock()
 					device.logger.Info("Unexpected device session ID ", msg.sessionId)
 					continue
 				}
 			}
+
+			device.mutex.Unlock()
 		}
 
 		// Increment sequence number
-		session.seqNum = session.seqNum + 1
+		atomic.AddUint32(&session.seqNum, 1)
 
-		// Send message to session
-		session.rxChan <- msg
+		// Queue message for session, never waits for the session
+		session.enqueue(msg)
 	}
 }
 
+/*
+ * Log a failed read, a connection closed locally (Close, Fail) is no error
+ */
+func (device *Device) readError(transport net.Conn, what string, err error) {
+	device.mutex.Lock()
+	local := device.transport != transport
+	device.mutex.Unlock()
+
+	if local {
+		device.logger.Debug("Connection closed locally [", what, "]")
+		return
+	}
+
+	device.logger.Error("Connection closed [", what, "] ", err.Error())
+}
+
 /*
  *
  */
 func (device *Device) SendMessage(msg *DeviceMessage) error {
+	_, err := device.send(msg)
+
+	return err
+}
+
+/*
+ * Send a message, returns a channel closed when the connection the message
+ * was sent on is lost
+ */
+func (device *Device) send(msg *DeviceMessage) (chan struct{}, error) {
+	device.mutex.Lock()
+	transport, lost := device.transport, device.lost
+	device.mutex.Unlock()
+
+	if transport == nil {
+		return nil, ErrNotConnected
+	}
+
+	device.txMutex.Lock()
+	defer device.txMutex.Unlock()
+
 	// Always reset the Tx buffer
 	device.txBuf.Reset()
 
 	// Encode message
 	EncodeMessage(msg, device.txBuf)
 
-	// Send message
-	writeLen, err := device.transport.Write(device.txBuf.Bytes())
+	// Send message, a write that doesn't complete in time leaves a partial
+	// message on the stream so the connection is dropped
+	if device.writeTimeout > 0 {
+		transport.SetWriteDeadline(time.Now().Add(device.writeTimeout))
+	}
+
+	writeLen, err := transport.Write(device.txBuf.Bytes())
+	if err != nil {
+		device.logger.Error("Unable to send message [", msg.msgId, "] [", err.Error(), "]")
+		device.detach(transport, err)
+		return nil, err
+	}
 
 	device.logger.Debug("Tx message [", msg.msgId, "], length [", writeLen, "]")
 
-	return err
+	return lost, err
 }
 
 /*
@@ -316,6 +610,17 @@ func DecodeMessageHeader(buf []byte) DeviceMessageHeader {
 	return hdr
 }
 
+// Does buffer start with a plausible message header
+func ValidMessageHeader(buf []byte) bool {
+	if len(buf) < DeviceMessageHeaderLen || buf[0] != 0xFF {
+		return false
+	}
+
+	hdr := DecodeMessageHeader(buf)
+
+	return hdr.version <= 1 && hdr.dataLen <= DeviceMessageMaxDataLen
+}
+
 /*
  *
  */
@@ -328,7 +633,13 @@ func DecodeMessage(buf []byte) DeviceMessage {
 		msg.seqNum = buf[DeviceMessageOffsetSeqNum]                                // Sequence number
 		msg.msgId = binary.LittleEndian.Uint16(buf[DeviceMessageOffsetMsgId:])     // Message ID
 		msg.dataLen = binary.LittleEndian.Uint32(buf[DeviceMessageOffsetDataLen:]) // Data length
-		msg.data = buf[DeviceMessageOffsetData:]                                   // Truncate the message trailer
+		msg.data = buf[DeviceMessageOffsetData:]                                   // Data
+
+		// Bound data by data length and truncate the message trailer
+		if uint32(len(msg.data)) > msg.dataLen {
+			msg.data = msg.data[:msg.dataLen]
+		}
+		msg.data = TrimMessagePayload(msg.msgId, msg.data)
 
 		// Extract login correlation id
 		if msg.msgId == LOGIN_RSP {
@@ -338,3 +649,27 @@ func DecodeMessage(buf []byte) DeviceMessage {
 
 	return msg
 }
+
+/*
+ * JSON payloads carry a 0x0A,0x00 trailer, binary payloads (file transfer)
+ * don't, so only strip it when present
+ */
+func TrimMessageTrailer(data []byte) []byte {
+	if n := len(data); n >= DeviceMessageTrailerLen && data[n-2] == 0x0A && data[n-1] == 0x00 {
+		return data[:n-DeviceMessageTrailerLen]
+	}
+
+	return data
+}
+
+/*
+ * Strip the trailer of a message payload, media payloads (MONITOR_DATA) are
+ * binary chunks that may end in anything
+ */
+func TrimMessagePayload(msgId uint16, data []byte) []byte {
+	if msgId == MONITOR_DATA {
+		return data
+	}
+
+	return TrimMessageTrailer(data)
+}
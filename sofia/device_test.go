@@ -0,0 +1,111 @@
+package sofia_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDeviceCloseWithPendingRequest(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+
+	// Never answered
+	server.InjectFault(sofiatest.FaultOn(sofia.SYSINFO_REQ, sofiatest.Fault{Drop: true}))
+
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	device := connectDevice(t, server, logger, nil)
+	sessions := []*sofia.Session{loginSession(t, device), loginSession(t, device)}
+	sessions[0].SetRequestTimeout(0)
+
+	// First session waits for ever, the second one is idle
+
+	pending := make(chan error, 1)
+	go func() {
+		_, err := sessions[0].SystemInfo()
+		pending <- err
+	}()
+
+	for deadline := time.Now().Add(2 * time.Second); countRequests(server, sofia.SYSINFO_REQ) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("request not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	device.Close()
+
+	if elapsed := time.Since(start); elapsed > sofia.CloseLogoutTimeout+time.Second {
+		t.Errorf("Close took %s", elapsed)
+	}
+
+	select {
+	case err := <-pending:
+		if err != sofia.ErrDeviceClosed {
+			t.Errorf("pending request [%v], want %v", err, sofia.ErrDeviceClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending request still waiting")
+	}
+
+	// The idle session logged out
+	if logouts := countRequests(server, sofia.LOGOUT_REQ); logouts == 0 {
+		t.Error("idle session not logged out")
+	}
+
+	// A local close is no error
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= logrus.ErrorLevel {
+			t.Errorf("logged %s: %s", entry.Level, entry.Message)
+		}
+	}
+}
+
+// Requests with message ID msgId the fake device received
+func countRequests(server *sofiatest.Server, msgId uint16) int {
+	count := 0
+	for _, req := range server.Requests() {
+		if req.MsgID == msgId {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestValidMessageHeader(t *testing.T) {
+	header := func(version byte, dataLen uint32) []byte {
+		buf := (sofiatest.Frame{Version: version, MsgID: sofia.KEEPALIVE_REQ}).Bytes()
+		binary.LittleEndian.PutUint32(buf[sofia.DeviceMessageOffsetDataLen:], dataLen)
+		return buf
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+		want bool
+	}{
+		{name: "version 0", buf: header(0, 0), want: true},
+		{name: "version 1", buf: header(1, 0), want: true},
+		{name: "largest payload", buf: header(0, sofia.DeviceMessageMaxDataLen), want: true},
+		{name: "payload too large", buf: header(0, sofia.DeviceMessageMaxDataLen+1)},
+		{name: "unknown version", buf: header(2, 0)},
+		{name: "no marker", buf: append([]byte{0xFE}, header(0, 0)[1:]...)},
+		{name: "short", buf: header(0, 0)[:sofia.DeviceMessageHeaderLen-1]},
+		{name: "empty"},
+	}
+
+	for _, test := range tests {
+		if got := sofia.ValidMessageHeader(test.buf); got != test.want {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
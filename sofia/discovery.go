@@ -2,8 +2,15 @@ package sofia
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -40,14 +47,171 @@ Broadcast UDP sent from factory reset devices on port 34569
 }
 */
 
+// Errors
+var (
+	ErrDiscoveryStarted = errors.New("discovery already started")
+	ErrDiscoveryStopped = errors.New("discovery stopped")
+)
+
 type Discovery struct {
-	logger   *logrus.Entry      // Contextual logger
-	txBuf    *bytes.Buffer      // Transmit buffer
-	interval time.Duration      // Interval for discovery broadcast
-	addr     *net.UDPAddr       // Address
-	baddr    *net.UDPAddr       // Broadcast address
-	conn     *net.UDPConn       // Listen connection
-	mQ       chan DeviceMessage // Message Q
+	logger   *logrus.Entry         // Contextual logger
+	txBuf    *bytes.Buffer         // Transmit buffer
+	interval time.Duration         // Interval for discovery broadcast
+	addr     *net.UDPAddr          // Address
+	baddr    *net.UDPAddr          // Broadcast address
+	ifaces   []*discoveryIface     // Interfaces to discover on
+	hosts    []*net.UDPAddr        // Unicast probe targets
+	mQ       chan DiscoveredDevice // Message Q
+	stateMu  sync.Mutex            // Protects cancel and stopped
+	cancel   context.CancelFunc    // Stops tasks
+	stopped  bool                  // Stop was called
+	wg       sync.WaitGroup        // Running tasks
+	stopOnce sync.Once             // Stop exactly once
+	watchMu  sync.Mutex            // Protects watchers
+	watchers []*discoveryWatch     // Internal consumers of responses
+	setMu    sync.Mutex            // Serialises IP_SET requests
+	passive  bool                  // Only listen, never send
+	ports    []uint16              // Additional ports to listen on in passive mode
+	fQ       chan DiscoveredFrame  // Frame Q (passive mode)
+	netsMu   sync.Mutex            // Protects nets
+	nets     []localNet            // Subnets of local interfaces, listed on Start
+}
+
+// Subnet of a local interface
+type localNet struct {
+	name  string     // Interface name
+	ipnet *net.IPNet // IPv4 subnet
+}
+
+// Internal consumer of responses, sees all responses regardless of mQ
+type discoveryWatch struct {
+	devices chan DiscoveredDevice // IPSEARCH_RSP
+	ipSet   chan DeviceMessage    // IP_SET_RSP
+}
+
+// Interface discovery runs on
+type discoveryIface struct {
+	name  string         // Interface name, empty for any interface
+	nets  []*net.IPNet   // IPv4 subnets of interface
+	conn  *net.UDPConn   // Listen connection
+	extra []*net.UDPConn // Passive listen connections on other ports
+}
+
+// Frame received in passive mode
+type DiscoveredFrame struct {
+	Message   DeviceMessage // Decoded message
+	Source    *net.UDPAddr  // Address the frame came from
+	Interface string        // Interface the frame arrived on, empty if unknown
+	Port      uint16        // Local port the frame arrived on
+}
+
+// Device found by discovery
+type DiscoveredDevice struct {
+	SerialNo      string           // Serial number
+	MAC           net.HardwareAddr // MAC address
+	HostName      string           // Host name
+	HostIP        net.IP           // IP address
+	Submask       net.IPMask       // Subnet mask
+	GateWay       net.IP           // Default gateway
+	TCPPort       uint16           // DVRIP port
+	UDPPort       uint16           // UDP port
+	HttpPort      uint16           // Web port
+	SSLPort       uint16           // SSL port
+	TCPMaxConn    uint32           // Maximum TCP connections
+	MaxBps        uint32           // Maximum bit rate
+	MonMode       string           // Monitor transport
+	TransferPlan  string           // Transfer plan
+	UseHSDownLoad bool             // High speed download
+	Version       string           // Firmware version
+	BuildDate     time.Time        // Firmware build date
+	OtherFunction string           // Vendor specific
+	DeviceType    uint32           // Device type
+	Source        *net.UDPAddr     // Address the response came from
+	Interface     string           // Interface the response arrived on, empty if unknown
+}
+
+// Decode IPSEARCH_RSP data
+func DecodeDiscoveredDevice(data []byte) (DiscoveredDevice, error) {
+	var device DiscoveredDevice
+
+	var resData SysIPSearchData
+	if err := json.Unmarshal(data, &resData); err != nil {
+		return device, err
+	}
+
+	if err := CheckRet(resData.Ret); err != nil {
+		return device, err
+	}
+
+	netCommon := &resData.NetWork
+	{
+		device.SerialNo = netCommon.SN
+		device.HostName = netCommon.HostName
+		device.TCPPort = uint16(netCommon.TCPPort)
+		device.UDPPort = uint16(netCommon.UDPPort)
+		device.HttpPort = uint16(netCommon.HttpPort)
+		device.SSLPort = uint16(netCommon.SSLPort)
+		device.TCPMaxConn = netCommon.TCPMaxConn
+		device.MaxBps = netCommon.MaxBps
+		device.MonMode = netCommon.MonMode
+		device.TransferPlan = netCommon.TransferPlan
+		device.UseHSDownLoad = netCommon.UseHSDownLoad
+		device.Version = netCommon.Version
+		device.BuildDate = parseDeviceTime(netCommon.BuildDate)
+		device.OtherFunction = netCommon.OtherFunction
+		device.DeviceType = netCommon.DeviceType
+	}
+
+	// Addresses
+	{
+		var err error
+
+		if device.MAC, err = net.ParseMAC(netCommon.MAC); err != nil {
+			return device, err
+		}
+
+		if device.HostIP, err = ParseHexIP(netCommon.HostIP); err != nil {
+			return device, err
+		}
+
+		if device.GateWay, err = ParseHexIP(netCommon.GateWay); err != nil {
+			return device, err
+		}
+
+		mask, err := ParseHexIP(netCommon.Submask)
+		if err != nil {
+			return device, err
+		}
+		device.Submask = net.IPMask(mask)
+	}
+
+	return device, nil
+}
+
+// Parse hex encoded little-endian IPv4 address, e.g. "0x0a01a8c0" is 192.168.1.10
+func ParseHexIP(str string) (net.IP, error) {
+	num, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(str), "0x"), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", str)
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(ip, uint32(num))
+
+	return ip, nil
+}
+
+// Format IPv4 address as hex encoded little-endian, inverse of ParseHexIP
+func FormatHexIP(ip []byte) string {
+	if ip4 := net.IP(ip).To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if len(ip) != net.IPv4len {
+		return "0x00000000"
+	}
+
+	return fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(ip))
 }
 
 // Create a new Discovery
@@ -73,8 +237,12 @@ func NewDiscovery(port uint16, interval uint32, logger *logrus.Logger) (*Discove
 		discovery.addr.Port = int(port)
 	}
 
-	// Create channel
-	discovery.mQ = make(chan DeviceMessage, 100)
+	// Discover on any interface
+	discovery.ifaces = []*discoveryIface{{}}
+
+	// Create channels
+	discovery.mQ = make(chan DiscoveredDevice, 100)
+	discovery.fQ = make(chan DiscoveredFrame, 100)
 
 	// Initialize logger
 	discovery.logger = logger.WithFields(logrus.Fields{
@@ -103,31 +271,120 @@ func dumpJSON(name string, amap map[string]interface{}, level string) {
 			fmt.Printf("struct\n")
 			dumpJSON("", v.(map[string]interface{}), level)
 		case float64:
-			fmt.Printf("uint32 `json: \"%s\"`", string(k))
+			fmt.Printf("uint32 `json:\"%s\"`", string(k))
 		default:
-			fmt.Printf("%T `json: \"%s\"`", v, string(k))
+			fmt.Printf("%T `json:\"%s\"`", v, string(k))
 
 		}
 		fmt.Printf("\n")
 	}
 	if len(olevel) > 0 {
-		fmt.Printf("%s} `json: \"%s\"`\n", olevel, "PH")
+		fmt.Printf("%s} `json:\"%s\"`\n", olevel, "PH")
 	} else {
 		fmt.Printf("%s}\n", olevel)
 	}
 }
 
-// Message Q
+// Message Q, responses are dropped when it is full
 //
-func (discover *Discovery) MQ() *chan DeviceMessage {
+func (discover *Discovery) MQ() *chan DiscoveredDevice {
 	return &discover.mQ
 }
 
+// Frame Q, every Sofia frame received in passive mode. Frames are dropped
+// when it is full.
+//
+func (discover *Discovery) FrameQ() *chan DiscoveredFrame {
+	return &discover.fQ
+}
+
+// Passive mode, only listen on the discovery port and the given ports (e.g.
+// the device UDP port 34568) without sending probes. Devices announcing
+// themselves still appear on the message Q, all frames appear on the frame Q.
+// Must be called before Start.
+//
+func (discovery *Discovery) SetPassive(ports []uint16) {
+	discovery.passive = true
+	discovery.ports = nil
+
+	for _, port := range ports {
+		if int(port) != discovery.addr.Port {
+			discovery.ports = append(discovery.ports, port)
+		}
+	}
+}
+
+// Discover on the named interfaces only, a probe is broadcast on each
+// interface and to the directed broadcast address of each of its subnets.
+// Must be called before Start.
+//
+func (discovery *Discovery) SetInterfaces(names []string) error {
+	ifaces := make([]*discoveryIface, 0, len(names))
+
+	for _, name := range names {
+		netIface, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("interface %s [%w]", name, err)
+		}
+
+		iface := &discoveryIface{name: name}
+		if iface.nets, err = interfaceNets(netIface); err != nil {
+			return fmt.Errorf("interface %s [%w]", name, err)
+		}
+
+		ifaces = append(ifaces, iface)
+	}
+
+	if len(ifaces) == 0 {
+		ifaces = append(ifaces, &discoveryIface{})
+	}
+
+	discovery.ifaces = ifaces
+
+	return nil
+}
+
+// Also probe the given hosts by unicast, e.g. devices behind routers. Hosts
+// may carry a port ("host:port"), the discovery port is used otherwise.
+// Must be called before Start.
+//
+func (discovery *Discovery) SetProbeHosts(hosts []string) error {
+	addrs := make([]*net.UDPAddr, 0, len(hosts))
+
+	for _, host := range hosts {
+		port := discovery.addr.Port
+		if hostOnly, portStr, err := net.SplitHostPort(host); err == nil {
+			if port, err = strconv.Atoi(portStr); err != nil || port <= 0 || port > 0xFFFF {
+				return fmt.Errorf("invalid probe host %q", host)
+			}
+			host = hostOnly
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ipAddr, err := net.ResolveIPAddr("ip4", host)
+			if err != nil {
+				return err
+			}
+			ip = ipAddr.IP
+		}
+
+		addrs = append(addrs, &net.UDPAddr{IP: ip, Port: port})
+	}
+
+	discovery.hosts = addrs
+
+	return nil
+}
+
 // Discover task
 //
-func (discovery *Discovery) discover() {
+func (discovery *Discovery) discover(ctx context.Context) {
+	defer discovery.wg.Done()
+
 	// Create a ticker
 	ticker := time.NewTicker(discovery.interval)
+	defer ticker.Stop()
 
 	// Build discovery message
 	msg := DeviceMessageHeader{
@@ -141,60 +398,395 @@ func (discovery *Discovery) discover() {
 		// Encode message
 		EncodeMessageHeader(&msg, discovery.txBuf)
 
+		// Send message on each interface and to the probe hosts
+		discovery.probe(discovery.txBuf.Bytes())
+
 		// Wait for tick
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-		// Send message
-		_, err := discovery.conn.WriteTo(discovery.txBuf.Bytes(), discovery.baddr)
+// Probe now, in addition to the periodic probes
+//
+func (discovery *Discovery) Probe() {
+	if discovery.passive {
+		return
+	}
 
-		if err != nil {
-			discovery.logger.Errorf("Tx discovery message fail [%s]", err.Error())
-		} else {
-			discovery.logger.Debugf("Tx discovery message success")
+	buf := new(bytes.Buffer)
+	EncodeMessageHeader(&DeviceMessageHeader{msgId: IPSEARCH_REQ}, buf)
+
+	discovery.probe(buf.Bytes())
+}
+
+// Broadcast probe and unicast it to the probe hosts
+//
+func (discovery *Discovery) probe(data []byte) {
+	discovery.broadcast(data)
+
+	for _, addr := range discovery.hosts {
+		discovery.send(discovery.ifaces[0], addr, data)
+	}
+}
+
+// Broadcast message on each interface and to the directed broadcast address
+// of each of its subnets
+//
+func (discovery *Discovery) broadcast(data []byte) {
+	for _, iface := range discovery.ifaces {
+		discovery.send(iface, discovery.baddr, data)
+
+		for _, ipnet := range iface.nets {
+			discovery.send(iface, &net.UDPAddr{IP: directedBroadcast(ipnet), Port: discovery.baddr.Port}, data)
 		}
 	}
 }
 
-// Listener task
+// Send discovery message
 //
-func (discovery *Discovery) listen() {
-	// Create receive buffer
-	buf := make([]byte, 1500)
+func (discovery *Discovery) send(iface *discoveryIface, addr *net.UDPAddr, data []byte) {
+	if iface.conn == nil {
+		return
+	}
+
+	_, err := iface.conn.WriteTo(data, addr)
 
-	// Create a listener
-	conn, err := net.ListenUDP("udp", discovery.addr)
 	if err != nil {
-		discovery.logger.Errorf("Listener create fail [%s]", err.Error())
-		return
+		discovery.logger.Errorf("Tx discovery message to [%s] on [%s] fail [%s]", addr.String(), iface.name, err.Error())
+	} else {
+		discovery.logger.Debugf("Tx discovery message to [%s] on [%s] success", addr.String(), iface.name)
 	}
+}
+
+// Listener task
+//
+func (discovery *Discovery) listen(ctx context.Context, iface *discoveryIface, conn *net.UDPConn) {
+	defer discovery.wg.Done()
 
-	discovery.conn = conn
-	discovery.logger.Debugf("Listener create success")
+	// Create receive buffer
+	buf := make([]byte, 1500)
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
 
 	for {
 		// Read messages
-		_, raddr, err := conn.ReadFrom(buf)
+		rlen, raddr, err := conn.ReadFromUDP(buf)
 
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
 			discovery.logger.Errorf("Rx discovery message fail [%s]", err.Error())
 			continue
 		}
 
+		if !ValidMessageHeader(buf[:rlen]) {
+			continue
+		}
+
 		// Decode message
-		msg := DecodeMessage(buf)
+		msg := DecodeMessage(buf[:rlen])
+
+		// Expose every frame in passive mode
+		if discovery.passive {
+			frame := DiscoveredFrame{
+				Message:   msg,
+				Source:    raddr,
+				Interface: iface.name,
+				Port:      port,
+			}
+			frame.Message.data = append([]byte(nil), msg.data...)
+
+			if len(frame.Interface) == 0 {
+				frame.Interface = discovery.interfaceFor(raddr.IP)
+			}
+
+			discovery.logger.Debugf("Rx frame [%d] from [%s] on [%s:%d]", msg.msgId, raddr.String(), frame.Interface, port)
+
+			// Never wait for a consumer, one that only reads the message Q
+			// would stall discovery
+			select {
+			case discovery.fQ <- frame:
+			default:
+				discovery.logger.Warnf("Frame Q full, dropped frame [%d] from [%s]", msg.msgId, raddr.String())
+			}
+		}
+
+		if msg.msgId == IP_SET_RSP {
+			msg.data = append([]byte(nil), msg.data...)
+			discovery.notify(nil, &msg)
+			continue
+		}
+
+		if msg.msgId != IPSEARCH_RSP {
+			continue
+		}
+
+		// Decode response
+		device, err := DecodeDiscoveredDevice(msg.data)
+		if err != nil {
+			discovery.logger.Errorf("Rx discovery message from [%s] malformed [%s]", raddr.String(), err.Error())
+			continue
+		}
+		device.Source = raddr
+
+		// Tag interface, when listening on any interface guess from source
+		if device.Interface = iface.name; len(device.Interface) == 0 {
+			device.Interface = discovery.interfaceFor(raddr.IP)
+		}
+
+		discovery.logger.Debugf("Rx discovery message success from [%s] on [%s]", raddr.String(), device.Interface)
+
+		discovery.notify(&device, nil)
+
+		// Never wait for a consumer, one that only reads the frame Q would
+		// stall notifications and IP_SET
+		select {
+		case discovery.mQ <- device:
+		default:
+			discovery.logger.Warnf("Message Q full, dropped response from [%s]", raddr.String())
+		}
+	}
+}
+
+// Start discovery, listeners are created before returning so bind errors are
+// reported here. Discovery stops when ctx is done or Stop is called, it can't
+// be started again once stopped.
+//
+func (discovery *Discovery) Start(ctx context.Context) error {
+	discovery.stateMu.Lock()
+	defer discovery.stateMu.Unlock()
+
+	if discovery.stopped {
+		return ErrDiscoveryStopped
+	}
+
+	if discovery.cancel != nil {
+		return ErrDiscoveryStarted
+	}
+
+	// List local subnets once, responses are matched against them
+	discovery.refreshLocalNets()
+
+	// Create listeners
+	for _, iface := range discovery.ifaces {
+		conn, err := listenUDP(iface.name, discovery.addr)
+		if err != nil {
+			discovery.closeListeners()
+			return fmt.Errorf("discovery listener on [%s] [%w]", iface.name, err)
+		}
+
+		iface.conn = conn
+		discovery.logger.Debugf("Listener create on [%s] success", iface.name)
+
+		// Passive listeners
+		for _, port := range discovery.ports {
+			conn, err := listenUDP(iface.name, &net.UDPAddr{IP: discovery.addr.IP, Port: int(port)})
+			if err != nil {
+				discovery.closeListeners()
+				return fmt.Errorf("discovery listener on [%s:%d] [%w]", iface.name, port, err)
+			}
+
+			iface.extra = append(iface.extra, conn)
+			discovery.logger.Debugf("Listener create on [%s:%d] success", iface.name, port)
+		}
+	}
+
+	ctx, discovery.cancel = context.WithCancel(ctx)
+
+	// Start listener tasks
+	for _, iface := range discovery.ifaces {
+		discovery.wg.Add(1)
+		go discovery.listen(ctx, iface, iface.conn)
+
+		for _, conn := range iface.extra {
+			discovery.wg.Add(1)
+			go discovery.listen(ctx, iface, conn)
+		}
+	}
+
+	// Start discovery task, unless passive
+	if !discovery.passive {
+		discovery.wg.Add(1)
+		go discovery.discover(ctx)
+	}
+
+	// Stop when context is done
+	go func() {
+		<-ctx.Done()
+		discovery.Stop()
+	}()
+
+	return nil
+}
+
+// Stop discovery, waits for tasks to finish and closes the message Q
+//
+func (discovery *Discovery) Stop() {
+	discovery.stopOnce.Do(func() {
+		discovery.stateMu.Lock()
+		discovery.stopped = true
+		cancel := discovery.cancel
+		discovery.stateMu.Unlock()
+
+		if cancel != nil {
+			cancel()
+		}
 
-		if msg.msgId == IPSEARCH_RSP {
-			discovery.logger.Debugf("Rx discovery message success from [%s]", raddr.String())
+		discovery.closeListeners()
+		discovery.wg.Wait()
 
-			discovery.mQ <- msg
+		close(discovery.mQ)
+		close(discovery.fQ)
+
+		discovery.logger.Debugf("Discovery stopped")
+	})
+}
+
+// Close discovery, same as Stop
+//
+func (discovery *Discovery) Close() error {
+	discovery.Stop()
+
+	return nil
+}
+
+// Register an internal consumer of responses
+//
+func (discovery *Discovery) watch() *discoveryWatch {
+	watch := &discoveryWatch{
+		devices: make(chan DiscoveredDevice, 16),
+		ipSet:   make(chan DeviceMessage, 1),
+	}
+
+	discovery.watchMu.Lock()
+	discovery.watchers = append(discovery.watchers, watch)
+	discovery.watchMu.Unlock()
+
+	return watch
+}
+
+// Unregister an internal consumer of responses
+//
+func (discovery *Discovery) unwatch(watch *discoveryWatch) {
+	discovery.watchMu.Lock()
+	defer discovery.watchMu.Unlock()
+
+	for idx, other := range discovery.watchers {
+		if other == watch {
+			discovery.watchers = append(discovery.watchers[:idx], discovery.watchers[idx+1:]...)
+			break
+		}
+	}
+}
+
+// Offer a response to internal consumers, slow consumers miss responses
+//
+func (discovery *Discovery) notify(device *DiscoveredDevice, ipSet *DeviceMessage) {
+	discovery.watchMu.Lock()
+	defer discovery.watchMu.Unlock()
+
+	for _, watch := range discovery.watchers {
+		if device != nil {
+			select {
+			case watch.devices <- *device:
+			default:
+			}
+		}
+
+		if ipSet != nil {
+			select {
+			case watch.ipSet <- *ipSet:
+			default:
+			}
 		}
 	}
 }
 
-func (discovery *Discovery) Start() {
-	// Start listener task
-	go discovery.listen()
+// Close listener connections
+//
+func (discovery *Discovery) closeListeners() {
+	for _, iface := range discovery.ifaces {
+		if iface.conn != nil {
+			iface.conn.Close()
+		}
+
+		for _, conn := range iface.extra {
+			conn.Close()
+		}
+	}
+}
+
+// IPv4 subnets of an interface
+func interfaceNets(iface *net.Interface) ([]*net.IPNet, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			nets = append(nets, &net.IPNet{IP: ipnet.IP.To4(), Mask: ipnet.Mask[len(ipnet.Mask)-net.IPv4len:]})
+		}
+	}
+
+	return nets, nil
+}
+
+// List subnets of local interfaces, the list is kept empty on error so the
+// next lookup tries again
+func (discovery *Discovery) refreshLocalNets() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		discovery.logger.Warnf("List interfaces fail [%s]", err.Error())
+	}
+
+	var localNets []localNet
+	for idx := range ifaces {
+		nets, _ := interfaceNets(&ifaces[idx])
+		for _, ipnet := range nets {
+			localNets = append(localNets, localNet{name: ifaces[idx].Name, ipnet: ipnet})
+		}
+	}
+
+	discovery.netsMu.Lock()
+	discovery.nets = localNets
+	discovery.netsMu.Unlock()
+}
+
+// Name of the interface whose subnet contains ip, empty if none
+func (discovery *Discovery) interfaceFor(ip net.IP) string {
+	discovery.netsMu.Lock()
+	empty := len(discovery.nets) == 0
+	discovery.netsMu.Unlock()
+
+	if empty {
+		discovery.refreshLocalNets()
+	}
+
+	discovery.netsMu.Lock()
+	defer discovery.netsMu.Unlock()
+
+	for _, local := range discovery.nets {
+		if local.ipnet.Contains(ip) {
+			return local.name
+		}
+	}
+
+	return ""
+}
+
+// Directed broadcast address of a subnet
+func directedBroadcast(ipnet *net.IPNet) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	for idx := range ip {
+		ip[idx] = ipnet.IP[idx] | ^ipnet.Mask[idx]
+	}
 
-	// Start discovery task
-	go discovery.discover()
+	return ip
 }
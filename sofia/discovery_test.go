@@ -0,0 +1,340 @@
+package sofia
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseHexIP(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    net.IP
+		wantErr bool
+	}{
+		{str: "0x0a01a8c0", want: net.IPv4(192, 168, 1, 10)},
+		{str: "0x0A01A8C0", want: net.IPv4(192, 168, 1, 10)},
+		{str: "0X0A01A8C0", want: net.IPv4(192, 168, 1, 10)},
+		{str: "0a01a8c0", want: net.IPv4(192, 168, 1, 10)},
+		{str: "0x00FFFFFF", want: net.IPv4(255, 255, 255, 0)},
+		{str: "0x00000000", want: net.IPv4(0, 0, 0, 0)},
+		{str: "0xFFFFFFFF", want: net.IPv4(255, 255, 255, 255)},
+		{str: "0x1", want: net.IPv4(1, 0, 0, 0)}, // Leading zeros omitted
+		{str: "0x", wantErr: true},
+		{str: "", wantErr: true},
+		{str: "0xZZ01A8C0", wantErr: true},
+		{str: "0x0a01a8c0 ", wantErr: true},
+		{str: "-0x1", wantErr: true},
+		{str: "0x10a01a8c0", wantErr: true}, // Over 32 bits
+		{str: "192.168.1.10", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseHexIP(test.str)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: error %v", test.str, err)
+			continue
+		}
+
+		if test.wantErr {
+			continue
+		}
+
+		if len(got) != net.IPv4len || !got.Equal(test.want) {
+			t.Errorf("%q: %v, want %v", test.str, got, test.want)
+		}
+	}
+}
+
+func TestFormatHexIP(t *testing.T) {
+	tests := []struct {
+		ip   []byte
+		want string
+	}{
+		{ip: net.IPv4(192, 168, 1, 10), want: "0x0a01a8c0"},
+		{ip: net.IPv4(192, 168, 1, 10).To4(), want: "0x0a01a8c0"},
+		{ip: net.IPv4Mask(255, 255, 255, 0), want: "0x00ffffff"},
+		{ip: net.IPv4zero, want: "0x00000000"},
+		{ip: net.ParseIP("fe80::1"), want: "0x00000000"},
+		{ip: []byte{1, 2, 3}, want: "0x00000000"},
+		{ip: nil, want: "0x00000000"},
+	}
+
+	for _, test := range tests {
+		if got := FormatHexIP(test.ip); got != test.want {
+			t.Errorf("%v: %q, want %q", test.ip, got, test.want)
+		}
+	}
+
+	// Round trip
+	for _, str := range []string{"0x0a01a8c0", "0x00ffffff", "0x0101a8c0", "0xffffffff", "0x00000000"} {
+		ip, err := ParseHexIP(str)
+		if err != nil {
+			t.Errorf("%q: %v", str, err)
+			continue
+		}
+
+		if got := FormatHexIP(ip); got != str {
+			t.Errorf("%q: round trip %q", str, got)
+		}
+	}
+}
+
+// IPSEARCH_RSP payload as sent by an NVR
+const ipSearchReply = `{ "NetWork.NetCommon" : { "BuildDate" : "2019-05-15 13:52:41", "ChannelNum" : 8, ` +
+	`"DeviceType" : 1, "GateWay" : "0x0101A8C0", "HostIP" : "0x6401A8C0", "HostName" : "NVR", "HttpPort" : 80, ` +
+	`"MAC" : "00:12:31:0a:4d:2b", "MaxBps" : 0, "MonMode" : "TCP", "NetConnectState" : 0, ` +
+	`"OtherFunction" : "D=2019-05-20 10:33:59 V=4ba9e2ad1d98a34", "SN" : "c142f4c2ba8b3c9b", "SSLPort" : 8443, ` +
+	`"Submask" : "0x00FFFFFF", "TCPMaxConn" : 10, "TCPPort" : 34567, "TransferPlan" : "Quality", "UDPPort" : 34568, ` +
+	`"UseHSDownLoad" : false, "Version" : "V4.02.R12.00035520.12012.047500.0000000" }, ` +
+	`"Ret" : 100, "SessionID" : "0x00000000" }`
+
+func TestDecodeDiscoveredDevice(t *testing.T) {
+	device, err := DecodeDiscoveredDevice([]byte(ipSearchReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildDate, _ := time.ParseInLocation(DeviceTimeLayout, "2019-05-15 13:52:41", time.Local)
+
+	if device.SerialNo != "c142f4c2ba8b3c9b" || device.HostName != "NVR" ||
+		device.MAC.String() != "00:12:31:0a:4d:2b" ||
+		!device.HostIP.Equal(net.IPv4(192, 168, 1, 100)) ||
+		!device.GateWay.Equal(net.IPv4(192, 168, 1, 1)) ||
+		device.Submask.String() != "ffffff00" ||
+		device.TCPPort != 34567 || device.UDPPort != 34568 || device.HttpPort != 80 || device.SSLPort != 8443 ||
+		device.TCPMaxConn != 10 || device.MonMode != "TCP" || device.TransferPlan != "Quality" ||
+		device.Version != "V4.02.R12.00035520.12012.047500.0000000" || !device.BuildDate.Equal(buildDate) ||
+		device.DeviceType != 1 {
+		t.Errorf("device %+v", device)
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "bad MAC", data: strings.Replace(ipSearchReply, `"00:12:31:0a:4d:2b"`, `"00:12:31"`, 1)},
+		{name: "bad host IP", data: strings.Replace(ipSearchReply, `"0x6401A8C0"`, `"0xZZ01A8C0"`, 1)},
+		{name: "empty gateway", data: strings.Replace(ipSearchReply, `"0x0101A8C0"`, `""`, 1)},
+		{name: "short mask", data: strings.Replace(ipSearchReply, `"0x00FFFFFF"`, `"0x"`, 1)},
+		{name: "error code", data: strings.Replace(ipSearchReply, `"Ret" : 100`, `"Ret" : 103`, 1)},
+		{name: "truncated", data: ipSearchReply[:len(ipSearchReply)/2]},
+		{name: "not JSON", data: "\x00\x00"},
+	}
+
+	for _, test := range tests {
+		if _, err := DecodeDiscoveredDevice([]byte(test.data)); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+// Discovery on port, probing every second, not started
+func newTestDiscovery(t *testing.T, port uint16) *Discovery {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	discovery, err := NewDiscovery(port, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return discovery
+}
+
+// Local loopback interface and its subnet
+func loopback(t *testing.T) (string, *net.IPNet) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for idx := range ifaces {
+		if ifaces[idx].Flags&net.FlagLoopback == 0 {
+			continue
+		}
+
+		if nets, _ := interfaceNets(&ifaces[idx]); len(nets) > 0 {
+			return ifaces[idx].Name, nets[0]
+		}
+	}
+
+	t.Skip("no IPv4 loopback interface")
+	return "", nil
+}
+
+func TestSetInterfaces(t *testing.T) {
+	name, ipnet := loopback(t)
+	discovery := newTestDiscovery(t, 34569)
+
+	if err := discovery.SetInterfaces([]string{name}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(discovery.ifaces) != 1 || discovery.ifaces[0].name != name ||
+		len(discovery.ifaces[0].nets) == 0 || discovery.ifaces[0].nets[0].String() != ipnet.String() {
+		t.Errorf("interfaces %+v", discovery.ifaces)
+	}
+
+	// Unknown interface, previous interfaces are kept
+	if err := discovery.SetInterfaces([]string{name, "nosuchif0"}); err == nil || !strings.Contains(err.Error(), "nosuchif0") {
+		t.Errorf("unknown interface error %v", err)
+	}
+
+	if len(discovery.ifaces) != 1 || discovery.ifaces[0].name != name {
+		t.Errorf("interfaces %+v after error", discovery.ifaces)
+	}
+
+	// None, any interface
+	if err := discovery.SetInterfaces(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(discovery.ifaces) != 1 || discovery.ifaces[0].name != "" || discovery.ifaces[0].nets != nil {
+		t.Errorf("interfaces %+v, want any", discovery.ifaces)
+	}
+}
+
+func TestDirectedBroadcast(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want net.IP
+	}{
+		{cidr: "192.168.1.10/24", want: net.IPv4(192, 168, 1, 255)},
+		{cidr: "10.10.3.4/16", want: net.IPv4(10, 10, 255, 255)},
+		{cidr: "172.16.5.1/20", want: net.IPv4(172, 16, 15, 255)},
+		{cidr: "192.168.1.10/31", want: net.IPv4(192, 168, 1, 11)},
+		{cidr: "192.168.1.10/32", want: net.IPv4(192, 168, 1, 10)},
+		{cidr: "0.0.0.0/0", want: net.IPv4(255, 255, 255, 255)},
+	}
+
+	for _, test := range tests {
+		ip, ipnet, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Interface address and mask, as listed by interfaceNets
+		ipnet = &net.IPNet{IP: ip.To4(), Mask: ipnet.Mask}
+
+		if got := directedBroadcast(ipnet); !got.Equal(test.want) {
+			t.Errorf("%s: %v, want %v", test.cidr, got, test.want)
+		}
+	}
+}
+
+func TestInterfaceFor(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, lab, _ := net.ParseCIDR("10.10.0.0/16")
+
+	discovery := newTestDiscovery(t, 34569)
+	discovery.nets = []localNet{{name: "eth0", ipnet: lan}, {name: "eth1", ipnet: lab}}
+
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{ip: net.IPv4(192, 168, 1, 10), want: "eth0"},
+		{ip: net.IPv4(192, 168, 1, 255), want: "eth0"},
+		{ip: net.IPv4(10, 10, 200, 1), want: "eth1"},
+		{ip: net.IPv4(192, 168, 2, 10), want: ""},
+		{ip: net.ParseIP("fe80::1"), want: ""},
+	}
+
+	for _, test := range tests {
+		if got := discovery.interfaceFor(test.ip); got != test.want {
+			t.Errorf("%v: %q, want %q", test.ip, got, test.want)
+		}
+	}
+
+	// Listed on first use when the list is empty, e.g. listing failed on Start
+	name, _ := loopback(t)
+
+	discovery.nets = nil
+	if got := discovery.interfaceFor(net.IPv4(127, 0, 0, 1)); got != name {
+		t.Errorf("loopback %q, want %q", got, name)
+	}
+
+	if len(discovery.nets) == 0 {
+		t.Error("local subnets not cached")
+	}
+}
+
+func TestProbeHosts(t *testing.T) {
+	// Stands in for a device behind a router
+	device, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	discovery := newTestDiscovery(t, uint16(device.LocalAddr().(*net.UDPAddr).Port))
+	if err := discovery.SetProbeHosts([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := listenUDP("", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	discovery.ifaces[0].conn = conn
+
+	discovery.Probe()
+
+	buf := make([]byte, 1500)
+	device.SetReadDeadline(time.Now().Add(time.Second))
+
+	rlen, _, err := device.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal("probe host not probed: ", err)
+	}
+
+	if !ValidMessageHeader(buf[:rlen]) || DecodeMessage(buf[:rlen]).msgId != IPSEARCH_REQ {
+		t.Errorf("probe % x", buf[:rlen])
+	}
+
+	// Passive discovery never probes
+	discovery.SetPassive(nil)
+	discovery.Probe()
+
+	device.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := device.ReadFromUDP(buf); err == nil {
+		t.Error("passive discovery probed")
+	}
+}
+
+func TestSetProbeHosts(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "192.168.1.10", want: "192.168.1.10:34569"},
+		{host: "192.168.1.10:34570", want: "192.168.1.10:34570"},
+		{host: "localhost", want: "127.0.0.1:34569"},
+		{host: "[::1]:34570", want: "[::1]:34570"},
+		{host: "192.168.1.10:0", wantErr: true},
+		{host: "192.168.1.10:65536", wantErr: true},
+		{host: "192.168.1.10:udp", wantErr: true},
+	}
+
+	for _, test := range tests {
+		discovery := newTestDiscovery(t, 34569)
+
+		err := discovery.SetProbeHosts([]string{test.host})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error %v", test.host, err)
+			continue
+		}
+
+		if !test.wantErr && (len(discovery.hosts) != 1 || discovery.hosts[0].String() != test.want) {
+			t.Errorf("%s: hosts %v, want %s", test.host, discovery.hosts, test.want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package sofia
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+Simplify.Encode, one entry per channel
+{
+	"ExtraFormat" : {
+		"AudioEnable" : false,
+		"Video" : {
+			"BitRate" : 552,
+			"BitRateControl" : "VBR",
+			"Compression" : "H.265",
+			"FPS" : 20,
+			"GOP" : 2,
+			"Quality" : 3,
+			"Resolution" : "D1"
+		},
+		"VideoEnable" : true
+	},
+	"MainFormat" : { ... }
+}
+
+Smart encoding (H.264+/H.265+) is a separate AVEnc.SmartH264 or
+AVEnc.SmartH264V2 section, depending on SystemFunction.EncodeFunction.
+*/
+
+// Codecs
+const (
+	CodecH264     = "H.264"
+	CodecH265     = "H.265"
+	CodecH264Plus = "H.264+" // H.264 with smart encoding
+	CodecH265Plus = "H.265+" // H.265 with smart encoding
+)
+
+// Bit rate control
+const (
+	BitRateCBR = "CBR"
+	BitRateVBR = "VBR"
+)
+
+// Stream types (EncodeCapability.EncodeInfo)
+const (
+	StreamMain  = "MainStream"
+	StreamExtra = "ExtraStream"
+)
+
+// Resolution names by bit of EncodeInfo.ResolutionMask
+var Resolutions = []string{
+	"D1", "HD1", "BCIF", "CIF", "QCIF", "VGA", "QVGA", "SVCD",
+	"QQVGA", "ND1", "960H", "720P", "1_3M", "UXGA", "1080P", "WUXGA",
+	"2_5M", "3M", "5M", "1080N", "4M", "6M", "8M", "12M",
+	"4K", "720N", "WSVGA", "NHD", "3M_N", "4M_N", "5M_N", "4K_N",
+}
+
+// Frame size of resolutions as the device SDK defines them (PAL)
+var ResolutionSizes = map[string][2]int{
+	"D1": {704, 576}, "HD1": {352, 576}, "BCIF": {704, 288}, "CIF": {352, 288},
+	"QCIF": {176, 144}, "VGA": {640, 480}, "QVGA": {320, 240}, "SVCD": {480, 480},
+	"QQVGA": {160, 128}, "ND1": {240, 192}, "960H": {928, 576}, "720P": {1280, 720},
+	"1_3M": {1280, 960}, "UXGA": {1600, 1200}, "1080P": {1920, 1080}, "WUXGA": {1920, 1200},
+	"2_5M": {1872, 1408}, "3M": {2048, 1536}, "5M": {3744, 1408}, "1080N": {960, 1080},
+	"4M": {2592, 1520}, "6M": {3072, 2048}, "8M": {3264, 2448}, "12M": {4000, 3000},
+	"4K": {3840, 2160}, "720N": {640, 720}, "WSVGA": {1024, 576}, "NHD": {640, 360},
+	"3M_N": {1024, 1536}, "4M_N": {1296, 1520}, "5M_N": {1872, 1408}, "4K_N": {1920, 2160},
+}
+
+// Upper bounds of video settings, devices don't report them
+const (
+	MaxEncodeFPS = 60 // Frame rate
+	MaxEncodeGOP = 12 // I-frame interval, seconds
+)
+
+// Codec names by bit of EncodeInfo.CompressionMask
+var Compressions = []string{
+	"DIVX_MPEG4", "MS_MPEG4", "MPEG2", "MPEG1", "H.263", "MJPG", "FCC_MPEG4", CodecH264,
+	CodecH265,
+}
+
+// Video settings of a stream
+type VideoFormat struct {
+	BitRate        int    // Bit rate, kbps
+	BitRateControl string // BitRateCBR or BitRateVBR
+	Compression    string // Codec, one of Codec*
+	FPS            int    // Frame rate
+	GOP            int    // I-frame interval, seconds
+	Quality        int    // Quality (VBR), 1 worst to 6 best
+	Resolution     string // One of Resolutions
+}
+
+// Settings of a stream
+type StreamFormat struct {
+	AudioEnable bool        // Audio enabled
+	Video       VideoFormat // Video settings
+	VideoEnable bool        // Video enabled
+}
+
+// Encode settings of a channel
+type EncodeConfig struct {
+	ExtraFormat StreamFormat // Extra (sub) stream
+	MainFormat  StreamFormat // Main stream
+}
+
+// Encoder capability of a stream
+type EncodeInfo struct {
+	CompressionMask HexUint32 // Supported codecs, bits index Compressions
+	Enable          bool      // Stream available
+	HaveAudio       bool      // Audio available
+	ResolutionMask  HexUint32 // Supported resolutions, bits index Resolutions
+	StreamType      string    // StreamMain, StreamExtra, ...
+}
+
+// Encoder capability
+type EncodeCapability struct {
+	EncodeInfo     []EncodeInfo // Per stream type
+	MaxBitrate     int          // Maximum bit rate, kbps
+	MaxEncodePower int          // Maximum encode power (pixels * fps)
+}
+
+// Smart encoding section
+type smartEncode struct {
+	SmartH264 bool
+}
+
+// System abilities (typed)
+func (session *Session) Abilities() (SysAbilitiesData, error) {
+	var abilities SysAbilitiesData
+	err := session.command(ABILITY_REQ, CmdReqData{Name: "SystemFunction", SessionID: session.sessionID()}, &abilities)
+
+	return abilities, err
+}
+
+// Encoder capability
+func (session *Session) EncodeCapability() (EncodeCapability, error) {
+	var resData struct {
+		EncodeCapability EncodeCapability
+	}
+
+	err := session.command(ABILITY_REQ, CmdReqData{Name: "EncodeCapability", SessionID: session.sessionID()}, &resData)
+
+	return resData.EncodeCapability, err
+}
+
+// Get encode settings of all channels, compression carries the "+" suffix
+// when smart encoding is enabled
+func (session *Session) EncodeConfig() ([]EncodeConfig, error) {
+	value, err := session.GetConfig("Simplify.Encode")
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []EncodeConfig
+	if err := json.Unmarshal(value, &configs); err != nil {
+		return nil, err
+	}
+
+	// Smart encoding
+	section, err := session.smartEncodeSection()
+	if err != nil || len(section) == 0 {
+		return configs, err
+	}
+
+	for ch := range configs {
+		value, err := session.GetConfig(fmt.Sprintf("%s.[%d]", section, ch))
+		if err != nil {
+			return nil, err
+		}
+
+		var smart smartEncode
+		if err := json.Unmarshal(value, &smart); err != nil {
+			return nil, err
+		}
+
+		if smart.SmartH264 {
+			configs[ch].MainFormat.Video.Compression += "+"
+		}
+	}
+
+	return configs, nil
+}
+
+// Set encode settings of all channels, settings are validated against the
+// encoder capability first
+func (session *Session) SetEncodeConfig(configs []EncodeConfig) error {
+	capability, err := session.EncodeCapability()
+	if err != nil {
+		return err
+	}
+
+	// Validate and split off smart encoding
+	smart := make([]bool, len(configs))
+	wire := make([]EncodeConfig, len(configs))
+	for ch, config := range configs {
+		if config.MainFormat.VideoEnable {
+			if err := capability.Validate(StreamMain, config.MainFormat.Video); err != nil {
+				return fmt.Errorf("channel %d: %w", ch, err)
+			}
+		}
+
+		if config.ExtraFormat.VideoEnable {
+			if err := capability.Validate(StreamExtra, config.ExtraFormat.Video); err != nil {
+				return fmt.Errorf("channel %d: %w", ch, err)
+			}
+
+			if strings.HasSuffix(config.ExtraFormat.Video.Compression, "+") {
+				return fmt.Errorf("channel %d: smart encoding only applies to main stream", ch)
+			}
+		}
+
+		wire[ch] = config
+		wire[ch].MainFormat.Video.Compression, smart[ch] = splitCodec(config.MainFormat.Video.Compression)
+	}
+
+	// Smart encoding availability
+	section, err := session.smartEncodeSection()
+	if err != nil {
+		return err
+	}
+
+	for ch := range smart {
+		if smart[ch] && len(section) == 0 {
+			return fmt.Errorf("channel %d: smart encoding not supported by device", ch)
+		}
+	}
+
+	// Apply
+	value, err := json.Marshal(wire)
+	if err != nil {
+		return err
+	}
+
+	if err := session.SetConfig("Simplify.Encode", value); err != nil {
+		return err
+	}
+
+	if len(section) == 0 {
+		return nil
+	}
+
+	// Read, modify and write, keeping fields not modelled here
+	for ch := range smart {
+		name := fmt.Sprintf("%s.[%d]", section, ch)
+
+		value, err := session.GetConfig(name)
+		if err != nil {
+			return err
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return err
+		}
+
+		if fields == nil {
+			fields = make(map[string]json.RawMessage)
+		}
+		fields["SmartH264"], _ = json.Marshal(smart[ch])
+
+		value, _ = json.Marshal(fields)
+		if err := session.SetConfig(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate video settings of a stream type
+func (capability EncodeCapability) Validate(stream string, video VideoFormat) error {
+	var info *EncodeInfo
+	for idx := range capability.EncodeInfo {
+		if capability.EncodeInfo[idx].StreamType == stream {
+			info = &capability.EncodeInfo[idx]
+			break
+		}
+	}
+
+	if info == nil || !info.Enable {
+		return fmt.Errorf("%s not supported", stream)
+	}
+
+	codec, _ := splitCodec(video.Compression)
+	if !maskHas(uint32(info.CompressionMask), Compressions, codec) {
+		return fmt.Errorf("%s: compression %q not supported", stream, video.Compression)
+	}
+
+	if !maskHas(uint32(info.ResolutionMask), Resolutions, video.Resolution) {
+		return fmt.Errorf("%s: resolution %q not supported", stream, video.Resolution)
+	}
+
+	if video.BitRate <= 0 || (capability.MaxBitrate > 0 && video.BitRate > capability.MaxBitrate) {
+		return fmt.Errorf("%s: bit rate %d out of range (max %d)", stream, video.BitRate, capability.MaxBitrate)
+	}
+
+	if video.BitRateControl != BitRateCBR && video.BitRateControl != BitRateVBR {
+		return fmt.Errorf("%s: bit rate control %q not supported", stream, video.BitRateControl)
+	}
+
+	if video.FPS <= 0 || video.FPS > MaxEncodeFPS || video.GOP <= 0 || video.GOP > MaxEncodeGOP {
+		return fmt.Errorf("%s: invalid frame rate %d or GOP %d", stream, video.FPS, video.GOP)
+	}
+
+	// Pixel rate the encoder can sustain
+	if size, ok := ResolutionSizes[video.Resolution]; ok && capability.MaxEncodePower > 0 {
+		if power := size[0] * size[1] * video.FPS; power > capability.MaxEncodePower {
+			return fmt.Errorf("%s: %s at %d fps exceeds the encode power (%d > %d)", stream, video.Resolution, video.FPS, power, capability.MaxEncodePower)
+		}
+	}
+
+	return nil
+}
+
+// Supported resolutions of a stream type
+func (capability EncodeCapability) Resolutions(stream string) []string {
+	for _, info := range capability.EncodeInfo {
+		if info.StreamType == stream {
+			return maskNames(uint32(info.ResolutionMask), Resolutions)
+		}
+	}
+
+	return nil
+}
+
+// Supported codecs of a stream type
+func (capability EncodeCapability) Compressions(stream string) []string {
+	for _, info := range capability.EncodeInfo {
+		if info.StreamType == stream {
+			return maskNames(uint32(info.CompressionMask), Compressions)
+		}
+	}
+
+	return nil
+}
+
+// Smart encoding section name, empty if not supported
+func (session *Session) smartEncodeSection() (string, error) {
+	abilities, err := session.Abilities()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case abilities.SystemFunction.EncodeFunction.SmartH264V2:
+		return "AVEnc.SmartH264V2", nil
+	case abilities.SystemFunction.EncodeFunction.SmartH264:
+		return "AVEnc.SmartH264", nil
+	}
+
+	return "", nil
+}
+
+// Split "+" suffix off a codec
+func splitCodec(codec string) (string, bool) {
+	if strings.HasSuffix(codec, "+") {
+		return strings.TrimSuffix(codec, "+"), true
+	}
+
+	return codec, false
+}
+
+// Is name set in mask
+func maskHas(mask uint32, names []string, name string) bool {
+	for bit, bname := range names {
+		if bname == name {
+			return mask&(1<<uint(bit)) != 0
+		}
+	}
+
+	return false
+}
+
+// Names set in mask
+func maskNames(mask uint32, names []string) []string {
+	var out []string
+	for bit, name := range names {
+		if mask&(1<<uint(bit)) != 0 {
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
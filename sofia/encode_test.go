@@ -0,0 +1,116 @@
+package sofia
+
+import (
+	"testing"
+)
+
+func TestSplitCodec(t *testing.T) {
+	tests := []struct {
+		codec     string
+		want      string
+		wantSmart bool
+	}{
+		{codec: CodecH264, want: CodecH264},
+		{codec: CodecH265Plus, want: CodecH265, wantSmart: true},
+		{codec: CodecH264Plus, want: CodecH264, wantSmart: true},
+		{codec: "", want: ""},
+		{codec: "+", want: "", wantSmart: true},
+	}
+
+	for _, test := range tests {
+		if got, smart := splitCodec(test.codec); got != test.want || smart != test.wantSmart {
+			t.Errorf("splitCodec(%q) = %q, %v, want %q, %v", test.codec, got, smart, test.want, test.wantSmart)
+		}
+	}
+}
+
+func TestMaskHas(t *testing.T) {
+	tests := []struct {
+		mask uint32
+		name string
+		want bool
+	}{
+		{mask: 0x1, name: "D1", want: true},
+		{mask: 0x1, name: "HD1"},
+		{mask: 1 << 14, name: "1080P", want: true},
+		{mask: 0x80000000, name: "4K_N", want: true},
+		{mask: 0xFFFFFFFF, name: "Unknown"},
+		{mask: 0xFFFFFFFF, name: ""},
+		{mask: 0, name: "D1"},
+	}
+
+	for _, test := range tests {
+		if got := maskHas(test.mask, Resolutions, test.name); got != test.want {
+			t.Errorf("maskHas(%#x, %q) = %v, want %v", test.mask, test.name, got, test.want)
+		}
+	}
+
+	if names := maskNames(0x180, Compressions); len(names) != 2 || names[0] != CodecH264 || names[1] != CodecH265 {
+		t.Errorf("maskNames(0x180) = %v", names)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	capability := EncodeCapability{
+		EncodeInfo: []EncodeInfo{
+			// H.264 and H.265, D1 to 4K
+			{StreamType: StreamMain, Enable: true, CompressionMask: 0x180, ResolutionMask: 1<<0 | 1<<11 | 1<<14 | 1<<24},
+			{StreamType: StreamExtra, Enable: true, CompressionMask: 0x80, ResolutionMask: 1<<0 | 1<<3},
+			{StreamType: "SnapStream", CompressionMask: 0x20, ResolutionMask: 0x1},
+		},
+		MaxBitrate:     8192,
+		MaxEncodePower: 1920 * 1080 * 30,
+	}
+
+	valid := VideoFormat{BitRate: 4096, BitRateControl: BitRateVBR, Compression: CodecH265, FPS: 25, GOP: 2, Quality: 4, Resolution: "1080P"}
+
+	tests := []struct {
+		name    string
+		stream  string
+		modify  func(video *VideoFormat)
+		power   int // Overrides MaxEncodePower if not 0, -1 for none
+		wantErr bool
+	}{
+		{name: "valid", stream: StreamMain},
+		{name: "smart encoding", stream: StreamMain, modify: func(video *VideoFormat) { video.Compression = CodecH265Plus }},
+		{name: "full encode power", stream: StreamMain, modify: func(video *VideoFormat) { video.FPS = 30 }},
+		{name: "extra stream", stream: StreamExtra, modify: func(video *VideoFormat) { video.Compression = CodecH264; video.Resolution = "CIF" }},
+		{name: "unknown stream", stream: "ThirdStream", wantErr: true},
+		{name: "disabled stream", stream: "SnapStream", wantErr: true},
+		{name: "codec", stream: StreamExtra, modify: func(video *VideoFormat) { video.Resolution = "CIF" }, wantErr: true},
+		{name: "resolution", stream: StreamMain, modify: func(video *VideoFormat) { video.Resolution = "5M" }, wantErr: true},
+		{name: "unknown resolution", stream: StreamMain, modify: func(video *VideoFormat) { video.Resolution = "16K" }, wantErr: true},
+		{name: "no bit rate", stream: StreamMain, modify: func(video *VideoFormat) { video.BitRate = 0 }, wantErr: true},
+		{name: "bit rate", stream: StreamMain, modify: func(video *VideoFormat) { video.BitRate = 8193 }, wantErr: true},
+		{name: "bit rate control", stream: StreamMain, modify: func(video *VideoFormat) { video.BitRateControl = "ABR" }, wantErr: true},
+		{name: "no frame rate", stream: StreamMain, modify: func(video *VideoFormat) { video.FPS = 0 }, wantErr: true},
+		{name: "frame rate", stream: StreamMain, modify: func(video *VideoFormat) { video.Resolution = "D1"; video.FPS = MaxEncodeFPS + 1 }, wantErr: true},
+		{name: "no GOP", stream: StreamMain, modify: func(video *VideoFormat) { video.GOP = 0 }, wantErr: true},
+		{name: "GOP", stream: StreamMain, modify: func(video *VideoFormat) { video.GOP = MaxEncodeGOP + 1 }, wantErr: true},
+		{name: "4K beyond encode power", stream: StreamMain, modify: func(video *VideoFormat) { video.Resolution = "4K"; video.FPS = 30 }, wantErr: true},
+		{name: "4K within encode power", stream: StreamMain, modify: func(video *VideoFormat) { video.Resolution = "4K"; video.FPS = 7 }},
+		{name: "1080P beyond encode power", stream: StreamMain, modify: func(video *VideoFormat) { video.FPS = 31 }, wantErr: true},
+		{name: "encode power not reported", stream: StreamMain, modify: func(video *VideoFormat) { video.Resolution = "4K"; video.FPS = 30 }, power: -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			capability := capability
+			switch {
+			case test.power < 0:
+				capability.MaxEncodePower = 0
+			case test.power > 0:
+				capability.MaxEncodePower = test.power
+			}
+
+			video := valid
+			if test.modify != nil {
+				test.modify(&video)
+			}
+
+			if err := capability.Validate(test.stream, video); (err != nil) != test.wantErr {
+				t.Errorf("Validate(%s, %+v) = %v", test.stream, video, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package sofia
+
+import "fmt"
+
+// Device return codes (Ret field of responses)
+const (
+	RetOK              = 100 // Success
+	RetUnknownError    = 101 // Unknown error
+	RetUnsupported     = 102 // Version not supported
+	RetIllegalRequest  = 103 // Illegal request
+	RetAlreadyLoggedIn = 104 // User already logged in
+	RetNotLoggedIn     = 105 // User not logged in
+	RetBadCredentials  = 106 // Username or password incorrect
+	RetNoPermission    = 107 // No permission
+	RetTimeout         = 108 // Timeout
+	RetSearchFailed    = 109 // Search failed, no matching file
+	RetBadPassword     = 203 // Password incorrect
+	RetUserNotExist    = 205 // User does not exist
+	RetUserLocked      = 206 // User locked
+	RetUserBlacklisted = 207 // User in blacklist
+	RetUpgradeOK       = 515 // Upgrade successful
+	RetRestartApp      = 603 // Success, application restart required
+	RetRestartSystem   = 604 // Success, system reboot required
+)
+
+// Return code descriptions
+var retStrings = map[uint32]string{
+	RetOK:              "success",
+	RetUnknownError:    "unknown error",
+	RetUnsupported:     "version not supported",
+	RetIllegalRequest:  "illegal request",
+	RetAlreadyLoggedIn: "user already logged in",
+	RetNotLoggedIn:     "user not logged in",
+	RetBadCredentials:  "username or password incorrect",
+	RetNoPermission:    "no permission",
+	RetTimeout:         "timeout",
+	RetSearchFailed:    "search failed",
+	RetBadPassword:     "password incorrect",
+	RetUserNotExist:    "user does not exist",
+	RetUserLocked:      "user locked",
+	RetUserBlacklisted: "user in blacklist",
+	RetUpgradeOK:       "upgrade successful",
+	RetRestartApp:      "application restart required",
+	RetRestartSystem:   "system reboot required",
+}
+
+// Error returned when device responds with a failure return code
+type RetError uint32
+
+func (ret RetError) Error() string {
+	if str, ok := retStrings[uint32(ret)]; ok {
+		return fmt.Sprintf("device returned %d (%s)", uint32(ret), str)
+	}
+
+	return fmt.Sprintf("device returned %d", uint32(ret))
+}
+
+// Check a return code, nil for any of the success codes
+func CheckRet(ret uint32) error {
+	switch ret {
+	case RetOK, RetUpgradeOK, RetRestartApp, RetRestartSystem:
+		return nil
+	}
+
+	return RetError(ret)
+}
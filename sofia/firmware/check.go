@@ -0,0 +1,127 @@
+package firmware
+
+import (
+	"fmt"
+	"strings"
+
+	"sofia-go/sofia"
+)
+
+// Result of a single compatibility check
+type Status int
+
+const (
+	StatusUnknown  Status = iota // Not enough information to decide
+	StatusMatch                  // Image and device agree
+	StatusMismatch               // Image targets different devices
+)
+
+func (status Status) String() string {
+	switch status {
+	case StatusMatch:
+		return "match"
+	case StatusMismatch:
+		return "MISMATCH"
+	}
+
+	return "unknown"
+}
+
+// Single compatibility check
+type Check struct {
+	Name   string // What is compared
+	Image  string // Value from the image
+	Device string // Value from the device
+	Status Status // Result
+}
+
+// Compatibility report
+type Report struct {
+	Checks      []Check // Individual checks
+	SameVersion bool    // Device already runs this version
+}
+
+// Image is compatible if no check failed
+func (report Report) Compatible() bool {
+	for _, check := range report.Checks {
+		if check.Status == StatusMismatch {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compare image with a device's system and OEM info, oem is nil when the
+// device didn't report it
+func (image *Image) Check(info sofia.SystemInfo, oem *sofia.OEMInfo) Report {
+	var report Report
+
+	// Hardware
+	{
+		check := Check{
+			Name:   "Hardware",
+			Image:  image.Manifest.Hardware,
+			Device: info.SystemInfo.HardWare,
+		}
+		check.Status = compare(check.Image, check.Device)
+
+		report.Checks = append(report.Checks, check)
+	}
+
+	// Build ID, the fourth field of the software version is tied to the board
+	{
+		check := Check{
+			Name:   "BuildID",
+			Image:  versionField(image.Version, 3),
+			Device: versionField(info.SystemInfo.SoftWareVersion, 3),
+		}
+		check.Status = compare(check.Image, check.Device)
+
+		report.Checks = append(report.Checks, check)
+	}
+
+	// OEM ID
+	{
+		check := Check{
+			Name: "OEMID",
+		}
+
+		if oem != nil {
+			check.Device = fmt.Sprint(oem.OEMInfo.OEMID)
+		}
+
+		if image.Manifest.OEMID != nil {
+			check.Image = fmt.Sprint(*image.Manifest.OEMID)
+		}
+		check.Status = compare(check.Image, check.Device)
+
+		report.Checks = append(report.Checks, check)
+	}
+
+	report.SameVersion = len(image.Version) > 0 && image.Version == info.SystemInfo.SoftWareVersion
+
+	return report
+}
+
+// Compare two values, unknown if either is missing
+func compare(image string, device string) Status {
+	if len(image) == 0 || len(device) == 0 {
+		return StatusUnknown
+	}
+
+	if strings.EqualFold(image, device) {
+		return StatusMatch
+	}
+
+	return StatusMismatch
+}
+
+// Get n-th dot separated field of a software version
+func versionField(version string, n int) string {
+	if fields := strings.Split(version, "."); n < len(fields) {
+		return fields[n]
+	}
+
+	return ""
+}
@@ -0,0 +1,267 @@
+package firmware
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+Vendor firmware packages (.bin) are plain ZIP archives, an InstallDesc
+manifest describes the target hardware and which images to burn
+{
+	"UpgradeCommand" : [
+		{
+			"Command" : "Burn",
+			"FileName" : "u-boot.bin.img"
+		},
+		{
+			"Command" : "Burn",
+			"FileName" : "romfs-x.cramfs.img"
+		}
+	],
+	"Hardware" : "HI3518EV200_50H10L_S38",
+	"DevID" : "00002532310000000000000000000000",
+	"CompatibleVersion" : 2,
+	"Vendor" : "General",
+	"CRC" : "1ad3e9c3"
+}
+
+Each partition image is wrapped in a 64 byte U-Boot legacy header
+*/
+
+// Name of the manifest inside the package
+const ManifestName = "InstallDesc"
+
+// U-Boot legacy image header particulars
+const (
+	ImageHeaderLen         = 64
+	ImageHeaderMagic       = 0x27051956
+	ImageHeaderOffsetMagic = 0
+	ImageHeaderOffsetHCRC  = 4
+	ImageHeaderOffsetTime  = 8
+	ImageHeaderOffsetSize  = 12
+	ImageHeaderOffsetLoad  = 16
+	ImageHeaderOffsetEntry = 20
+	ImageHeaderOffsetDCRC  = 24
+	ImageHeaderOffsetName  = 32
+	ImageHeaderNameLen     = 32
+)
+
+// Errors
+var (
+	ErrNoManifest = errors.New("firmware: package has no InstallDesc manifest")
+)
+
+// Single command of the upgrade script
+type UpgradeCommand struct {
+	Command  string // Command, usually Burn
+	FileName string // Image file inside the package
+}
+
+// InstallDesc manifest
+type Manifest struct {
+	UpgradeCommand    []UpgradeCommand // Upgrade script
+	Hardware          string           // Target hardware, matches SystemInfo.HardWare
+	DevID             string           // Target device ID
+	CompatibleVersion int              // Compatible upgrade protocol version
+	Vendor            string           // Target vendor
+	OEMID             *uint32          // Target OEM ID, not present in all packages
+	CRC               string           // Package CRC
+}
+
+// Partition image inside the package
+type Partition struct {
+	FileName string // File name inside the package
+	Size     uint64 // Uncompressed size
+	Burn     bool   // Listed in upgrade script
+	UImage   bool   // Has a U-Boot legacy header
+	Name     string // Image name (from header)
+	DataSize uint32 // Payload size (from header)
+	Load     uint32 // Load address (from header)
+	Entry    uint32 // Entry point (from header)
+	DataCRC  uint32 // Payload CRC (from header)
+	CRCValid bool   // Header and payload match their CRCs
+}
+
+// Opened firmware package
+type Image struct {
+	Path       string      // Package path
+	Version    string      // Software version parsed from the package name, may be empty
+	Manifest   Manifest    // InstallDesc manifest
+	Partitions []Partition // Partition images
+}
+
+// Matches software versions like V4.02.R12.E7335520.12012.047502.00000
+var versionRegexp = regexp.MustCompile(`V\d+\.\d+\.R\d+\.[0-9A-Fa-f]+\.\d+\.\d+\.\d+`)
+
+// Open and inspect a firmware package
+func Open(path string) (*Image, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("firmware: %s is not a firmware package [%w]", path, err)
+	}
+	defer reader.Close()
+
+	image, err := Inspect(&reader.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	image.Path = path
+	image.Version = versionRegexp.FindString(filepath.Base(path))
+
+	return image, nil
+}
+
+// Inspect an already opened firmware package
+func Inspect(reader *zip.Reader) (*Image, error) {
+	// Allocate a new image
+	image := new(Image)
+
+	// Parse manifest
+	{
+		file := findFile(reader, ManifestName)
+		if file == nil {
+			return nil, ErrNoManifest
+		}
+
+		data, err := readFile(file, -1)
+		if err != nil {
+			return nil, err
+		}
+
+		if image.Manifest, err = ParseManifest(data); err != nil {
+			return nil, err
+		}
+	}
+
+	// Burn list
+	burn := make(map[string]bool)
+	for _, cmd := range image.Manifest.UpgradeCommand {
+		if strings.EqualFold(cmd.Command, "Burn") {
+			burn[cmd.FileName] = true
+		}
+	}
+
+	// List partitions
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() || file.Name == ManifestName {
+			continue
+		}
+
+		part := Partition{
+			FileName: file.Name,
+			Size:     file.UncompressedSize64,
+			Burn:     burn[file.Name],
+		}
+
+		hdr, err := readFile(file, ImageHeaderLen)
+		if err != nil {
+			return nil, err
+		}
+
+		decodeImageHeader(hdr, &part)
+
+		// Verify the whole image
+		if part.UImage {
+			data, err := readFile(file, -1)
+			if err != nil {
+				return nil, err
+			}
+
+			part.CRCValid = checkImageCRC(data, part)
+		}
+
+		image.Partitions = append(image.Partitions, part)
+	}
+
+	return image, nil
+}
+
+// Parse an InstallDesc manifest
+func ParseManifest(data []byte) (Manifest, error) {
+	var manifest Manifest
+
+	// Some packages carry a UTF-8 BOM and NUL padding
+	data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+	data = bytes.TrimRight(data, "\x00\r\n\t ")
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("firmware: unable to parse %s [%w]", ManifestName, err)
+	}
+
+	return manifest, nil
+}
+
+// Find a file in the package, names are matched case insensitive
+func findFile(reader *zip.Reader, name string) *zip.File {
+	for _, file := range reader.File {
+		if strings.EqualFold(file.Name, name) {
+			return file
+		}
+	}
+
+	return nil
+}
+
+// Read a file from the package, at most limit bytes (-1 for all)
+func readFile(file *zip.File, limit int64) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var src io.Reader = rc
+	if limit >= 0 {
+		src = io.LimitReader(rc, limit)
+	}
+
+	return io.ReadAll(src)
+}
+
+// Decode U-Boot legacy header, if any
+func decodeImageHeader(buf []byte, part *Partition) {
+	if len(buf) < ImageHeaderLen || binary.BigEndian.Uint32(buf[ImageHeaderOffsetMagic:]) != ImageHeaderMagic {
+		return
+	}
+
+	part.UImage = true
+	part.DataSize = binary.BigEndian.Uint32(buf[ImageHeaderOffsetSize:])
+	part.Load = binary.BigEndian.Uint32(buf[ImageHeaderOffsetLoad:])
+	part.Entry = binary.BigEndian.Uint32(buf[ImageHeaderOffsetEntry:])
+	part.DataCRC = binary.BigEndian.Uint32(buf[ImageHeaderOffsetDCRC:])
+
+	name := buf[ImageHeaderOffsetName : ImageHeaderOffsetName+ImageHeaderNameLen]
+	if idx := bytes.IndexByte(name, 0); idx >= 0 {
+		name = name[:idx]
+	}
+	part.Name = string(name)
+}
+
+// Check the header CRC (computed with the field zeroed) and the payload CRC
+// of a U-Boot legacy image
+func checkImageCRC(buf []byte, part Partition) bool {
+	if len(buf) < ImageHeaderLen || uint64(len(buf)-ImageHeaderLen) < uint64(part.DataSize) {
+		return false
+	}
+
+	hdr := make([]byte, ImageHeaderLen)
+	copy(hdr, buf)
+	binary.BigEndian.PutUint32(hdr[ImageHeaderOffsetHCRC:], 0)
+
+	if crc32.ChecksumIEEE(hdr) != binary.BigEndian.Uint32(buf[ImageHeaderOffsetHCRC:]) {
+		return false
+	}
+
+	return crc32.ChecksumIEEE(buf[ImageHeaderLen:ImageHeaderLen+int(part.DataSize)]) == part.DataCRC
+}
@@ -0,0 +1,360 @@
+package firmware
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sofia-go/sofia"
+)
+
+const testManifest = `{
+	"UpgradeCommand" : [
+		{ "Command" : "Burn", "FileName" : "u-boot.bin.img" },
+		{ "Command" : "Burn", "FileName" : "romfs-x.cramfs.img" }
+	],
+	"Hardware" : "HI3518EV200_50H10L_S38",
+	"DevID" : "00002532310000000000000000000000",
+	"CompatibleVersion" : 2,
+	"Vendor" : "General",
+	"CRC" : "1ad3e9c3"
+}`
+
+// U-Boot legacy image of payload
+func testUImage(name string, payload []byte) []byte {
+	buf := make([]byte, ImageHeaderLen, ImageHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(buf[ImageHeaderOffsetMagic:], ImageHeaderMagic)
+	binary.BigEndian.PutUint32(buf[ImageHeaderOffsetSize:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[ImageHeaderOffsetLoad:], 0x80000000)
+	binary.BigEndian.PutUint32(buf[ImageHeaderOffsetEntry:], 0x80000040)
+	binary.BigEndian.PutUint32(buf[ImageHeaderOffsetDCRC:], crc32.ChecksumIEEE(payload))
+	copy(buf[ImageHeaderOffsetName:ImageHeaderOffsetName+ImageHeaderNameLen], name)
+	binary.BigEndian.PutUint32(buf[ImageHeaderOffsetHCRC:], crc32.ChecksumIEEE(buf))
+
+	return append(buf, payload...)
+}
+
+type testFile struct {
+	name string
+	data []byte
+}
+
+// ZIP archive of files
+func testPackage(t *testing.T, files ...testFile) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, err := writer.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write(file.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func inspectBytes(t *testing.T, data []byte) (*Image, error) {
+	t.Helper()
+
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Inspect(reader)
+}
+
+func TestParseManifest(t *testing.T) {
+	oemId := uint32(123)
+
+	tests := []struct {
+		name     string
+		data     string
+		hardware string
+		oemId    *uint32
+		commands int
+		wantErr  bool
+	}{
+		{name: "plain", data: testManifest, hardware: "HI3518EV200_50H10L_S38", commands: 2},
+		{name: "BOM and padding", data: "\xEF\xBB\xBF" + testManifest + "\r\n\x00\x00", hardware: "HI3518EV200_50H10L_S38", commands: 2},
+		{name: "OEM ID", data: `{"Hardware":"HW","OEMID":123}`, hardware: "HW", oemId: &oemId},
+		{name: "not JSON", data: "InstallDesc", wantErr: true},
+		{name: "empty", data: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest, err := ParseManifest([]byte(test.data))
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if manifest.Hardware != test.hardware {
+				t.Errorf("Hardware = %q, want %q", manifest.Hardware, test.hardware)
+			}
+
+			if len(manifest.UpgradeCommand) != test.commands {
+				t.Errorf("%d upgrade commands, want %d", len(manifest.UpgradeCommand), test.commands)
+			}
+
+			switch {
+			case test.oemId == nil && manifest.OEMID != nil:
+				t.Errorf("OEMID = %d, want none", *manifest.OEMID)
+			case test.oemId != nil && (manifest.OEMID == nil || *manifest.OEMID != *test.oemId):
+				t.Errorf("OEMID = %v, want %d", manifest.OEMID, *test.oemId)
+			}
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	payload := bytes.Repeat([]byte("kernel"), 100)
+
+	corruptPayload := testUImage("romfs", []byte("romfs payload"))
+	corruptPayload[len(corruptPayload)-1] ^= 0xFF
+
+	corruptHeader := testUImage("user", []byte("user payload"))
+	corruptHeader[ImageHeaderOffsetLoad] ^= 0xFF
+
+	truncated := testUImage("web", []byte("web payload"))
+	truncated = truncated[:len(truncated)-4]
+
+	data := testPackage(t,
+		testFile{ManifestName, []byte(testManifest)},
+		testFile{"u-boot.bin.img", testUImage("u-boot", payload)},
+		testFile{"romfs-x.cramfs.img", corruptPayload},
+		testFile{"user-x.cramfs.img", corruptHeader},
+		testFile{"web-x.cramfs.img", truncated},
+		testFile{"logo-x.cramfs", []byte("no header")},
+	)
+
+	image, err := inspectBytes(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Manifest.Vendor != "General" {
+		t.Errorf("Vendor = %q", image.Manifest.Vendor)
+	}
+
+	tests := []struct {
+		fileName string
+		burn     bool
+		uImage   bool
+		name     string
+		crcValid bool
+	}{
+		{"u-boot.bin.img", true, true, "u-boot", true},
+		{"romfs-x.cramfs.img", true, true, "romfs", false},
+		{"user-x.cramfs.img", false, true, "user", false},
+		{"web-x.cramfs.img", false, true, "web", false},
+		{"logo-x.cramfs", false, false, "", false},
+	}
+
+	if len(image.Partitions) != len(tests) {
+		t.Fatalf("%d partitions, want %d", len(image.Partitions), len(tests))
+	}
+
+	for idx, test := range tests {
+		part := image.Partitions[idx]
+		if part.FileName != test.fileName {
+			t.Errorf("partition %d is %q, want %q", idx, part.FileName, test.fileName)
+			continue
+		}
+
+		if part.Burn != test.burn || part.UImage != test.uImage || part.Name != test.name || part.CRCValid != test.crcValid {
+			t.Errorf("%s: burn=%t uimage=%t name=%q crc=%t, want burn=%t uimage=%t name=%q crc=%t", part.FileName,
+				part.Burn, part.UImage, part.Name, part.CRCValid, test.burn, test.uImage, test.name, test.crcValid)
+		}
+	}
+
+	boot := image.Partitions[0]
+	if boot.DataSize != uint32(len(payload)) || boot.Load != 0x80000000 || boot.Entry != 0x80000040 || boot.DataCRC != crc32.ChecksumIEEE(payload) {
+		t.Errorf("u-boot header size=%d load=0x%X entry=0x%X crc=0x%X", boot.DataSize, boot.Load, boot.Entry, boot.DataCRC)
+	}
+}
+
+func TestInspectNoManifest(t *testing.T) {
+	data := testPackage(t, testFile{"u-boot.bin.img", testUImage("u-boot", []byte("boot"))})
+
+	if _, err := inspectBytes(t, data); !errors.Is(err, ErrNoManifest) {
+		t.Fatalf("err = %v, want %v", err, ErrNoManifest)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "General_IPC_HI3518EV200_50H10L_S38.Nat.dss.OnvifS.HIK_V5.00.R02.000529B8.10010.346332.0000000.bin")
+	if err := os.WriteFile(path, testPackage(t, testFile{"installdesc", []byte(testManifest)}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Version != "V5.00.R02.000529B8.10010.346332.0000000" {
+		t.Errorf("Version = %q", image.Version)
+	}
+
+	notZip := filepath.Join(t.TempDir(), "firmware.bin")
+	if err := os.WriteFile(notZip, []byte("not a package"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(notZip); err == nil {
+		t.Error("expected an error for a file that isn't a package")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	oemId, otherOEMID, zero := uint32(7), uint32(8), uint32(0)
+
+	tests := []struct {
+		name        string
+		hardware    string
+		version     string
+		oemId       *uint32
+		devHardware string
+		devVersion  string
+		devOEMID    *uint32  // nil if the device didn't report it
+		statuses    []Status // Hardware, BuildID, OEMID
+		compatible  bool
+		sameVersion bool
+	}{
+		{
+			name:        "same board and OEM",
+			hardware:    "HI3518EV200_50H10L_S38",
+			version:     "V5.00.R02.000529B8.10010.346332.0000000",
+			oemId:       &oemId,
+			devHardware: "hi3518ev200_50h10l_s38",
+			devVersion:  "V5.00.R02.000529B8.10010.346332.0000000",
+			devOEMID:    &oemId,
+			statuses:    []Status{StatusMatch, StatusMatch, StatusMatch},
+			compatible:  true,
+			sameVersion: true,
+		},
+		{
+			name:        "newer build of the same board",
+			hardware:    "HI3518EV200_50H10L_S38",
+			version:     "V5.00.R02.000529B8.10010.346400.0000000",
+			devHardware: "HI3518EV200_50H10L_S38",
+			devVersion:  "V5.00.R02.000529B8.10010.346332.0000000",
+			devOEMID:    &oemId,
+			statuses:    []Status{StatusMatch, StatusMatch, StatusUnknown},
+			compatible:  true,
+		},
+		{
+			name:        "other hardware",
+			hardware:    "HI3516EV300_85H50AI",
+			version:     "V5.00.R02.000529B8.10010.346332.0000000",
+			devHardware: "HI3518EV200_50H10L_S38",
+			devVersion:  "V5.00.R02.000529B8.10010.346332.0000000",
+			statuses:    []Status{StatusMismatch, StatusMatch, StatusUnknown},
+			sameVersion: true,
+		},
+		{
+			name:        "other board build",
+			hardware:    "HI3518EV200_50H10L_S38",
+			version:     "V5.00.R02.00030695.10010.346332.0000000",
+			devHardware: "HI3518EV200_50H10L_S38",
+			devVersion:  "V5.00.R02.000529B8.10010.346332.0000000",
+			statuses:    []Status{StatusMatch, StatusMismatch, StatusUnknown},
+		},
+		{
+			name:        "other OEM",
+			hardware:    "HI3518EV200_50H10L_S38",
+			oemId:       &oemId,
+			devHardware: "HI3518EV200_50H10L_S38",
+			devVersion:  "V5.00.R02.000529B8.10010.346332.0000000",
+			devOEMID:    &otherOEMID,
+			statuses:    []Status{StatusMatch, StatusUnknown, StatusMismatch},
+		},
+		{
+			name:        "OEM info unavailable",
+			hardware:    "HI3518EV200_50H10L_S38",
+			oemId:       &oemId,
+			devHardware: "HI3518EV200_50H10L_S38",
+			devVersion:  "V5.00.R02.000529B8.10010.346332.0000000",
+			statuses:    []Status{StatusMatch, StatusUnknown, StatusUnknown},
+			compatible:  true,
+		},
+		{
+			name:        "OEM ID 0 reported",
+			hardware:    "HI3518EV200_50H10L_S38",
+			oemId:       &oemId,
+			devHardware: "HI3518EV200_50H10L_S38",
+			devVersion:  "V5.00.R02.000529B8.10010.346332.0000000",
+			devOEMID:    &zero,
+			statuses:    []Status{StatusMatch, StatusUnknown, StatusMismatch},
+		},
+		{
+			name:     "nothing known about the device",
+			hardware: "HI3518EV200_50H10L_S38",
+			version:  "V5.00.R02.000529B8.10010.346332.0000000",
+			statuses: []Status{StatusUnknown, StatusUnknown, StatusUnknown},
+			// Nothing failed
+			compatible: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image := &Image{
+				Version:  test.version,
+				Manifest: Manifest{Hardware: test.hardware, OEMID: test.oemId},
+			}
+
+			var info sofia.SystemInfo
+			info.SystemInfo.HardWare = test.devHardware
+			info.SystemInfo.SoftWareVersion = test.devVersion
+
+			var oem *sofia.OEMInfo
+			if test.devOEMID != nil {
+				oem = &sofia.OEMInfo{}
+				oem.OEMInfo.OEMID = *test.devOEMID
+			}
+
+			report := image.Check(info, oem)
+			if len(report.Checks) != len(test.statuses) {
+				t.Fatalf("%d checks, want %d", len(report.Checks), len(test.statuses))
+			}
+
+			for idx, check := range report.Checks {
+				if check.Status != test.statuses[idx] {
+					t.Errorf("%s: %s (image %q, device %q), want %s", check.Name, check.Status, check.Image, check.Device, test.statuses[idx])
+				}
+			}
+
+			if report.Compatible() != test.compatible {
+				t.Errorf("Compatible() = %t, want %t", report.Compatible(), test.compatible)
+			}
+
+			if report.SameVersion != test.sameVersion {
+				t.Errorf("SameVersion = %t, want %t", report.SameVersion, test.sameVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package sofia_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	return logger
+}
+
+// Fake device listening on a random local port
+func startServer(t *testing.T, config sofiatest.Config) *sofiatest.Server {
+	t.Helper()
+
+	server := sofiatest.NewServer(config)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+// Device connected to the fake device, closed at the end of the test. A nil
+// logger discards, setup runs before connecting, e.g. to supervise the device.
+func connectDevice(t *testing.T, server *sofiatest.Server, logger *logrus.Logger, setup func(device *sofia.Device)) *sofia.Device {
+	t.Helper()
+
+	if logger == nil {
+		logger = testLogger()
+	}
+
+	host, port := server.HostPort()
+
+	device, err := sofia.NewDevice(host, port, 1, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if setup != nil {
+		setup(device)
+	}
+
+	if err := device.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { device.Close() })
+
+	return device
+}
+
+// Session with a 1s request timeout, not logged in
+func newSession(t *testing.T, device *sofia.Device, user string, password string) *sofia.Session {
+	t.Helper()
+
+	session, err := device.NewSession(user, sofia.SofiaHash(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetRequestTimeout(time.Second)
+
+	return session
+}
+
+// Logged in admin session of device
+func loginSession(t *testing.T, device *sofia.Device) *sofia.Session {
+	t.Helper()
+
+	session := newSession(t, device, "admin", "")
+	if err := session.Login(); err != nil {
+		t.Fatal(err)
+	}
+
+	return session
+}
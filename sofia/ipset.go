@@ -0,0 +1,226 @@
+package sofia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+IP_SET_REQ is broadcast on the discovery port so it reaches devices outside
+our subnet, the device is selected by MAC
+{
+	"Name" : "NetWork.NetCommon",
+	"NetWork.NetCommon" : {
+		"GateWay" : "0x0101a8c0",
+		"HostIP" : "0x0a01a8c0",
+		"HostName" : "IPC_6a6b",
+		"HttpPort" : 80,
+		"MAC" : "00:12:31:09:b7:9e",
+		...
+		"Submask" : "0x00ffffff",
+		"TCPPort" : 34567,
+		"UDPPort" : 34568
+	},
+	"Password" : "tlJwpbo6",
+	"SessionID" : "0x00000000",
+	"UserName" : "admin"
+}
+*/
+
+// Interval between probes while waiting for a device
+const ipSetProbeInterval = time.Second
+
+// Errors
+var (
+	ErrDiscoveryNotStarted = errors.New("discovery not started")
+	ErrDiscoveryPassive    = errors.New("discovery is passive")
+)
+
+// NetWork.NetCommon (wire format)
+type NetCommon struct {
+	GateWay       string
+	HostIP        string
+	HostName      string
+	HttpPort      uint16
+	MAC           string
+	MaxBps        uint32
+	MonMode       string
+	SSLPort       uint16
+	Submask       string
+	TCPMaxConn    uint32
+	TCPPort       uint16
+	TransferPlan  string
+	UDPPort       uint16
+	UseHSDownLoad bool
+}
+
+// IP_SET_REQ data
+type IPSetReqData struct {
+	Name      string
+	NetCommon NetCommon `json:"NetWork.NetCommon"`
+	Password  string
+	SessionID string
+	UserName  string
+}
+
+// Does device match a MAC or serial number
+func (device *DiscoveredDevice) Matches(target string) bool {
+	if strings.EqualFold(device.SerialNo, target) {
+		return true
+	}
+
+	mac, err := net.ParseMAC(target)
+
+	return err == nil && bytes.Equal(mac, device.MAC)
+}
+
+// Find a device by MAC or serial number, probing until it responds or ctx is done
+func (discovery *Discovery) Find(ctx context.Context, target string) (DiscoveredDevice, error) {
+	watch := discovery.watch()
+	defer discovery.unwatch(watch)
+
+	return discovery.waitFor(ctx, watch, func(device *DiscoveredDevice) bool {
+		return device.Matches(target)
+	})
+}
+
+// Re-address a device found by broadcast, identified by MAC or serial number.
+// The device may be in a different subnet than the host. Waits for the
+// confirmation and for the device to respond at the new address, ctx bounds
+// the whole operation.
+func (discovery *Discovery) SetNetwork(ctx context.Context, target string, ip net.IP, mask net.IPMask, gateway net.IP, credentials Credentials) (DiscoveredDevice, error) {
+	if ip.To4() == nil || len(mask) == 0 || gateway.To4() == nil {
+		return DiscoveredDevice{}, errors.New("IPv4 address, mask and gateway required")
+	}
+
+	if len(discovery.ifaces) == 0 || discovery.ifaces[0].conn == nil {
+		return DiscoveredDevice{}, ErrDiscoveryNotStarted
+	}
+
+	if discovery.passive {
+		return DiscoveredDevice{}, ErrDiscoveryPassive
+	}
+
+	// Confirmations can't be correlated, one request at a time
+	discovery.setMu.Lock()
+	defer discovery.setMu.Unlock()
+
+	watch := discovery.watch()
+	defer discovery.unwatch(watch)
+
+	// Current settings
+	device, err := discovery.waitFor(ctx, watch, func(device *DiscoveredDevice) bool {
+		return device.Matches(target)
+	})
+	if err != nil {
+		return device, fmt.Errorf("device %s not found [%w]", target, err)
+	}
+
+	// Build message
+	buf := new(bytes.Buffer)
+	{
+		if len(credentials.User) == 0 {
+			credentials.User = "admin"
+		}
+
+		data := IPSetReqData{
+			Name: "NetWork.NetCommon",
+			NetCommon: NetCommon{
+				GateWay:       FormatHexIP(gateway),
+				HostIP:        FormatHexIP(ip),
+				HostName:      device.HostName,
+				HttpPort:      device.HttpPort,
+				MAC:           device.MAC.String(),
+				MaxBps:        device.MaxBps,
+				MonMode:       device.MonMode,
+				SSLPort:       device.SSLPort,
+				Submask:       FormatHexIP(mask),
+				TCPMaxConn:    device.TCPMaxConn,
+				TCPPort:       device.TCPPort,
+				TransferPlan:  device.TransferPlan,
+				UDPPort:       device.UDPPort,
+				UseHSDownLoad: device.UseHSDownLoad,
+			},
+			Password:  SofiaHash(credentials.Password),
+			SessionID: "0x00000000",
+			UserName:  credentials.User,
+		}
+
+		mdata, err := json.Marshal(data)
+		if err != nil {
+			return device, err
+		}
+
+		EncodeMessage(&DeviceMessage{msgId: IP_SET_REQ, dataLen: uint32(len(mdata)), data: mdata}, buf)
+	}
+
+	discovery.logger.Infof("Setting %s (%s) from [%s] to [%s/%s gw %s]", device.SerialNo, device.MAC, device.HostIP, ip, net.IP(mask), gateway)
+
+	// Send and wait for confirmation, resending every probe interval
+	{
+		ticker := time.NewTicker(ipSetProbeInterval)
+		defer ticker.Stop()
+
+		discovery.broadcast(buf.Bytes())
+
+	wait:
+		for {
+			select {
+			case msg := <-watch.ipSet:
+				var resData CmdResData2
+				if err := json.Unmarshal(msg.data, &resData); err != nil {
+					return device, err
+				}
+
+				if err := CheckRet(resData.Ret); err != nil {
+					return device, err
+				}
+
+				break wait
+			case <-ticker.C:
+				discovery.broadcast(buf.Bytes())
+			case <-ctx.Done():
+				return device, fmt.Errorf("no confirmation from %s [%w]", target, ctx.Err())
+			}
+		}
+	}
+
+	// Verify device reappears at the new address
+	device, err = discovery.waitFor(ctx, watch, func(device *DiscoveredDevice) bool {
+		return device.Matches(target) && device.HostIP.Equal(ip)
+	})
+	if err != nil {
+		return device, fmt.Errorf("device %s not seen at [%s] [%w]", target, ip, err)
+	}
+
+	discovery.logger.Infof("Device %s now at [%s]", target, device.HostIP)
+
+	return device, nil
+}
+
+// Probe until a response satisfies match or ctx is done
+func (discovery *Discovery) waitFor(ctx context.Context, watch *discoveryWatch, match func(*DiscoveredDevice) bool) (DiscoveredDevice, error) {
+	ticker := time.NewTicker(ipSetProbeInterval)
+	defer ticker.Stop()
+
+	discovery.Probe()
+
+	for {
+		select {
+		case device := <-watch.devices:
+			if match(&device) {
+				return device, nil
+			}
+		case <-ticker.C:
+			discovery.Probe()
+		case <-ctx.Done():
+			return DiscoveredDevice{}, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package sofia
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Keepalive defaults
+const (
+	KeepAliveMaxMisses = 3                // Consecutive missed keepalives before the session is dead
+	KeepAliveTimeout   = 20 * time.Second // Response timeout when the device gave no interval
+)
+
+// Errors
+var (
+	ErrSessionDead = errors.New("session dead, keepalives not answered")
+)
+
+// Keepalive health
+type KeepAliveStats struct {
+	MsgID    uint16        // Keepalive message ID the device answers, 0 until detected
+	LastRTT  time.Duration // Round trip time of the last answered keepalive
+	LastSeen time.Time     // Time of the last answered keepalive
+	Sent     uint64        // Keepalives due, sent or not
+	Missed   uint64        // Keepalives not answered
+	Misses   int           // Consecutive keepalives not answered
+	Dead     bool          // Declared dead after too many consecutive misses
+}
+
+// Keepalive health
+func (session *Session) KeepAliveStats() KeepAliveStats {
+	session.kaMutex.Lock()
+	defer session.kaMutex.Unlock()
+
+	return session.kaStats
+}
+
+// Round trip time of the last answered keepalive
+func (session *Session) LastRTT() time.Duration {
+	return session.KeepAliveStats().LastRTT
+}
+
+// Consecutive missed keepalives before the session is declared dead and the
+// connection dropped, 0 to never give up
+func (session *Session) SetKeepAliveMisses(misses int) {
+	session.kaMutex.Lock()
+	session.kaMaxMiss = misses
+	session.kaMutex.Unlock()
+}
+
+// Keepalive task
+func (session *Session) keepAliveTask(stop chan struct{}, interval uint32) {
+	session.device.logger.Info("Starting KA task for session ", session.sessionID())
+
+	// Create a ticker
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// Send a keep alive message, a dead session is dropped so a
+			// supervised device reconnects
+			err := session.KeepAlive()
+			switch {
+			case err == nil:
+				continue
+			case errors.Is(err, ErrSessionDead):
+				session.device.logger.Error("No keepalive response in ", session.KeepAliveStats().Misses, " tries for session ", session.sessionID())
+				session.device.Fail(err)
+			case errors.Is(err, ErrNotConnected), errors.Is(err, ErrSessionClosed), errors.Is(err, ErrNotLoggedIn), errors.Is(err, ErrDeviceClosed):
+				// Connection lost or session closed, the supervisor restarts
+				// the task after the relogin
+			default:
+				session.device.logger.Warn("Missed keepalive for session ", session.sessionID(), " [", err.Error(), "]")
+				continue
+			}
+
+			return
+		}
+	}
+}
+
+// Start the keepalive task, stopping a previous one
+func (session *Session) startKeepAlive() {
+	session.stopKeepAlive()
+
+	session.kaMutex.Lock()
+	session.kaStats.Misses = 0
+	session.kaStats.Dead = false
+	session.kaMutex.Unlock()
+
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+
+	if session.kaInterval == 0 {
+		return
+	}
+
+	session.kaStop = make(chan struct{})
+	go session.keepAliveTask(session.kaStop, session.kaInterval)
+}
+
+// Stop the keepalive task
+func (session *Session) stopKeepAlive() {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+
+	if session.kaStop != nil {
+		close(session.kaStop)
+		session.kaStop = nil
+	}
+}
+
+// Session keep-alive. Until the device answered once, KEEPALIVE_REQ and
+// KEEPALIVE_REQ_ALT are tried in turn. Any failure other than a lost
+// connection or a closed session or device is a missed reply, ErrSessionDead is
+// returned once too many replies in a row were missed. The keepalive waits
+// for a request in progress at most its own timeout, not getting through
+// counts as a miss.
+func (session *Session) KeepAlive() error {
+	// Data for keepalive
+	data := KeepAliveReqData{
+		Name:      "KeepAlive",
+		SessionID: session.sessionID(),
+	}
+
+	// Marshall data as JSON
+	mdata, _ := json.Marshal(data)
+
+	// Message ID to try
+	session.kaMutex.Lock()
+	msgId := session.kaMsgId
+	if msgId == 0 {
+		msgId = KEEPALIVE_REQ
+		if session.kaStats.Misses%2 == 1 {
+			msgId = KEEPALIVE_REQ_ALT
+		}
+	}
+	session.kaStats.Sent++
+	session.kaMutex.Unlock()
+
+	session.stateMutex.RLock()
+	timeout := time.Second * time.Duration(session.kaInterval)
+	session.stateMutex.RUnlock()
+	if timeout == 0 {
+		timeout = KeepAliveTimeout
+	}
+
+	// Send message to device and receive response, the round trip time
+	// doesn't include the wait for another request
+	var resMsg DeviceMessage
+	var rtt time.Duration
+
+	err := session.acquire(timeout)
+	if err == nil {
+		sent := time.Now()
+		resMsg, err = session.roundTrip(msgId, mdata, timeout, func(resId uint16) bool {
+			return resId == KEEPALIVE_RSP || resId == KEEPALIVE_RSP_ALT
+		})
+		rtt = time.Since(sent)
+
+		session.release()
+	}
+
+	if errors.Is(err, ErrNotConnected) || errors.Is(err, ErrSessionClosed) || errors.Is(err, ErrNotLoggedIn) || errors.Is(err, ErrDeviceClosed) {
+		return err
+	}
+
+	// Check response
+	if err == nil {
+		var resData KeepAliveResData
+		if err = json.Unmarshal(resMsg.data, &resData); err == nil {
+			err = CheckRet(resData.Ret)
+		}
+	}
+
+	session.kaMutex.Lock()
+	defer session.kaMutex.Unlock()
+
+	if err != nil {
+		session.kaStats.Missed++
+		session.kaStats.Misses++
+
+		if session.kaMaxMiss > 0 && session.kaStats.Misses >= session.kaMaxMiss {
+			session.kaStats.Dead = true
+			return ErrSessionDead
+		}
+
+		return err
+	}
+
+	if session.kaMsgId == 0 {
+		session.kaMsgId = msgId
+		session.device.logger.Debug("Keepalive message ID ", msgId, " for session ", session.sessionID())
+	}
+
+	session.kaStats.MsgID = session.kaMsgId
+	session.kaStats.LastRTT = rtt
+	session.kaStats.LastSeen = time.Now()
+	session.kaStats.Misses = 0
+
+	return nil
+}
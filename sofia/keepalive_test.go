@@ -0,0 +1,67 @@
+package sofia_test
+
+import (
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+func TestKeepAliveBehindRequest(t *testing.T) {
+	server := startServer(t, sofiatest.Config{AliveInterval: 1})
+	server.InjectFault(sofiatest.FaultOn(sofia.SYSINFO_REQ, sofiatest.Fault{Delay: 3500 * time.Millisecond}))
+
+	session := loginSession(t, connectDevice(t, server, nil, nil))
+	session.SetRequestTimeout(10 * time.Second)
+	session.SetKeepAliveMisses(0)
+
+	// Keepalives due while the request is in progress can't get through
+	if _, err := session.SystemInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := session.KeepAliveStats()
+	if stats.Missed == 0 || stats.Sent < 2 {
+		t.Fatalf("sent %d, missed %d behind a slow request", stats.Sent, stats.Missed)
+	}
+
+	// Answered once the session is free, the wait isn't part of the RTT
+	deadline := time.Now().Add(3 * time.Second)
+	for stats = session.KeepAliveStats(); stats.Misses > 0; stats = session.KeepAliveStats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("keepalive not answered again, %+v", stats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if stats.LastRTT > 500*time.Millisecond {
+		t.Errorf("RTT %s", stats.LastRTT)
+	}
+}
+
+func TestKeepAliveErrorIsMiss(t *testing.T) {
+	server := startServer(t, sofiatest.Config{AliveInterval: 1})
+
+	// Answered with an error code
+	server.Handle(sofia.KEEPALIVE_REQ, func(conn *sofiatest.Conn, req sofiatest.Frame) error {
+		return conn.Reply(req, map[string]interface{}{"Name": "KeepAlive", "Ret": sofia.RetIllegalRequest})
+	})
+
+	session := loginSession(t, connectDevice(t, server, nil, nil))
+	session.SetKeepAliveMisses(0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := session.KeepAliveStats()
+		if stats.Missed >= 3 {
+			break
+		}
+
+		// The task keeps running after an error
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %d, missed %d", stats.Sent, stats.Missed)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
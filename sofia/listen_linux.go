@@ -0,0 +1,43 @@
+//go:build linux
+
+package sofia
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Create a UDP listener, bound to the named interface if any so broadcasts
+// go out and come in on that interface only
+func listenUDP(ifname string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	config := net.ListenConfig{
+		Control: func(network string, address string, rawConn syscall.RawConn) error {
+			var err error
+
+			cerr := rawConn.Control(func(fd uintptr) {
+				// Several interfaces share the discovery port
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+
+				if len(ifname) > 0 {
+					err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifname)
+				}
+			})
+
+			if cerr != nil {
+				return cerr
+			}
+
+			return err
+		},
+	}
+
+	conn, err := config.ListenPacket(context.Background(), "udp4", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
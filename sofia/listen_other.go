@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sofia
+
+import "net"
+
+// Create a UDP listener, binding to an interface is not supported on this
+// platform so directed broadcasts are the only per-interface traffic
+func listenUDP(ifname string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.ListenUDP("udp4", addr)
+}
@@ -0,0 +1,209 @@
+package sofia
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// Media frame types, the big-endian marker starting every media frame
+const (
+	MediaInfo   = 0x000001F9 // Information frame
+	MediaAudio  = 0x000001FA // Audio frame
+	MediaIFrame = 0x000001FC // Video key frame, carries stream metadata
+	MediaPFrame = 0x000001FD // Video inter frame
+	MediaJPEG   = 0x000001FE // Snapshot, same header as MediaIFrame
+)
+
+// Video codecs of media frames
+const (
+	MediaMPEG4 = 1
+	MediaH264  = 2
+	MediaH265  = 3
+)
+
+// Errors
+var (
+	ErrBadMediaFrame = errors.New("malformed media frame")
+)
+
+/*
+	Media frames are carried by MONITOR_DATA messages, one frame possibly
+	split across several of them. Lengths and time are little-endian.
+
+	I-frame (0x1FC) and JPEG (0x1FE), 16B header:
+	 marker 4B (BE) | media 1B | fps 1B | width/8 1B | height/8 1B | time 4B | length 4B
+
+	P-frame (0x1FD), 8B header:
+	 marker 4B (BE) | length 4B
+
+	Audio (0x1FA) and information (0x1F9), 8B header:
+	 marker 4B (BE) | media 1B | rate/subtype 1B | length 2B
+*/
+
+// Media frame
+type MediaFrame struct {
+	Type   uint32    // MediaIFrame, MediaPFrame, ...
+	Media  byte      // Codec, MediaH264 or MediaH265 for video
+	FPS    byte      // Frame rate (I-frames), sample rate (audio)
+	Width  int       // Width in pixels (I-frames), a multiple of 8
+	Height int       // Height in pixels (I-frames), a multiple of 8
+	Time   time.Time // Capture time (I-frames), second resolution
+	Data   []byte    // Payload, Annex B NAL units for video
+}
+
+// Short name of a media frame type
+func MediaTypeName(mediaType uint32) string {
+	switch mediaType {
+	case MediaInfo:
+		return "Info"
+	case MediaAudio:
+		return "Audio"
+	case MediaIFrame:
+		return "I"
+	case MediaPFrame:
+		return "P"
+	case MediaJPEG:
+		return "JPEG"
+	}
+
+	return "Unknown"
+}
+
+// Name of a video codec
+func MediaCodecName(media byte) string {
+	switch media {
+	case MediaMPEG4:
+		return "MPEG4"
+	case MediaH264:
+		return "H.264"
+	case MediaH265:
+		return "H.265"
+	}
+
+	return "Unknown"
+}
+
+// Length of the media frame header starting buf, 0 if buf doesn't start
+// with a media frame marker
+func MediaHeaderLen(buf []byte) int {
+	if len(buf) < 4 {
+		return 0
+	}
+
+	switch binary.BigEndian.Uint32(buf) {
+	case MediaIFrame, MediaJPEG:
+		return 16
+	case MediaPFrame, MediaAudio, MediaInfo:
+		return 8
+	}
+
+	return 0
+}
+
+// Decode a media frame header, returns the frame without data and the
+// payload length
+func DecodeMediaHeader(buf []byte) (MediaFrame, uint32, error) {
+	var frame MediaFrame
+
+	hlen := MediaHeaderLen(buf)
+	if hlen == 0 || len(buf) < hlen {
+		return frame, 0, ErrBadMediaFrame
+	}
+
+	frame.Type = binary.BigEndian.Uint32(buf)
+
+	switch frame.Type {
+	case MediaIFrame, MediaJPEG:
+		frame.Media = buf[4]
+		frame.FPS = buf[5]
+		frame.Width = int(buf[6]) * 8
+		frame.Height = int(buf[7]) * 8
+		frame.Time = unpackMediaTime(binary.LittleEndian.Uint32(buf[8:]))
+		return frame, binary.LittleEndian.Uint32(buf[12:]), nil
+	case MediaAudio, MediaInfo:
+		frame.Media = buf[4]
+		frame.FPS = buf[5]
+		return frame, uint32(binary.LittleEndian.Uint16(buf[6:])), nil
+	}
+
+	return frame, binary.LittleEndian.Uint32(buf[4:]), nil
+}
+
+// Read a media frame from the concatenated payloads of MONITOR_DATA messages
+func ReadMediaFrame(r io.Reader) (MediaFrame, error) {
+	hbuf := make([]byte, 16)
+	if _, err := io.ReadFull(r, hbuf[:4]); err != nil {
+		return MediaFrame{}, err
+	}
+
+	hlen := MediaHeaderLen(hbuf)
+	if hlen == 0 {
+		return MediaFrame{}, ErrBadMediaFrame
+	}
+
+	if _, err := io.ReadFull(r, hbuf[4:hlen]); err != nil {
+		return MediaFrame{}, err
+	}
+
+	frame, length, err := DecodeMediaHeader(hbuf[:hlen])
+	if err != nil {
+		return frame, err
+	}
+
+	frame.Data = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		return frame, err
+	}
+
+	return frame, nil
+}
+
+// Encode a media frame
+func (frame MediaFrame) Bytes() []byte {
+	var hdr []byte
+
+	switch frame.Type {
+	case MediaIFrame, MediaJPEG:
+		hdr = make([]byte, 16)
+		hdr[4] = frame.Media
+		hdr[5] = frame.FPS
+		hdr[6] = byte(frame.Width / 8)
+		hdr[7] = byte(frame.Height / 8)
+		binary.LittleEndian.PutUint32(hdr[8:], packMediaTime(frame.Time))
+		binary.LittleEndian.PutUint32(hdr[12:], uint32(len(frame.Data)))
+	case MediaAudio, MediaInfo:
+		hdr = make([]byte, 8)
+		hdr[4] = frame.Media
+		hdr[5] = frame.FPS
+		binary.LittleEndian.PutUint16(hdr[6:], uint16(len(frame.Data)))
+	default:
+		hdr = make([]byte, 8)
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(len(frame.Data)))
+	}
+
+	binary.BigEndian.PutUint32(hdr, frame.Type)
+
+	return append(hdr, frame.Data...)
+}
+
+// Pack time as devices do: year-2000 (6b), month (4b), day (5b), hour (5b),
+// minute (6b), second (6b)
+func packMediaTime(t time.Time) uint32 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return uint32(t.Year()-2000)&0x3F<<26 | uint32(t.Month())&0xF<<22 | uint32(t.Day())&0x1F<<17 |
+		uint32(t.Hour())&0x1F<<12 | uint32(t.Minute())&0x3F<<6 | uint32(t.Second())&0x3F
+}
+
+func unpackMediaTime(value uint32) time.Time {
+	if value == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(int(value>>26&0x3F)+2000, time.Month(value>>22&0xF), int(value>>17&0x1F),
+		int(value>>12&0x1F), int(value>>6&0x3F), int(value&0x3F), 0, time.Local)
+}
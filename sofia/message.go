@@ -1,26 +1,114 @@
 package sofia
 
+import (
+	"fmt"
+	"time"
+)
+
 // Message types
 const (
 	LOGIN_REQ1                = 999
 	LOGIN_REQ2                = 1000
 	LOGIN_RSP                 = 1001
-	LOGOUT_REQ                = 1001
-	LOGOUT_RSP                = 1002
+	LOGOUT_REQ                = 1002
+	LOGOUT_RSP                = 1003
 	SYSINFO_REQ               = 1020
 	SYSINFO_RSP               = 1021
+	CONFIG_SET_REQ            = 1040
+	CONFIG_SET_RSP            = 1041
+	CONFIG_GET_REQ            = 1042
+	CONFIG_GET_RSP            = 1043
+	CHANNELTITLE_SET_REQ      = 1046
+	CHANNELTITLE_SET_RSP      = 1047
+	CHANNELTITLE_GET_REQ      = 1048
+	CHANNELTITLE_GET_RSP      = 1049
 	ABILITY_REQ               = 1360
 	ABILITY_RSP               = 1361
+	MONITOR_REQ               = 1410
+	MONITOR_RSP               = 1411
+	MONITOR_DATA              = 1412 // Media frames, not JSON
+	MONITOR_CLAIM             = 1413
+	MONITOR_CLAIM_RSP         = 1414
 	KEEPALIVE_REQ             = 1006 // 1005 on some devices
 	KEEPALIVE_RSP             = 1007 // 1006 on some devices
+	KEEPALIVE_REQ_ALT         = 1005
+	KEEPALIVE_RSP_ALT         = 1006
+	SYSMANAGER_REQ            = 1450
+	SYSMANAGER_RSP            = 1451
+	TIMEQUERY_REQ             = 1452
+	TIMEQUERY_RSP             = 1453
+	DISKMANAGER_REQ           = 1460
+	DISKMANAGER_RSP           = 1461
 	FULLAUTHORITYLIST_GET     = 1470
 	FULLAUTHORITYLIST_GET_RSP = 1471
+	MODIFYPASSWORD_REQ        = 1488
+	MODIFYPASSWORD_RSP        = 1489
 	IPSEARCH_REQ              = 1530
 	IPSEARCH_RSP              = 1531
 	IP_SET_REQ                = 1532
 	IP_SET_RSP                = 1533
+	CONFIG_IMPORT_REQ         = 1540
+	CONFIG_IMPORT_RSP         = 1541
+	CONFIG_EXPORT_REQ         = 1542
+	CONFIG_EXPORT_RSP         = 1543
 )
 
+// Message names, KEEPALIVE_RSP_ALT shares its ID with KEEPALIVE_REQ
+var messageNames = map[uint16]string{
+	LOGIN_REQ1:                "LOGIN_REQ1",
+	LOGIN_REQ2:                "LOGIN_REQ2",
+	LOGIN_RSP:                 "LOGIN_RSP",
+	LOGOUT_REQ:                "LOGOUT_REQ",
+	LOGOUT_RSP:                "LOGOUT_RSP",
+	SYSINFO_REQ:               "SYSINFO_REQ",
+	SYSINFO_RSP:               "SYSINFO_RSP",
+	CONFIG_SET_REQ:            "CONFIG_SET_REQ",
+	CONFIG_SET_RSP:            "CONFIG_SET_RSP",
+	CONFIG_GET_REQ:            "CONFIG_GET_REQ",
+	CONFIG_GET_RSP:            "CONFIG_GET_RSP",
+	CHANNELTITLE_SET_REQ:      "CHANNELTITLE_SET_REQ",
+	CHANNELTITLE_SET_RSP:      "CHANNELTITLE_SET_RSP",
+	CHANNELTITLE_GET_REQ:      "CHANNELTITLE_GET_REQ",
+	CHANNELTITLE_GET_RSP:      "CHANNELTITLE_GET_RSP",
+	ABILITY_REQ:               "ABILITY_REQ",
+	ABILITY_RSP:               "ABILITY_RSP",
+	MONITOR_REQ:               "MONITOR_REQ",
+	MONITOR_RSP:               "MONITOR_RSP",
+	MONITOR_DATA:              "MONITOR_DATA",
+	MONITOR_CLAIM:             "MONITOR_CLAIM",
+	MONITOR_CLAIM_RSP:         "MONITOR_CLAIM_RSP",
+	KEEPALIVE_REQ:             "KEEPALIVE_REQ",
+	KEEPALIVE_RSP:             "KEEPALIVE_RSP",
+	KEEPALIVE_REQ_ALT:         "KEEPALIVE_REQ_ALT",
+	SYSMANAGER_REQ:            "SYSMANAGER_REQ",
+	SYSMANAGER_RSP:            "SYSMANAGER_RSP",
+	TIMEQUERY_REQ:             "TIMEQUERY_REQ",
+	TIMEQUERY_RSP:             "TIMEQUERY_RSP",
+	DISKMANAGER_REQ:           "DISKMANAGER_REQ",
+	DISKMANAGER_RSP:           "DISKMANAGER_RSP",
+	FULLAUTHORITYLIST_GET:     "FULLAUTHORITYLIST_GET",
+	FULLAUTHORITYLIST_GET_RSP: "FULLAUTHORITYLIST_GET_RSP",
+	MODIFYPASSWORD_REQ:        "MODIFYPASSWORD_REQ",
+	MODIFYPASSWORD_RSP:        "MODIFYPASSWORD_RSP",
+	IPSEARCH_REQ:              "IPSEARCH_REQ",
+	IPSEARCH_RSP:              "IPSEARCH_RSP",
+	IP_SET_REQ:                "IP_SET_REQ",
+	IP_SET_RSP:                "IP_SET_RSP",
+	CONFIG_IMPORT_REQ:         "CONFIG_IMPORT_REQ",
+	CONFIG_IMPORT_RSP:         "CONFIG_IMPORT_RSP",
+	CONFIG_EXPORT_REQ:         "CONFIG_EXPORT_REQ",
+	CONFIG_EXPORT_RSP:         "CONFIG_EXPORT_RSP",
+}
+
+// Name of a message ID, the number when unknown
+func MessageName(msgId uint16) string {
+	if name, ok := messageNames[msgId]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("MSG_%d", msgId)
+}
+
 /*
 	<-1----------------->|<-2-------------->|...
      0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9
@@ -52,8 +140,22 @@ const (
 	DeviceMessageOffsetMsgId     = 14
 	DeviceMessageOffsetDataLen   = 16
 	DeviceMessageOffsetData      = 20
+	DeviceMessageMaxDataLen      = 0x800000 // Sanity limit, larger frames are treated as corrupt
 )
 
+// Layout of date/time strings used by devices
+const DeviceTimeLayout = "2006-01-02 15:04:05"
+
+// Parse device time, devices report "0000-00-00 00:00:00" for none
+func parseDeviceTime(str string) time.Time {
+	t, err := time.ParseInLocation(DeviceTimeLayout, str, time.Local)
+	if err != nil || t.Year() < 2000 {
+		return time.Time{}
+	}
+
+	return t
+}
+
 // Message header for internal consumption (!wire format)
 type DeviceMessageHeader struct {
 	msgId     uint16 // Message ID
@@ -75,6 +177,14 @@ type DeviceMessage struct {
 	data      []byte // Payload
 }
 
+func (hdr DeviceMessageHeader) ID() uint16 {
+	return hdr.msgId
+}
+
+func (hdr DeviceMessageHeader) DataLen() uint32 {
+	return hdr.dataLen
+}
+
 func (msg DeviceMessage) ID() uint16 {
 	return msg.msgId
 }
@@ -83,6 +193,18 @@ func (msg DeviceMessage) DataLen() uint32 {
 	return msg.dataLen
 }
 
+func (msg DeviceMessage) SessionID() byte {
+	return msg.sessionId
+}
+
+func (msg DeviceMessage) SeqNum() byte {
+	return msg.seqNum
+}
+
+func (msg DeviceMessage) Data() []byte {
+	return msg.data
+}
+
 // Login request data
 type LoginReqData struct {
 	EncryptType string // Encryption type, always MD5
@@ -114,15 +236,15 @@ type CmdReqData2 struct {
 
 // Generic response data
 type CmdResData struct {
-	Name      string `json: "Name"`      // Command name
-	Ret       uint32 `json: "Ret"`       // Return code
-	SessionID string `json: "SessionID"` // Session ID
+	Name      string `json:"Name"`      // Command name
+	Ret       uint32 `json:"Ret"`       // Return code
+	SessionID string `json:"SessionID"` // Session ID
 }
 
 // Generic response data (format 2)
 type CmdResData2 struct {
-	Ret       uint32 `json: "Ret"`       // Return code
-	SessionID string `json: "SessionID"` // Session ID
+	Ret       uint32 `json:"Ret"`       // Return code
+	SessionID string `json:"SessionID"` // Session ID
 }
 
 type KeepAliveReqData CmdReqData
@@ -284,30 +406,30 @@ type OEMInfo struct {
 }
 
 type SysIPSearchData struct {
-	Ret       uint32 `json: "Ret"`
-	SessionID string `json: "SessionID"`
-	Name      string `json: "Name"`
+	Ret       uint32 `json:"Ret"`
+	SessionID string `json:"SessionID"`
+	Name      string `json:"Name"`
 	NetWork   struct {
-		SN            string `json: "SN"`
-		UDPPort       uint32 `json: "UDPPort"`
-		OtherFunction string `json: "OtherFunction"`
-		HostName      string `json: "HostName"`
-		HttpPort      uint32 `json: "HttpPort"`
-		MAC           string `json: "MAC"`
-		TCPMaxConn    uint32 `json: "TCPMaxConn"`
-		Version       string `json: "Version"`
-		DeviceType    uint32 `json: "DeviceType"`
-		GateWay       string `json: "GateWay"`
-		HostIP        string `json: "HostIP"`
-		MaxBps        uint32 `json: "MaxBps"`
-		TCPPort       uint32 `json: "TCPPort"`
-		TransferPlan  string `json: "TransferPlan"`
-		UseHSDownLoad bool   `json: "UseHSDownLoad"`
-		MonMode       string `json: "MonMode"`
-		SSLPort       uint32 `json: "SSLPort"`
-		Submask       string `json: "Submask"`
-		BuildDate     string `json: "BuildDate"`
-	} `json: "NetWork.NetCommon"`
+		SN            string `json:"SN"`
+		UDPPort       uint32 `json:"UDPPort"`
+		OtherFunction string `json:"OtherFunction"`
+		HostName      string `json:"HostName"`
+		HttpPort      uint32 `json:"HttpPort"`
+		MAC           string `json:"MAC"`
+		TCPMaxConn    uint32 `json:"TCPMaxConn"`
+		Version       string `json:"Version"`
+		DeviceType    uint32 `json:"DeviceType"`
+		GateWay       string `json:"GateWay"`
+		HostIP        string `json:"HostIP"`
+		MaxBps        uint32 `json:"MaxBps"`
+		TCPPort       uint32 `json:"TCPPort"`
+		TransferPlan  string `json:"TransferPlan"`
+		UseHSDownLoad bool   `json:"UseHSDownLoad"`
+		MonMode       string `json:"MonMode"`
+		SSLPort       uint32 `json:"SSLPort"`
+		Submask       string `json:"Submask"`
+		BuildDate     string `json:"BuildDate"`
+	} `json:"NetWork.NetCommon"`
 }
 
 type SysAuthorityList struct {
@@ -0,0 +1,433 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"sofia-go/sofia"
+)
+
+// Default ports
+var (
+	DefaultTCPPorts = []uint16{34567}        // DVRIP
+	DefaultUDPPorts = []uint16{34568, 34569} // Device UDP port and discovery
+)
+
+// Direction of a frame
+type Direction int
+
+const (
+	DirUnknown    Direction = iota // Neither or both ends use a DVRIP port
+	DirToDevice                    // Client to device
+	DirFromDevice                  // Device to client
+)
+
+func (dir Direction) String() string {
+	switch dir {
+	case DirToDevice:
+		return "to device"
+	case DirFromDevice:
+		return "from device"
+	}
+
+	return "unknown"
+}
+
+// Media frame starting in a MONITOR_DATA payload
+type Media struct {
+	Frame  sofia.MediaFrame // Header fields, without data
+	Length int              // Payload length
+}
+
+// Decoded DVRIP frame
+type Frame struct {
+	Time      time.Time           // Capture time of the packet completing the frame
+	Proto     string              // tcp or udp
+	Src       netip.AddrPort      // Source
+	Dst       netip.AddrPort      // Destination
+	Direction Direction           // Direction
+	Message   sofia.DeviceMessage // Message, payload without trailer
+	Media     []Media             // Media frames starting in a MONITOR_DATA payload
+}
+
+// Dissection counters
+type Stats struct {
+	Packets   int // Packets read
+	Frames    int // DVRIP frames decoded
+	Ignored   int // Packets of other protocols or ports
+	Fragments int // IP fragments, not reassembled
+	Truncated int // Packets cut by the snap length
+	Gaps      int // Stream bytes never captured, decoding resumed after them
+	Skipped   int // Stream bytes that weren't DVRIP frames
+}
+
+// Connection halves by source and destination
+type flowKey struct {
+	src netip.AddrPort
+	dst netip.AddrPort
+}
+
+// Decodes DVRIP frames from captured packets
+type Dissector struct {
+	tcpPorts map[uint16]bool        // DVRIP ports
+	udpPorts map[uint16]bool        // Discovery ports
+	streams  map[flowKey]*tcpStream // TCP streams
+	stats    Stats                  // Counters
+}
+
+// Create a dissector for the default ports
+func NewDissector() *Dissector {
+	dissector := &Dissector{
+		streams: make(map[flowKey]*tcpStream),
+	}
+
+	dissector.SetPorts(DefaultTCPPorts, DefaultUDPPorts)
+
+	return dissector
+}
+
+// Ports to decode, nil keeps the current ones
+func (dissector *Dissector) SetPorts(tcpPorts []uint16, udpPorts []uint16) {
+	if tcpPorts != nil {
+		dissector.tcpPorts = make(map[uint16]bool)
+		for _, port := range tcpPorts {
+			dissector.tcpPorts[port] = true
+		}
+	}
+
+	if udpPorts != nil {
+		dissector.udpPorts = make(map[uint16]bool)
+		for _, port := range udpPorts {
+			dissector.udpPorts[port] = true
+		}
+	}
+}
+
+// Counters so far
+func (dissector *Dissector) Stats() Stats {
+	return dissector.stats
+}
+
+// Read all packets, fn is called for every frame in capture order
+func (dissector *Dissector) Dissect(reader *Reader, fn func(frame Frame) error) error {
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, frame := range dissector.Packet(packet) {
+			if err := fn(frame); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, frame := range dissector.Flush() {
+		if err := fn(frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decode a packet, returns the frames it completes
+func (dissector *Dissector) Packet(packet Packet) []Frame {
+	dissector.stats.Packets++
+
+	seg, err := decodePacket(packet)
+	switch err {
+	case nil:
+	case errFragment:
+		dissector.stats.Fragments++
+		return nil
+	case errTruncated:
+		dissector.stats.Truncated++
+		return nil
+	default:
+		dissector.stats.Ignored++
+		return nil
+	}
+
+	var ports map[uint16]bool
+	if ports = dissector.tcpPorts; seg.proto == protoUDP {
+		ports = dissector.udpPorts
+	}
+
+	if !ports[seg.src.Port()] && !ports[seg.dst.Port()] {
+		dissector.stats.Ignored++
+		return nil
+	}
+
+	if seg.proto == protoUDP {
+		return dissector.datagram(packet.Time, seg)
+	}
+
+	return dissector.segment(packet.Time, seg)
+}
+
+// Decode what is left of streams with bytes never captured
+func (dissector *Dissector) Flush() []Frame {
+	var frames []Frame
+
+	for key, stream := range dissector.streams {
+		for len(stream.pending) > 0 {
+			dissector.stats.Gaps++
+			stream.skipGap()
+			frames = append(frames, dissector.decode(stream.last, key, stream)...)
+		}
+	}
+
+	return frames
+}
+
+// TCP segment
+func (dissector *Dissector) segment(t time.Time, seg segment) []Frame {
+	key := flowKey{src: seg.src, dst: seg.dst}
+
+	stream := dissector.streams[key]
+	if stream == nil || seg.flags&tcpSYN != 0 {
+		// New connection, possibly reusing the addresses
+		stream = newTCPStream()
+		dissector.streams[key] = stream
+	}
+
+	stream.last = t
+	stream.add(seg)
+	frames := dissector.decode(t, key, stream)
+
+	for stream.pendingLen > MaxPendingLen {
+		dissector.stats.Gaps++
+		stream.skipGap()
+		frames = append(frames, dissector.decode(t, key, stream)...)
+	}
+
+	if seg.flags&tcpRST != 0 {
+		dissector.EndStream(seg.src, seg.dst)
+	}
+
+	return frames
+}
+
+// Decode bytes of a TCP stream received in order, e.g. by a proxy. Returns
+// the frames they complete.
+func (dissector *Dissector) Stream(t time.Time, src netip.AddrPort, dst netip.AddrPort, data []byte) []Frame {
+	key := flowKey{src: src, dst: dst}
+
+	stream := dissector.streams[key]
+	if stream == nil {
+		stream = newTCPStream()
+		dissector.streams[key] = stream
+	}
+
+	stream.last = t
+	stream.buf = append(stream.buf, data...)
+
+	return dissector.decode(t, key, stream)
+}
+
+// Forget both directions of a TCP connection
+func (dissector *Dissector) EndStream(src netip.AddrPort, dst netip.AddrPort) {
+	delete(dissector.streams, flowKey{src: src, dst: dst})
+	delete(dissector.streams, flowKey{src: dst, dst: src})
+}
+
+// Decode the complete frames of a stream
+func (dissector *Dissector) decode(t time.Time, key flowKey, stream *tcpStream) []Frame {
+	var frames []Frame
+
+	msgs, used := dissector.messages(stream.buf)
+	stream.buf = append(stream.buf[:0], stream.buf[used:]...)
+
+	for _, msg := range msgs {
+		frame := dissector.frame(t, "tcp", key.src, key.dst, msg)
+
+		if msg.ID() == sofia.MONITOR_DATA {
+			var skipped int
+			frame.Media, skipped = stream.media.scan(msg.Data())
+			dissector.stats.Skipped += skipped
+		}
+
+		frames = append(frames, frame)
+	}
+
+	return frames
+}
+
+// UDP datagram, possibly carrying several messages
+func (dissector *Dissector) datagram(t time.Time, seg segment) []Frame {
+	var frames []Frame
+
+	msgs, used := dissector.messages(seg.payload)
+	if rest := seg.payload[used:]; !bytes.Equal(rest, []byte{0x0A, 0x00}) {
+		dissector.stats.Skipped += len(rest)
+	}
+
+	for _, msg := range msgs {
+		frames = append(frames, dissector.frame(t, "udp", seg.src, seg.dst, msg))
+	}
+
+	return frames
+}
+
+// Split buf into messages, returns the bytes used. Client trailers and bytes
+// that aren't DVRIP are skipped, an incomplete message at the end is not used.
+func (dissector *Dissector) messages(buf []byte) ([]sofia.DeviceMessage, int) {
+	var msgs []sofia.DeviceMessage
+
+	used := 0
+	for len(buf)-used >= sofia.DeviceMessageHeaderLen {
+		rest := buf[used:]
+
+		if !sofia.ValidMessageHeader(rest) {
+			// Trailer clients send after the data length
+			if rest[0] == 0x0A && rest[1] == 0x00 {
+				used += sofia.DeviceMessageTrailerLen
+				continue
+			}
+
+			// Resynchronize on the next header flag
+			skip := bytes.IndexByte(rest[1:], 0xFF) + 1
+			if skip == 0 {
+				skip = len(rest)
+			}
+
+			dissector.stats.Skipped += skip
+			used += skip
+			continue
+		}
+
+		hdr := sofia.DecodeMessageHeader(rest)
+		msgLen := sofia.DeviceMessageHeaderLen + int(hdr.DataLen())
+		if len(rest) < msgLen {
+			break
+		}
+
+		// Copied, buf is reused
+		msgs = append(msgs, sofia.DecodeMessage(append([]byte(nil), rest[:msgLen]...)))
+		used += msgLen
+	}
+
+	dissector.stats.Frames += len(msgs)
+
+	return msgs, used
+}
+
+// Frame of a message
+func (dissector *Dissector) frame(t time.Time, proto string, src netip.AddrPort, dst netip.AddrPort, msg sofia.DeviceMessage) Frame {
+	frame := Frame{
+		Time:    t,
+		Proto:   proto,
+		Src:     src,
+		Dst:     dst,
+		Message: msg,
+	}
+
+	var ports map[uint16]bool
+	if ports = dissector.tcpPorts; proto == "udp" {
+		ports = dissector.udpPorts
+	}
+
+	switch {
+	case ports[dst.Port()] && !ports[src.Port()]:
+		frame.Direction = DirToDevice
+	case ports[src.Port()] && !ports[dst.Port()]:
+		frame.Direction = DirFromDevice
+	case proto == "udp":
+		// Discovery uses the same port both ways, responses have odd IDs
+		if frame.Direction = DirToDevice; msg.ID()%2 == 1 {
+			frame.Direction = DirFromDevice
+		}
+	}
+
+	return frame
+}
+
+// Summary line
+func (frame Frame) String() string {
+	msg := frame.Message
+
+	ts := "-"
+	if !frame.Time.IsZero() {
+		ts = frame.Time.Format("2006-01-02 15:04:05.000000")
+	}
+
+	return fmt.Sprintf("%s %s %s > %s (%s) session 0x%08X seq %d %s [%d] %d bytes", ts, frame.Proto, frame.Src, frame.Dst,
+		frame.Direction, msg.SessionID(), msg.SeqNum(), sofia.MessageName(msg.ID()), msg.ID(), len(msg.Data()))
+}
+
+// Write the summary line followed by the pretty printed JSON payload, the
+// media frames or a hex dump of other payloads
+func (frame Frame) Format(w io.Writer) error {
+	var out strings.Builder
+	out.WriteString(frame.String())
+	out.WriteByte('\n')
+
+	data := frame.Message.Data()
+	trimmed := bytes.TrimRight(data, "\x00\n ")
+
+	switch {
+	case frame.Message.ID() == sofia.MONITOR_DATA:
+		for _, media := range frame.Media {
+			out.WriteString("  ")
+			out.WriteString(media.String())
+			out.WriteByte('\n')
+		}
+	case len(trimmed) > 0 && json.Valid(trimmed):
+		var pretty bytes.Buffer
+		json.Indent(&pretty, trimmed, "  ", "  ")
+		out.WriteString("  ")
+		out.Write(pretty.Bytes())
+		out.WriteByte('\n')
+	case len(data) > 0:
+		dump := data
+		if len(dump) > 256 {
+			dump = dump[:256]
+		}
+
+		for _, line := range strings.SplitAfter(strings.TrimRight(hex.Dump(dump), "\n"), "\n") {
+			out.WriteString("  ")
+			out.WriteString(line)
+		}
+		out.WriteByte('\n')
+
+		if len(dump) < len(data) {
+			fmt.Fprintf(&out, "  ... %d more bytes\n", len(data)-len(dump))
+		}
+	}
+
+	_, err := io.WriteString(w, out.String())
+
+	return err
+}
+
+// Media frame summary
+func (media Media) String() string {
+	frame := media.Frame
+
+	switch frame.Type {
+	case sofia.MediaIFrame, sofia.MediaJPEG:
+		ts := "-"
+		if !frame.Time.IsZero() {
+			ts = frame.Time.Format(sofia.DeviceTimeLayout)
+		}
+
+		return fmt.Sprintf("%s %s %dx%d %d fps %s, %d bytes", sofia.MediaTypeName(frame.Type), sofia.MediaCodecName(frame.Media),
+			frame.Width, frame.Height, frame.FPS, ts, media.Length)
+	case sofia.MediaAudio, sofia.MediaInfo:
+		return fmt.Sprintf("%s type %d rate %d, %d bytes", sofia.MediaTypeName(frame.Type), frame.Media, frame.FPS, media.Length)
+	}
+
+	return fmt.Sprintf("%s, %d bytes", sofia.MediaTypeName(frame.Type), media.Length)
+}
@@ -0,0 +1,278 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// IP protocols
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+)
+
+// Errors
+var (
+	errNotIP      = errors.New("not IP")
+	errFragment   = errors.New("IP fragment")
+	errTruncated  = errors.New("truncated by snap length")
+	errMalformed  = errors.New("malformed packet")
+	errOtherProto = errors.New("neither TCP nor UDP")
+)
+
+// TCP segment or UDP datagram
+type segment struct {
+	proto   byte           // protoTCP or protoUDP
+	src     netip.AddrPort // Source
+	dst     netip.AddrPort // Destination
+	seq     uint32         // TCP sequence number
+	flags   byte           // TCP flags
+	payload []byte         // Payload
+}
+
+// Decode the link, network and transport layers of a packet
+func decodePacket(packet Packet) (segment, error) {
+	data := packet.Data
+
+	// Link layer, down to an IP packet
+	var etherType uint16
+	switch packet.LinkType {
+	case LinkEthernet:
+		if len(data) < 14 {
+			return segment{}, errMalformed
+		}
+
+		etherType, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+
+		// VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88A8 || etherType == 0x9100) && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case LinkSLL:
+		if len(data) < 16 {
+			return segment{}, errMalformed
+		}
+
+		etherType, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case LinkSLL2:
+		if len(data) < 20 {
+			return segment{}, errMalformed
+		}
+
+		etherType, data = binary.BigEndian.Uint16(data), data[20:]
+	case LinkNull, LinkLoop:
+		if len(data) < 4 {
+			return segment{}, errMalformed
+		}
+
+		// Address family in host order of the capturing machine
+		family := binary.BigEndian.Uint32(data)
+		if packet.LinkType == LinkNull && family > 0xFFFF {
+			family = binary.LittleEndian.Uint32(data)
+		}
+
+		switch family {
+		case 2:
+			etherType = 0x0800
+		case 10, 24, 28, 30:
+			etherType = 0x86DD
+		}
+
+		data = data[4:]
+	case LinkRaw, LinkIPv4, LinkIPv6:
+		if len(data) > 0 {
+			switch data[0] >> 4 {
+			case 4:
+				etherType = 0x0800
+			case 6:
+				etherType = 0x86DD
+			}
+		}
+	}
+
+	switch etherType {
+	case 0x0800:
+		return decodeIPv4(data)
+	case 0x86DD:
+		return decodeIPv6(data)
+	}
+
+	return segment{}, errNotIP
+}
+
+// IPv4 packet
+func decodeIPv4(data []byte) (segment, error) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return segment{}, errMalformed
+	}
+
+	hlen := int(data[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(data[2:]))
+	if hlen < 20 || total < hlen {
+		return segment{}, errMalformed
+	}
+
+	// More fragments or a fragment offset
+	if binary.BigEndian.Uint16(data[6:])&0x3FFF != 0 {
+		return segment{}, errFragment
+	}
+
+	if total > len(data) {
+		return segment{}, errTruncated
+	}
+
+	src, _ := netip.AddrFromSlice(data[12:16])
+	dst, _ := netip.AddrFromSlice(data[16:20])
+
+	return decodeTransport(data[9], src, dst, data[hlen:total])
+}
+
+// IPv6 packet
+func decodeIPv6(data []byte) (segment, error) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return segment{}, errMalformed
+	}
+
+	total := 40 + int(binary.BigEndian.Uint16(data[4:]))
+	if total > len(data) {
+		return segment{}, errTruncated
+	}
+
+	src, _ := netip.AddrFromSlice(data[8:24])
+	dst, _ := netip.AddrFromSlice(data[24:40])
+
+	// Extension headers
+	next, payload := data[6], data[40:total]
+	for {
+		switch next {
+		case 0, 43, 60: // Hop-by-hop, routing, destination options
+			if len(payload) < 8 || len(payload) < (int(payload[1])+1)*8 {
+				return segment{}, errMalformed
+			}
+
+			next, payload = payload[0], payload[(int(payload[1])+1)*8:]
+			continue
+		case 44: // Fragment
+			return segment{}, errFragment
+		}
+
+		return decodeTransport(next, src, dst, payload)
+	}
+}
+
+// TCP segment or UDP datagram
+func decodeTransport(proto byte, src netip.Addr, dst netip.Addr, data []byte) (segment, error) {
+	seg := segment{proto: proto}
+
+	switch proto {
+	case protoTCP:
+		if len(data) < 20 {
+			return seg, errMalformed
+		}
+
+		hlen := int(data[12]>>4) * 4
+		if hlen < 20 || hlen > len(data) {
+			return seg, errMalformed
+		}
+
+		seg.seq = binary.BigEndian.Uint32(data[4:])
+		seg.flags = data[13]
+		seg.payload = data[hlen:]
+	case protoUDP:
+		if len(data) < 8 {
+			return seg, errMalformed
+		}
+
+		length := int(binary.BigEndian.Uint16(data[4:]))
+		if length < 8 || length > len(data) {
+			return seg, errMalformed
+		}
+
+		seg.payload = data[8:length]
+	default:
+		return seg, errOtherProto
+	}
+
+	seg.src = netip.AddrPortFrom(src.Unmap(), binary.BigEndian.Uint16(data))
+	seg.dst = netip.AddrPortFrom(dst.Unmap(), binary.BigEndian.Uint16(data[2:]))
+
+	return seg, nil
+}
+
+// Encode a TCP segment in an IPv4 packet, IPv6 if either address is IPv6
+func encodeTCP(src netip.AddrPort, dst netip.AddrPort, seq uint32, ack uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp, src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF)
+	tcp = append(tcp, payload...)
+
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+
+	var ip, pseudo []byte
+	if srcIP.Is4() && dstIP.Is4() {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // Don't fragment
+		ip[8] = 64
+		ip[9] = protoTCP
+		src4, dst4 := srcIP.As4(), dstIP.As4()
+		copy(ip[12:], src4[:])
+		copy(ip[16:], dst4[:])
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+		pseudo = append(append(append([]byte{}, ip[12:20]...), 0, protoTCP), byte(len(tcp)>>8), byte(len(tcp)))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = protoTCP
+		ip[7] = 64
+		src16, dst16 := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:], src16[:])
+		copy(ip[24:], dst16[:])
+
+		pseudo = append(append([]byte{}, ip[8:40]...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, protoTCP)
+	}
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+
+	return append(ip, tcp...)
+}
+
+// Internet checksum of data, continuing initial
+func checksum(data []byte, initial uint32) uint16 {
+	total := initial + sum(data)
+	for total>>16 != 0 {
+		total = total&0xFFFF + total>>16
+	}
+
+	return ^uint16(total)
+}
+
+// One's complement sum of 16 bit words, unfolded
+func sum(data []byte) uint32 {
+	var total uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		total += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+
+	if len(data)%2 == 1 {
+		total += uint32(data[len(data)-1]) << 8
+	}
+
+	return total
+}
@@ -0,0 +1,355 @@
+// Package pcap decodes DVRIP traffic from tcpdump captures (pcap and pcapng
+// files) without libpcap.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Link types
+const (
+	LinkNull     = 0   // BSD loopback, host order address family
+	LinkEthernet = 1   // Ethernet
+	LinkRaw      = 101 // Raw IPv4 or IPv6
+	LinkLoop     = 108 // OpenBSD loopback, network order address family
+	LinkSLL      = 113 // Linux cooked capture
+	LinkIPv4     = 228 // Raw IPv4
+	LinkIPv6     = 229 // Raw IPv6
+	LinkSLL2     = 276 // Linux cooked capture v2
+)
+
+// File format particulars
+const (
+	pcapMagicMicro   = 0xA1B2C3D4 // pcap, microsecond timestamps
+	pcapMagicNano    = 0xA1B23C4D // pcap, nanosecond timestamps
+	pcapngSHB        = 0x0A0D0D0A // pcapng section header block
+	pcapngIDB        = 0x00000001 // pcapng interface description block
+	pcapngSPB        = 0x00000003 // pcapng simple packet block
+	pcapngEPB        = 0x00000006 // pcapng enhanced packet block
+	pcapngByteOrder  = 0x1A2B3C4D // pcapng byte order magic
+	pcapngTsResol    = 9          // if_tsresol option
+	pcapngTsOffset   = 14         // if_tsoffset option
+	pcapMaxBlockLen  = 0x4000000  // Sanity limit of blocks and packets
+	pcapMinBlockLen  = 12         // Block type, length and trailing length
+	pcapngEPBHdrLen  = 20         // Interface id, timestamp, captured and original length
+	pcapRecordHdrLen = 16         // Timestamp, captured and original length
+)
+
+// Errors
+var (
+	ErrUnknownFormat = errors.New("pcap: unknown capture file format")
+	ErrBadBlock      = errors.New("pcap: malformed block")
+)
+
+// Captured packet
+type Packet struct {
+	Time     time.Time // Capture time, zero for pcapng simple packets
+	LinkType uint32    // Link type of Data
+	Data     []byte    // Captured bytes, possibly cut at the snap length
+	Length   int       // Original length on the wire
+}
+
+// Interface of a pcapng section
+type pcapngInterface struct {
+	linkType uint32        // Link type
+	unit     time.Duration // Timestamp unit, 0 for sub-nanosecond
+	perSec   uint64        // Timestamp units per second
+	offset   int64         // Seconds added to timestamps
+}
+
+// Reads packets from a pcap or pcapng file
+type Reader struct {
+	r          *bufio.Reader     // Capture file
+	order      binary.ByteOrder  // Byte order of the file (pcapng: section)
+	ng         bool              // pcapng
+	nano       bool              // pcap: nanosecond timestamps
+	linkType   uint32            // pcap: link type
+	interfaces []pcapngInterface // pcapng: interfaces of the section
+}
+
+// Create a reader, detects the format from the file header
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{
+		r: bufio.NewReaderSize(r, 0x10000),
+	}
+
+	magic, err := reader.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(magic) == pcapngSHB:
+		reader.ng = true
+		if err := reader.readSection(); err != nil {
+			return nil, err
+		}
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicro || binary.LittleEndian.Uint32(magic) == pcapMagicNano:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == pcapMagicMicro || binary.BigEndian.Uint32(magic) == pcapMagicNano:
+		reader.order = binary.BigEndian
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	if !reader.ng {
+		// Magic, version, zone, sigfigs, snaplen, link type
+		hdr := make([]byte, 24)
+		if _, err := io.ReadFull(reader.r, hdr); err != nil {
+			return nil, err
+		}
+
+		reader.nano = reader.order.Uint32(hdr) == pcapMagicNano
+		reader.linkType = reader.order.Uint32(hdr[20:]) & 0x0FFFFFFF
+	}
+
+	return reader, nil
+}
+
+// Read the next packet, io.EOF at the end of the file
+func (reader *Reader) ReadPacket() (Packet, error) {
+	if reader.ng {
+		return reader.readBlock()
+	}
+
+	return reader.readRecord()
+}
+
+// pcap record
+func (reader *Reader) readRecord() (Packet, error) {
+	var packet Packet
+
+	hdr := make([]byte, pcapRecordHdrLen)
+	if _, err := io.ReadFull(reader.r, hdr); err != nil {
+		return packet, err
+	}
+
+	capLen := reader.order.Uint32(hdr[8:])
+	if capLen > pcapMaxBlockLen {
+		return packet, ErrBadBlock
+	}
+
+	sec, frac := int64(reader.order.Uint32(hdr)), int64(reader.order.Uint32(hdr[4:]))
+	if !reader.nano {
+		frac *= 1000
+	}
+
+	packet.Time = time.Unix(sec, frac)
+	packet.LinkType = reader.linkType
+	packet.Length = int(reader.order.Uint32(hdr[12:]))
+	packet.Data = make([]byte, capLen)
+
+	if _, err := io.ReadFull(reader.r, packet.Data); err != nil {
+		return packet, unexpected(err)
+	}
+
+	return packet, nil
+}
+
+// pcapng blocks until a packet
+func (reader *Reader) readBlock() (Packet, error) {
+	for {
+		head, err := reader.r.Peek(4)
+		if err != nil {
+			return Packet{}, err
+		}
+
+		// A new section may switch byte order
+		if binary.LittleEndian.Uint32(head) == pcapngSHB {
+			if err := reader.readSection(); err != nil {
+				return Packet{}, err
+			}
+			continue
+		}
+
+		blockType, body, err := reader.block()
+		if err != nil {
+			return Packet{}, err
+		}
+
+		switch blockType {
+		case pcapngIDB:
+			if err := reader.addInterface(body); err != nil {
+				return Packet{}, err
+			}
+		case pcapngEPB:
+			return reader.enhancedPacket(body)
+		case pcapngSPB:
+			return reader.simplePacket(body)
+		}
+	}
+}
+
+// Read a block, returns its type and body
+func (reader *Reader) block() (uint32, []byte, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(reader.r, hdr); err != nil {
+		return 0, nil, err
+	}
+
+	blockType, blockLen := reader.order.Uint32(hdr), reader.order.Uint32(hdr[4:])
+	if blockLen < pcapMinBlockLen || blockLen > pcapMaxBlockLen || blockLen%4 != 0 {
+		return 0, nil, ErrBadBlock
+	}
+
+	body := make([]byte, blockLen-8)
+	if _, err := io.ReadFull(reader.r, body); err != nil {
+		return 0, nil, unexpected(err)
+	}
+
+	// Without the trailing block length
+	return blockType, body[:len(body)-4], nil
+}
+
+// Section header block, resets interfaces
+func (reader *Reader) readSection() error {
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(reader.r, hdr); err != nil {
+		return unexpected(err)
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr[8:]) == pcapngByteOrder:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[8:]) == pcapngByteOrder:
+		reader.order = binary.BigEndian
+	default:
+		return ErrBadBlock
+	}
+
+	blockLen := reader.order.Uint32(hdr[4:])
+	if blockLen < 28 || blockLen > pcapMaxBlockLen || blockLen%4 != 0 {
+		return ErrBadBlock
+	}
+
+	if _, err := reader.r.Discard(int(blockLen) - len(hdr)); err != nil {
+		return unexpected(err)
+	}
+
+	reader.interfaces = nil
+
+	return nil
+}
+
+// Interface description block
+func (reader *Reader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return ErrBadBlock
+	}
+
+	iface := pcapngInterface{
+		linkType: uint32(reader.order.Uint16(body)),
+		unit:     time.Microsecond,
+		perSec:   1000000,
+	}
+
+	// Options
+	for opts := body[8:]; len(opts) >= 4; {
+		code, length := reader.order.Uint16(opts), int(reader.order.Uint16(opts[2:]))
+		if code == 0 || 4+length > len(opts) {
+			break
+		}
+
+		value := opts[4 : 4+length]
+
+		switch {
+		case code == pcapngTsResol && length >= 1:
+			exp := uint64(value[0] & 0x7F)
+			base := uint64(10)
+			if value[0]&0x80 != 0 {
+				base = 2
+			}
+
+			if float64(exp)*math.Log2(float64(base)) >= 64 {
+				return fmt.Errorf("pcap: unsupported timestamp resolution 0x%02X", value[0])
+			}
+
+			iface.perSec = 1
+			for i := uint64(0); i < exp; i++ {
+				iface.perSec *= base
+			}
+
+			iface.unit = 0
+			if iface.perSec <= uint64(time.Second) && uint64(time.Second)%iface.perSec == 0 {
+				iface.unit = time.Second / time.Duration(iface.perSec)
+			}
+		case code == pcapngTsOffset && length >= 8:
+			iface.offset = int64(reader.order.Uint64(value))
+		}
+
+		opts = opts[4+(length+3)&^3:]
+	}
+
+	reader.interfaces = append(reader.interfaces, iface)
+
+	return nil
+}
+
+// Enhanced packet block
+func (reader *Reader) enhancedPacket(body []byte) (Packet, error) {
+	var packet Packet
+
+	if len(body) < pcapngEPBHdrLen {
+		return packet, ErrBadBlock
+	}
+
+	ifaceId := reader.order.Uint32(body)
+	if int(ifaceId) >= len(reader.interfaces) {
+		return packet, fmt.Errorf("pcap: packet of undeclared interface %d", ifaceId)
+	}
+	iface := reader.interfaces[ifaceId]
+
+	capLen := reader.order.Uint32(body[12:])
+	if int(capLen) > len(body)-pcapngEPBHdrLen {
+		return packet, ErrBadBlock
+	}
+
+	ts := uint64(reader.order.Uint32(body[4:]))<<32 | uint64(reader.order.Uint32(body[8:]))
+
+	sec, frac := ts/iface.perSec, ts%iface.perSec
+	if iface.unit > 0 {
+		packet.Time = time.Unix(int64(sec)+iface.offset, int64(frac)*int64(iface.unit))
+	} else {
+		packet.Time = time.Unix(int64(sec)+iface.offset, int64(float64(frac)*1e9/float64(iface.perSec)))
+	}
+
+	packet.LinkType = iface.linkType
+	packet.Length = int(reader.order.Uint32(body[16:]))
+	packet.Data = body[pcapngEPBHdrLen : pcapngEPBHdrLen+capLen]
+
+	return packet, nil
+}
+
+// Simple packet block, always of the first interface and without timestamp
+func (reader *Reader) simplePacket(body []byte) (Packet, error) {
+	var packet Packet
+
+	if len(body) < 4 || len(reader.interfaces) == 0 {
+		return packet, ErrBadBlock
+	}
+
+	packet.LinkType = reader.interfaces[0].linkType
+	packet.Length = int(reader.order.Uint32(body))
+	packet.Data = body[4:]
+
+	if packet.Length < len(packet.Data) {
+		packet.Data = packet.Data[:packet.Length]
+	}
+
+	return packet, nil
+}
+
+// A file ending within a record is truncated
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
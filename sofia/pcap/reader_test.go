@@ -0,0 +1,281 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// pcap file of records, timestamps in microseconds or nanoseconds
+func pcapFile(order binary.ByteOrder, magic uint32, linkType uint32, packets []Packet) []byte {
+	buf := make([]byte, 24)
+	order.PutUint32(buf, magic)
+	order.PutUint16(buf[4:], 2)
+	order.PutUint16(buf[6:], 4)
+	order.PutUint32(buf[16:], 0xFFFF)
+	order.PutUint32(buf[20:], linkType)
+
+	for _, packet := range packets {
+		frac := packet.Time.Nanosecond()
+		if magic == pcapMagicMicro {
+			frac /= 1000
+		}
+
+		hdr := make([]byte, pcapRecordHdrLen)
+		order.PutUint32(hdr, uint32(packet.Time.Unix()))
+		order.PutUint32(hdr[4:], uint32(frac))
+		order.PutUint32(hdr[8:], uint32(len(packet.Data)))
+		order.PutUint32(hdr[12:], uint32(packet.Length))
+
+		buf = append(append(buf, hdr...), packet.Data...)
+	}
+
+	return buf
+}
+
+// pcapng block, body padded to 32 bits
+func pcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+
+	buf := make([]byte, 8, 12+len(body))
+	order.PutUint32(buf, blockType)
+	order.PutUint32(buf[4:], uint32(12+len(body)))
+	buf = append(buf, body...)
+
+	buf = append(buf, 0, 0, 0, 0)
+	order.PutUint32(buf[len(buf)-4:], uint32(12+len(body)))
+
+	return buf
+}
+
+// Section header block
+func pcapngSection(order binary.ByteOrder) []byte {
+	body := make([]byte, 16)
+	order.PutUint32(body, pcapngByteOrder)
+	order.PutUint16(body[4:], 1)
+	order.PutUint64(body[8:], 0xFFFFFFFFFFFFFFFF)
+
+	return pcapngBlock(order, pcapngSHB, body)
+}
+
+// Interface description block with options (code, value)
+func pcapngInterfaceBlock(order binary.ByteOrder, linkType uint16, options ...[]byte) []byte {
+	body := make([]byte, 8)
+	order.PutUint16(body, linkType)
+	order.PutUint32(body[4:], 0xFFFF)
+
+	for _, option := range options {
+		opt := make([]byte, 4)
+		order.PutUint16(opt, uint16(option[0]))
+		order.PutUint16(opt[2:], uint16(len(option)-1))
+		opt = append(opt, option[1:]...)
+		for len(opt)%4 != 0 {
+			opt = append(opt, 0)
+		}
+
+		body = append(body, opt...)
+	}
+
+	return pcapngBlock(order, pcapngIDB, append(body, 0, 0, 0, 0))
+}
+
+// Enhanced packet block, ts in units of the interface
+func pcapngPacketBlock(order binary.ByteOrder, ifaceId uint32, ts uint64, data []byte, length int) []byte {
+	body := make([]byte, pcapngEPBHdrLen)
+	order.PutUint32(body, ifaceId)
+	order.PutUint32(body[4:], uint32(ts>>32))
+	order.PutUint32(body[8:], uint32(ts))
+	order.PutUint32(body[12:], uint32(len(data)))
+	order.PutUint32(body[16:], uint32(length))
+
+	return pcapngBlock(order, pcapngEPB, append(body, data...))
+}
+
+// Simple packet block
+func pcapngSimpleBlock(order binary.ByteOrder, data []byte, length int) []byte {
+	body := make([]byte, 4)
+	order.PutUint32(body, uint32(length))
+
+	return pcapngBlock(order, pcapngSPB, append(body, data...))
+}
+
+// All packets of a capture
+func readAll(data []byte) ([]Packet, error) {
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []Packet
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			return packets, nil
+		}
+
+		if err != nil {
+			return packets, err
+		}
+
+		packets = append(packets, packet)
+	}
+}
+
+func TestReaderPcap(t *testing.T) {
+	t0 := time.Unix(1700000000, 123456000)
+
+	packets := []Packet{
+		{Time: t0, LinkType: LinkEthernet, Data: []byte{1, 2, 3, 4}, Length: 4},
+		{Time: t0.Add(1500 * time.Millisecond), LinkType: LinkEthernet, Data: []byte{5, 6}, Length: 60}, // Cut at the snap length
+	}
+
+	nanoPackets := []Packet{
+		{Time: time.Unix(1700000000, 123456789), LinkType: LinkRaw, Data: []byte{0x45}, Length: 1},
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []Packet
+		wantErr error
+	}{
+		{name: "little endian", data: pcapFile(binary.LittleEndian, pcapMagicMicro, LinkEthernet, packets), want: packets},
+		{name: "big endian", data: pcapFile(binary.BigEndian, pcapMagicMicro, LinkEthernet, packets), want: packets},
+		{name: "nanoseconds", data: pcapFile(binary.LittleEndian, pcapMagicNano, LinkRaw, nanoPackets), want: nanoPackets},
+		{name: "empty", data: pcapFile(binary.LittleEndian, pcapMagicMicro, LinkEthernet, nil)},
+		{
+			name:    "truncated record",
+			data:    pcapFile(binary.LittleEndian, pcapMagicMicro, LinkEthernet, packets)[:24+pcapRecordHdrLen+2],
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "oversized record",
+			data:    append(pcapFile(binary.LittleEndian, pcapMagicMicro, LinkEthernet, nil), 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0),
+			wantErr: ErrBadBlock,
+		},
+		{name: "unknown format", data: []byte("GIF89a and some more bytes of an image"), wantErr: ErrUnknownFormat},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readAll(test.data)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			comparePackets(t, got, test.want)
+		})
+	}
+}
+
+func TestReaderPcapng(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	t0 := time.Unix(1700000000, 0)
+
+	// Default microseconds, nanoseconds with an offset
+	capture := bytes.Join([][]byte{
+		pcapngSection(le),
+		pcapngInterfaceBlock(le, LinkEthernet),
+		pcapngInterfaceBlock(le, LinkRaw, []byte{pcapngTsResol, 9}, []byte{pcapngTsOffset, 100, 0, 0, 0, 0, 0, 0, 0}),
+		pcapngPacketBlock(le, 0, uint64(t0.UnixMicro())+250, []byte{1, 2, 3}, 3),
+		pcapngPacketBlock(le, 1, uint64(t0.UnixNano())+7, []byte{0x45, 0}, 1500),
+		pcapngSimpleBlock(le, []byte{9, 9, 9, 9, 9, 9, 9, 9}, 5), // Padding isn't packet data
+		pcapngBlock(le, 0x00000005, make([]byte, 8)),             // Interface statistics, skipped
+		// New section, other byte order and interfaces
+		pcapngSection(be),
+		pcapngInterfaceBlock(be, LinkSLL, []byte{pcapngTsResol, 0x80 | 10}),
+		pcapngPacketBlock(be, 0, uint64(t0.Unix())<<10|512, []byte{7}, 1),
+	}, nil)
+
+	want := []Packet{
+		{Time: t0.Add(250 * time.Microsecond), LinkType: LinkEthernet, Data: []byte{1, 2, 3}, Length: 3},
+		{Time: t0.Add(100*time.Second + 7), LinkType: LinkRaw, Data: []byte{0x45, 0}, Length: 1500},
+		{LinkType: LinkEthernet, Data: []byte{9, 9, 9, 9, 9}, Length: 5},
+		{Time: t0.Add(500 * time.Millisecond), LinkType: LinkSLL, Data: []byte{7}, Length: 1},
+	}
+
+	got, err := readAll(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comparePackets(t, got, want)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "undeclared interface", data: append(pcapngSection(le), pcapngPacketBlock(le, 0, 0, []byte{1}, 1)...)},
+		{name: "bad block length", data: append(pcapngSection(le), 1, 0, 0, 0, 5, 0, 0, 0)},
+		{name: "captured length past block", data: append(append(pcapngSection(le), pcapngInterfaceBlock(le, LinkRaw)...), badPacketBlock(le)...)},
+		{name: "truncated block", data: append(pcapngSection(le), pcapngInterfaceBlock(le, LinkRaw)[:10]...)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := readAll(test.data); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+// Enhanced packet block claiming more captured bytes than it holds
+func badPacketBlock(order binary.ByteOrder) []byte {
+	block := pcapngPacketBlock(order, 0, 0, []byte{1, 2, 3, 4}, 4)
+	order.PutUint32(block[8+12:], 100)
+
+	return block
+}
+
+func TestWriterReader(t *testing.T) {
+	t0 := time.Unix(1700000000, 42000)
+
+	want := []Packet{
+		{Time: t0, LinkType: LinkRaw, Data: []byte{0x45, 1, 2}, Length: 3},
+		{Time: t0.Add(time.Second), LinkType: LinkRaw, Data: []byte{0x45}, Length: 1},
+	}
+
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, LinkRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, packet := range want {
+		if err := writer.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := readAll(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comparePackets(t, got, want)
+}
+
+func comparePackets(t *testing.T, got []Packet, want []Packet) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("%d packets, want %d", len(got), len(want))
+	}
+
+	for idx := range want {
+		if !got[idx].Time.Equal(want[idx].Time) || got[idx].LinkType != want[idx].LinkType ||
+			!bytes.Equal(got[idx].Data, want[idx].Data) || got[idx].Length != want[idx].Length {
+			t.Errorf("packet %d: %+v, want %+v", idx, got[idx], want[idx])
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package pcap
+
+import (
+	"time"
+
+	"sofia-go/sofia"
+)
+
+// Out of order bytes buffered per stream before a gap is skipped
+const MaxPendingLen = 0x200000
+
+// Compare TCP sequence numbers across wraparound
+func seqDiff(a uint32, b uint32) int32 {
+	return int32(a - b)
+}
+
+// One direction of a TCP connection
+type tcpStream struct {
+	started    bool              // Sequence numbers known
+	next       uint32            // Next expected sequence number
+	pending    map[uint32][]byte // Out of order segments by sequence number
+	pendingLen int               // Bytes in pending
+	buf        []byte            // Reassembled bytes not decoded yet
+	last       time.Time         // Capture time of the last segment
+	media      mediaScanner      // Media frames of MONITOR_DATA payloads
+}
+
+func newTCPStream() *tcpStream {
+	return &tcpStream{
+		pending: make(map[uint32][]byte),
+	}
+}
+
+// Add a segment, out of order ones wait for the missing bytes
+func (stream *tcpStream) add(seg segment) {
+	if seg.flags&tcpSYN != 0 {
+		stream.started = true
+		stream.next = seg.seq + 1
+		return
+	}
+
+	if !stream.started {
+		// Connection established before the capture
+		stream.started = true
+		stream.next = seg.seq
+	}
+
+	if len(seg.payload) == 0 {
+		return
+	}
+
+	if seqDiff(seg.seq, stream.next) > 0 {
+		if old, ok := stream.pending[seg.seq]; !ok || len(old) < len(seg.payload) {
+			stream.pending[seg.seq] = seg.payload
+			stream.pendingLen += len(seg.payload) - len(old)
+		}
+
+		return
+	}
+
+	stream.append(seg.seq, seg.payload)
+	stream.drain()
+}
+
+// Append data at seq, without the part already seen
+func (stream *tcpStream) append(seq uint32, data []byte) {
+	if overlap := -int(seqDiff(seq, stream.next)); overlap > 0 {
+		if overlap >= len(data) {
+			return
+		}
+
+		data = data[overlap:]
+	}
+
+	stream.buf = append(stream.buf, data...)
+	stream.next += uint32(len(data))
+}
+
+// Append pending segments that became contiguous
+func (stream *tcpStream) drain() {
+	for len(stream.pending) > 0 {
+		found := false
+		for seq, data := range stream.pending {
+			if seqDiff(seq, stream.next) > 0 {
+				continue
+			}
+
+			delete(stream.pending, seq)
+			stream.pendingLen -= len(data)
+			stream.append(seq, data)
+			found = true
+		}
+
+		if !found {
+			return
+		}
+	}
+}
+
+// Continue at the first pending segment, giving up on the missing bytes.
+// Undecoded bytes before the gap are dropped.
+func (stream *tcpStream) skipGap() {
+	first, found := uint32(0), false
+	for seq := range stream.pending {
+		if !found || seqDiff(seq, first) < 0 {
+			first, found = seq, true
+		}
+	}
+
+	if !found {
+		return
+	}
+
+	stream.buf = stream.buf[:0]
+	stream.media = mediaScanner{}
+	stream.next = first
+	stream.drain()
+}
+
+// Tracks media frame boundaries in the concatenated MONITOR_DATA payloads
+// of a stream
+type mediaScanner struct {
+	remaining uint32 // Payload bytes of the current media frame left
+	hdr       []byte // Partial header
+}
+
+// Media frames starting in data, and bytes skipped to find one
+func (scanner *mediaScanner) scan(data []byte) ([]Media, int) {
+	var media []Media
+	var skipped int
+
+	for {
+		// Payload of the current frame
+		if scanner.remaining > 0 {
+			if len(data) == 0 {
+				break
+			}
+
+			n := uint32(len(data))
+			if n > scanner.remaining {
+				n = scanner.remaining
+			}
+
+			scanner.remaining -= n
+			data = data[n:]
+			continue
+		}
+
+		// Header, possibly split across messages
+		need := 4
+		if len(scanner.hdr) >= 4 {
+			if need = sofia.MediaHeaderLen(scanner.hdr); need == 0 {
+				// Not in sync, e.g. the capture started within a frame
+				scanner.hdr = scanner.hdr[1:]
+				skipped++
+				continue
+			}
+		}
+
+		if len(scanner.hdr) < need {
+			if len(data) == 0 {
+				break
+			}
+
+			n := need - len(scanner.hdr)
+			if n > len(data) {
+				n = len(data)
+			}
+
+			scanner.hdr = append(scanner.hdr, data[:n]...)
+			data = data[n:]
+			continue
+		}
+
+		frame, length, _ := sofia.DecodeMediaHeader(scanner.hdr)
+		media = append(media, Media{Frame: frame, Length: int(length)})
+
+		scanner.remaining = length
+		scanner.hdr = scanner.hdr[:0]
+	}
+
+	return media, skipped
+}
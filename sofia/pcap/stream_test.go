@@ -0,0 +1,309 @@
+package pcap
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+func TestSeqDiff(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want int32
+	}{
+		{a: 100, b: 100, want: 0},
+		{a: 110, b: 100, want: 10},
+		{a: 100, b: 110, want: -10},
+		{a: 5, b: 0xFFFFFFFB, want: 10},  // a wrapped around
+		{a: 0xFFFFFFFB, b: 5, want: -10}, // b wrapped around
+		{a: 0x7FFFFFFF, b: 0, want: 0x7FFFFFFF},
+	}
+
+	for _, test := range tests {
+		if got := seqDiff(test.a, test.b); got != test.want {
+			t.Errorf("seqDiff(%#x, %#x) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestTCPStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		segs        []segment
+		want        string
+		wantPending int
+	}{
+		{
+			name: "in order",
+			segs: []segment{{seq: 99, flags: tcpSYN}, {seq: 100, payload: []byte("ab")}, {seq: 102, payload: []byte("cd")}},
+			want: "abcd",
+		},
+		{
+			name: "started before the capture",
+			segs: []segment{{seq: 5000, payload: []byte("ab")}, {seq: 5002, payload: []byte("cd")}},
+			want: "abcd",
+		},
+		{
+			name: "out of order",
+			segs: []segment{{seq: 100, payload: []byte("ab")}, {seq: 104, payload: []byte("ef")}, {seq: 102, payload: []byte("cd")}},
+			want: "abcdef",
+		},
+		{
+			name:        "missing bytes",
+			segs:        []segment{{seq: 100, payload: []byte("ab")}, {seq: 104, payload: []byte("ef")}, {seq: 107, payload: []byte("h")}},
+			want:        "ab",
+			wantPending: 3,
+		},
+		{
+			name: "retransmit",
+			segs: []segment{{seq: 100, payload: []byte("abcd")}, {seq: 100, payload: []byte("ab")}, {seq: 90, payload: []byte("0123456789")}},
+			want: "abcd",
+		},
+		{
+			name: "overlap",
+			segs: []segment{{seq: 100, payload: []byte("abcd")}, {seq: 102, payload: []byte("cdef")}},
+			want: "abcdef",
+		},
+		{
+			name: "pending overlap",
+			segs: []segment{{seq: 100, payload: []byte("ab")}, {seq: 104, payload: []byte("efgh")}, {seq: 103, payload: []byte("def")}, {seq: 102, payload: []byte("c")}},
+			want: "abcdefgh",
+		},
+		{
+			name: "longer retransmit while pending",
+			segs: []segment{{seq: 100, payload: []byte("a")}, {seq: 103, payload: []byte("d")}, {seq: 103, payload: []byte("defg")}, {seq: 101, payload: []byte("bc")}},
+			want: "abcdefg",
+		},
+		{
+			name: "wraparound",
+			segs: []segment{{seq: 0xFFFFFFFD, flags: tcpSYN}, {seq: 0xFFFFFFFE, payload: []byte("ab")}, {seq: 2, payload: []byte("ef")}, {seq: 0, payload: []byte("cd")}},
+			want: "abcdef",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := newTCPStream()
+			for _, seg := range test.segs {
+				stream.add(seg)
+			}
+
+			if string(stream.buf) != test.want {
+				t.Errorf("stream %q, want %q", stream.buf, test.want)
+			}
+
+			if stream.pendingLen != test.wantPending {
+				t.Errorf("%d bytes pending, want %d", stream.pendingLen, test.wantPending)
+			}
+		})
+	}
+}
+
+func TestTCPStreamSkipGap(t *testing.T) {
+	stream := newTCPStream()
+	stream.add(segment{seq: 100, payload: []byte("abc")})
+	stream.add(segment{seq: 110, payload: []byte("kl")})
+	stream.add(segment{seq: 108, payload: []byte("ij")})
+	stream.add(segment{seq: 120, payload: []byte("uv")})
+
+	// Undecoded bytes before the gap are dropped, the bytes up to the next
+	// gap are appended
+	stream.skipGap()
+	if string(stream.buf) != "ijkl" || stream.next != 112 || stream.pendingLen != 2 {
+		t.Fatalf("stream %q, next %d, %d bytes pending", stream.buf, stream.next, stream.pendingLen)
+	}
+
+	stream.skipGap()
+	if string(stream.buf) != "uv" || stream.next != 122 || stream.pendingLen != 0 {
+		t.Fatalf("stream %q, next %d, %d bytes pending", stream.buf, stream.next, stream.pendingLen)
+	}
+}
+
+// Device to client TCP packets of a connection
+type tcpCapture struct {
+	device netip.AddrPort
+	client netip.AddrPort
+	seq    uint32
+	t      time.Time
+}
+
+// Packet carrying data at the current sequence number, skip bytes are never
+// captured
+func (capture *tcpCapture) packet(skip uint32, data []byte) Packet {
+	capture.seq += skip
+	capture.t = capture.t.Add(time.Millisecond)
+
+	raw := encodeTCP(capture.device, capture.client, capture.seq, 1, tcpACK|tcpPSH, data)
+	capture.seq += uint32(len(data))
+
+	return Packet{Time: capture.t, LinkType: LinkRaw, Data: raw, Length: len(raw)}
+}
+
+func TestDissectorGap(t *testing.T) {
+	chunk := make([]byte, 60000)
+	monitorData := sofiatest.Frame{MsgID: sofia.MONITOR_DATA, Data: chunk}.Bytes()
+	keepAlive := sofiatest.Frame{MsgID: sofia.KEEPALIVE_RSP, Data: []byte(`{"Ret":100}`)}.Bytes()
+
+	// Enough out of order bytes to exceed MaxPendingLen
+	overflow := MaxPendingLen/len(monitorData) + 1
+
+	tests := []struct {
+		name       string
+		after      int  // MONITOR_DATA messages after the gap
+		flush      bool // Flush at the end
+		wantFrames int
+		wantGaps   int
+	}{
+		{name: "pending limit", after: overflow, wantFrames: 1 + overflow, wantGaps: 1},
+		{name: "below pending limit", after: 3, wantFrames: 1},
+		{name: "flush", after: 3, flush: true, wantFrames: 1 + 3, wantGaps: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dissector := NewDissector()
+			capture := &tcpCapture{
+				device: netip.MustParseAddrPort("10.0.0.1:34567"),
+				client: netip.MustParseAddrPort("10.0.0.2:50000"),
+				seq:    1000,
+				t:      time.Unix(1700000000, 0),
+			}
+
+			var frames []Frame
+			frames = append(frames, dissector.Packet(capture.packet(0, keepAlive))...)
+
+			// Part of a message never captured
+			frames = append(frames, dissector.Packet(capture.packet(10, monitorData[10:]))...)
+
+			for idx := 0; idx < test.after; idx++ {
+				frames = append(frames, dissector.Packet(capture.packet(0, monitorData))...)
+			}
+
+			if test.flush {
+				frames = append(frames, dissector.Flush()...)
+			}
+
+			if len(frames) != test.wantFrames {
+				t.Fatalf("%d frames, want %d", len(frames), test.wantFrames)
+			}
+
+			stats := dissector.Stats()
+			if stats.Gaps != test.wantGaps || stats.Frames != test.wantFrames {
+				t.Errorf("stats %+v", stats)
+			}
+
+			if frames[0].Message.ID() != sofia.KEEPALIVE_RSP || frames[0].Direction != DirFromDevice {
+				t.Errorf("first frame %v", frames[0])
+			}
+
+			for _, frame := range frames[1:] {
+				if frame.Message.ID() != sofia.MONITOR_DATA || !bytes.Equal(frame.Message.Data(), chunk) {
+					t.Fatalf("frame %v", frame)
+				}
+			}
+
+			// Decoding continues in order once the gap was skipped
+			frames = dissector.Packet(capture.packet(0, keepAlive))
+			if test.wantGaps > 0 && (len(frames) != 1 || frames[0].Message.ID() != sofia.KEEPALIVE_RSP) {
+				t.Errorf("frames after the gap %v", frames)
+			}
+		})
+	}
+}
+
+func TestMediaScanner(t *testing.T) {
+	iframe := sofia.MediaFrame{
+		Type:   sofia.MediaIFrame,
+		Media:  sofia.MediaH264,
+		FPS:    25,
+		Width:  640,
+		Height: 480,
+		Time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local),
+		Data:   bytes.Repeat([]byte{0x11}, 100),
+	}
+
+	pframe := sofia.MediaFrame{Type: sofia.MediaPFrame, Data: bytes.Repeat([]byte{0x22}, 50)}
+	audio := sofia.MediaFrame{Type: sofia.MediaAudio, Media: 14, FPS: 2, Data: bytes.Repeat([]byte{0x33}, 20)}
+
+	stream := bytes.Join([][]byte{iframe.Bytes(), pframe.Bytes(), audio.Bytes()}, nil)
+	iLen, pLen := 16+100, 8+50
+
+	hdr := func(frame sofia.MediaFrame) Media {
+		length := len(frame.Data)
+		frame.Data = nil
+
+		return Media{Frame: frame, Length: length}
+	}
+
+	tests := []struct {
+		name        string
+		chunks      [][]byte  // MONITOR_DATA payloads
+		want        [][]Media // Media frames starting per payload
+		wantSkipped int
+	}{
+		{
+			name:   "one payload",
+			chunks: [][]byte{stream},
+			want:   [][]Media{{hdr(iframe), hdr(pframe), hdr(audio)}},
+		},
+		{
+			name:   "payload per frame",
+			chunks: [][]byte{stream[:iLen], stream[iLen : iLen+pLen], stream[iLen+pLen:]},
+			want:   [][]Media{{hdr(iframe)}, {hdr(pframe)}, {hdr(audio)}},
+		},
+		{
+			name:   "split marker",
+			chunks: [][]byte{stream[:2], stream[2:]},
+			want:   [][]Media{nil, {hdr(iframe), hdr(pframe), hdr(audio)}},
+		},
+		{
+			name:   "split header",
+			chunks: [][]byte{stream[:10], stream[10 : iLen+4], stream[iLen+4:]},
+			want:   [][]Media{nil, {hdr(iframe)}, {hdr(pframe), hdr(audio)}},
+		},
+		{
+			name:   "split payload",
+			chunks: [][]byte{stream[:iLen+20], stream[iLen+20 : iLen+pLen-1], stream[iLen+pLen-1:]},
+			want:   [][]Media{{hdr(iframe), hdr(pframe)}, nil, {hdr(audio)}},
+		},
+		{
+			name:        "started within a frame",
+			chunks:      [][]byte{{0x11, 0x22, 0x33}, append([]byte{0x44, 0x55}, stream[:iLen]...)},
+			want:        [][]Media{nil, {hdr(iframe)}},
+			wantSkipped: 5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var scanner mediaScanner
+			var skipped int
+
+			for idx, chunk := range test.chunks {
+				media, n := scanner.scan(chunk)
+				skipped += n
+
+				if len(media) != len(test.want[idx]) {
+					t.Fatalf("payload %d: %v, want %v", idx, media, test.want[idx])
+				}
+
+				for pos, got := range media {
+					want := test.want[idx][pos]
+					if got.Frame.Type != want.Frame.Type || got.Frame.Media != want.Frame.Media || got.Frame.FPS != want.Frame.FPS ||
+						got.Frame.Width != want.Frame.Width || got.Frame.Height != want.Frame.Height ||
+						!got.Frame.Time.Equal(want.Frame.Time) || got.Length != want.Length {
+						t.Errorf("payload %d: %v, want %v", idx, got, want)
+					}
+				}
+			}
+
+			if skipped != test.wantSkipped {
+				t.Errorf("%d bytes skipped, want %d", skipped, test.wantSkipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// TCP flags of recorded segments
+const (
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// Payload bytes per recorded segment at most, fits the IP length field
+const recordSegmentLen = 0xFFFF - 60 - 20
+
+// Initial sequence numbers of recorded connections
+const (
+	recordClientISN = 0x10000000
+	recordDeviceISN = 0x20000000
+)
+
+// Writes packets to a pcap file
+type Writer struct {
+	w        io.Writer // Capture file
+	linkType uint32    // Link type of all packets
+}
+
+// Create a writer, writes the file header
+func NewWriter(w io.Writer, linkType uint32) (*Writer, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr, pcapMagicMicro)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 0xFFFF)
+	binary.LittleEndian.PutUint32(hdr[20:], linkType)
+
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w, linkType: linkType}, nil
+}
+
+// Write a packet, its link type is ignored
+func (writer *Writer) WritePacket(packet Packet) error {
+	length := packet.Length
+	if length < len(packet.Data) {
+		length = len(packet.Data)
+	}
+
+	hdr := make([]byte, pcapRecordHdrLen)
+	binary.LittleEndian.PutUint32(hdr, uint32(packet.Time.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(packet.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(packet.Data)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(length))
+
+	if _, err := writer.w.Write(hdr); err != nil {
+		return err
+	}
+
+	_, err := writer.w.Write(packet.Data)
+
+	return err
+}
+
+// Recorded connection
+type recordedConn struct {
+	client    netip.AddrPort // Client end
+	device    netip.AddrPort // Device end
+	clientSeq uint32         // Next client sequence number
+	deviceSeq uint32         // Next device sequence number
+}
+
+// Records TCP streams relayed by a proxy as a capture of raw IP packets,
+// with handshakes and closes, for the pcap command or tcpreplay
+type Recorder struct {
+	writer *Writer                   // Capture file
+	mutex  sync.Mutex                // Protects the following
+	conns  map[flowKey]*recordedConn // Connections by client and device
+}
+
+// Create a recorder, writes the file header
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	writer, err := NewWriter(w, LinkRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		writer: writer,
+		conns:  make(map[flowKey]*recordedConn),
+	}, nil
+}
+
+// Record a connection established by client to device
+func (recorder *Recorder) Open(t time.Time, client netip.AddrPort, device netip.AddrPort) error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	_, err := recorder.open(t, client, device)
+
+	return err
+}
+
+func (recorder *Recorder) open(t time.Time, client netip.AddrPort, device netip.AddrPort) (*recordedConn, error) {
+	conn := &recordedConn{
+		client:    client,
+		device:    device,
+		clientSeq: recordClientISN,
+		deviceSeq: recordDeviceISN,
+	}
+
+	recorder.conns[flowKey{src: client, dst: device}] = conn
+
+	// Handshake
+	for _, err := range []error{
+		recorder.segment(t, client, device, conn.clientSeq, 0, tcpSYN, nil),
+		recorder.segment(t, device, client, conn.deviceSeq, conn.clientSeq+1, tcpSYN|tcpACK, nil),
+		recorder.segment(t, client, device, conn.clientSeq+1, conn.deviceSeq+1, tcpACK, nil),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn.clientSeq++
+	conn.deviceSeq++
+
+	return conn, nil
+}
+
+// Record data relayed from src to dst
+func (recorder *Recorder) Data(t time.Time, src netip.AddrPort, dst netip.AddrPort, data []byte) error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	conn, err := recorder.conn(t, src, dst)
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > recordSegmentLen {
+			chunk = chunk[:recordSegmentLen]
+		}
+
+		if src == conn.client {
+			err = recorder.segment(t, src, dst, conn.clientSeq, conn.deviceSeq, tcpPSH|tcpACK, chunk)
+			conn.clientSeq += uint32(len(chunk))
+		} else {
+			err = recorder.segment(t, src, dst, conn.deviceSeq, conn.clientSeq, tcpPSH|tcpACK, chunk)
+			conn.deviceSeq += uint32(len(chunk))
+		}
+
+		if err != nil {
+			return err
+		}
+
+		data = data[len(chunk):]
+	}
+
+	return nil
+}
+
+// Record the close of a connection
+func (recorder *Recorder) Close(t time.Time, client netip.AddrPort, device netip.AddrPort) error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	key := flowKey{src: client, dst: device}
+
+	conn := recorder.conns[key]
+	if conn == nil {
+		return nil
+	}
+
+	delete(recorder.conns, key)
+
+	for _, err := range []error{
+		recorder.segment(t, client, device, conn.clientSeq, conn.deviceSeq, tcpFIN|tcpACK, nil),
+		recorder.segment(t, device, client, conn.deviceSeq, conn.clientSeq+1, tcpFIN|tcpACK, nil),
+		recorder.segment(t, client, device, conn.clientSeq+1, conn.deviceSeq+1, tcpACK, nil),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Connection of src and dst in either direction, opened if not recorded yet
+func (recorder *Recorder) conn(t time.Time, src netip.AddrPort, dst netip.AddrPort) (*recordedConn, error) {
+	if conn := recorder.conns[flowKey{src: src, dst: dst}]; conn != nil {
+		return conn, nil
+	}
+
+	if conn := recorder.conns[flowKey{src: dst, dst: src}]; conn != nil {
+		return conn, nil
+	}
+
+	return recorder.open(t, src, dst)
+}
+
+// Write a TCP segment
+func (recorder *Recorder) segment(t time.Time, src netip.AddrPort, dst netip.AddrPort, seq uint32, ack uint32, flags byte, payload []byte) error {
+	data := encodeTCP(src, dst, seq, ack, flags, payload)
+
+	return recorder.writer.WritePacket(Packet{Time: t, Data: data, Length: len(data)})
+}
@@ -0,0 +1,170 @@
+package provision
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provisioning steps, in order
+const (
+	StateNew        = ""           // Not started
+	StateAddressed  = "addressed"  // IP assigned
+	StatePassword   = "password"   // Admin password changed
+	StateConfigured = "configured" // Template applied
+	StateDone       = "done"       // Clock synced, provisioning complete
+)
+
+// Order of states
+var stateOrder = map[string]int{
+	StateNew:        0,
+	StateAddressed:  1,
+	StatePassword:   2,
+	StateConfigured: 3,
+	StateDone:       4,
+}
+
+// Device record
+type InventoryEntry struct {
+	Key      string    // Serial number or MAC
+	SerialNo string    // Serial number
+	MAC      string    // MAC address
+	HostName string    // Host name
+	Version  string    // Firmware version
+	IP       string    // Assigned address
+	State    string    // Last completed step
+	Updated  time.Time // Last update
+}
+
+// Device reached state
+func (entry *InventoryEntry) Reached(state string) bool {
+	return stateOrder[entry.State] >= stateOrder[state]
+}
+
+// Inventory of provisioned devices, persisted as JSON
+type Inventory struct {
+	path    string                     // File path
+	mutex   sync.Mutex                 // Protects entries
+	entries map[string]*InventoryEntry // Entries by key
+}
+
+// Load inventory, a missing file is an empty inventory
+func LoadInventory(path string) (*Inventory, error) {
+	inventory := &Inventory{
+		path:    path,
+		entries: make(map[string]*InventoryEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return inventory, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*InventoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		inventory.entries[entry.Key] = entry
+	}
+
+	return inventory, nil
+}
+
+// Get entry by key
+func (inventory *Inventory) Get(key string) (InventoryEntry, bool) {
+	inventory.mutex.Lock()
+	defer inventory.mutex.Unlock()
+
+	if entry, ok := inventory.entries[key]; ok {
+		return *entry, true
+	}
+
+	return InventoryEntry{}, false
+}
+
+// Is IP assigned to any device other than key
+func (inventory *Inventory) IPInUse(ip string, key string) bool {
+	inventory.mutex.Lock()
+	defer inventory.mutex.Unlock()
+
+	for _, entry := range inventory.entries {
+		if entry.IP == ip && entry.Key != key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// All entries, ordered by key
+func (inventory *Inventory) Entries() []InventoryEntry {
+	inventory.mutex.Lock()
+	defer inventory.mutex.Unlock()
+
+	entries := make([]InventoryEntry, 0, len(inventory.entries))
+	for _, entry := range inventory.entries {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+// Add or update an entry and save the inventory
+func (inventory *Inventory) Put(entry InventoryEntry) error {
+	inventory.mutex.Lock()
+	defer inventory.mutex.Unlock()
+
+	entry.Updated = time.Now()
+	inventory.entries[entry.Key] = &entry
+
+	return inventory.save()
+}
+
+// Save inventory, written to a temporary file first so it is never truncated
+func (inventory *Inventory) save() error {
+	entries := make([]*InventoryEntry, 0, len(inventory.entries))
+	for _, entry := range inventory.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(inventory.path), filepath.Base(inventory.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), inventory.path)
+}
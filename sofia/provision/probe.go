@@ -0,0 +1,60 @@
+package provision
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Time allowed for a host to answer an address probe
+const ProbeTimeout = 500 * time.Millisecond
+
+// Kernel ARP table (Linux)
+const arpTable = "/proc/net/arp"
+
+// Reports whether a host answers at ip: a TCP connect to port that is
+// accepted or refused, or a resolved ARP entry once the connect was tried
+// (Linux only). A silent host that drops everything isn't detected.
+func AddressInUse(ip net.IP, port string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), ProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	return arpResolved(ip)
+}
+
+// Does the ARP table hold a resolved entry for ip
+func arpResolved(ip net.IP) bool {
+	file, err := os.Open(arpTable)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	// IP address, HW type, Flags, HW address, Mask, Device
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !ip.Equal(net.ParseIP(fields[0])) {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[2], 0, 32)
+		if err == nil && flags&0x02 != 0 && fields[3] != "00:00:00:00:00:00" {
+			return true
+		}
+	}
+
+	return false
+}
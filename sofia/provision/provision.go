@@ -0,0 +1,507 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sofia-go/sofia"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Errors
+var (
+	ErrPoolExhausted = errors.New("provision: address pool exhausted")
+	ErrNotDefault    = errors.New("provision: device doesn't accept default or new credentials")
+)
+
+// Host names of factory reset devices, e.g. IPC_6a6b
+var DefaultHostName = regexp.MustCompile(`^(IPC|NVR|DVR|HVR)_[0-9A-Fa-f]+$`)
+
+// Address of factory reset devices
+var DefaultIP = net.IPv4(192, 168, 1, 10)
+
+// Provisioning configuration
+type Config struct {
+	PoolStart   net.IP               // First address of the pool
+	PoolEnd     net.IP               // Last address of the pool
+	Mask        net.IPMask           // Subnet mask to assign
+	Gateway     net.IP               // Gateway to assign
+	Port        string               // DVRIP port, default 34567
+	Default     sofia.Credentials    // Factory credentials
+	Password    string               // New admin password, empty to keep
+	Template    *sofia.ConfigBackup  // Configuration template, nil for none
+	SyncClock   bool                 // Set device clock to host clock
+	Inventory   string               // Inventory file
+	HostName    *regexp.Regexp       // Host names of unprovisioned devices, default DefaultHostName
+	DefaultIPs  []net.IP             // Addresses of unprovisioned devices, default DefaultIP
+	Timeout     time.Duration        // Time allowed per device, default 2 minutes
+	Concurrency int                  // Devices provisioned in parallel, default 4
+	Registry    *sofia.Registry      // Live devices whose addresses are not handed out, nil for none
+	InUse       func(ip net.IP) bool // Reports addresses in use on the network, default AddressInUse on Port
+}
+
+// Provisioning engine
+type Engine struct {
+	config    Config            // Configuration
+	discovery *sofia.Discovery  // Discovery used for IP_SET
+	inventory *Inventory        // Inventory
+	logger    *logrus.Logger    // Logger
+	mutex     sync.Mutex        // Protects seen and busy
+	seen      map[string]net.IP // Addresses of all discovered devices, by key
+	busy      map[string]bool   // Devices being provisioned
+}
+
+// Template sections never applied, they carry the identity and addressing
+// of the device the template was exported from (HostIP, MAC, HostName).
+// Addresses are only assigned through IP_SET.
+var TemplateExcluded = []string{
+	"NetWork.NetCommon",
+	"NetWork.NetDHCP",
+	"NetWork.NetIPv6",
+	"NetWork.Wifi",
+	"NetWork.NetPPPoE",
+}
+
+// Load a configuration template saved by Session.ExportConfigSections
+func LoadTemplate(path string) (*sofia.ConfigBackup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var template sofia.ConfigBackup
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, err
+	}
+
+	if template.Format != sofia.ConfigBackupFormat {
+		return nil, fmt.Errorf("provision: %s is not a %s template", path, sofia.ConfigBackupFormat)
+	}
+
+	return &template, nil
+}
+
+// Copy of a template without the TemplateExcluded sections, returns the
+// names of the removed sections
+func StripTemplate(template *sofia.ConfigBackup) (*sofia.ConfigBackup, []string) {
+	stripped := &sofia.ConfigBackup{
+		Format:   template.Format,
+		Sections: make(map[string]json.RawMessage, len(template.Sections)),
+	}
+
+	var removed []string
+
+next:
+	for name, value := range template.Sections {
+		for _, excluded := range TemplateExcluded {
+			if strings.EqualFold(name, excluded) {
+				removed = append(removed, name)
+				continue next
+			}
+		}
+
+		stripped.Sections[name] = value
+	}
+
+	sort.Strings(removed)
+
+	return stripped, removed
+}
+
+// Create a new provisioning engine, discovery must be started
+func NewEngine(config Config, discovery *sofia.Discovery, logger *logrus.Logger) (*Engine, error) {
+	if config.PoolStart.To4() == nil || config.PoolEnd.To4() == nil || len(config.Mask) == 0 || config.Gateway.To4() == nil {
+		return nil, errors.New("provision: pool, mask and gateway required")
+	}
+
+	// Defaults
+	{
+		if len(config.Port) == 0 {
+			config.Port = "34567"
+		}
+
+		if len(config.Default.User) == 0 {
+			config.Default.User = "admin"
+		}
+
+		if config.HostName == nil {
+			config.HostName = DefaultHostName
+		}
+
+		if config.DefaultIPs == nil {
+			config.DefaultIPs = []net.IP{DefaultIP}
+		}
+
+		if config.Timeout == 0 {
+			config.Timeout = 2 * time.Minute
+		}
+
+		if config.Concurrency <= 0 {
+			config.Concurrency = 4
+		}
+
+		if config.InUse == nil {
+			port := config.Port
+			config.InUse = func(ip net.IP) bool {
+				return AddressInUse(ip, port)
+			}
+		}
+	}
+
+	// Never copy the identity of the template device
+	if config.Template != nil {
+		var removed []string
+		if config.Template, removed = StripTemplate(config.Template); len(removed) > 0 {
+			logger.Infof("Template sections %v are not applied, addresses are assigned by IP_SET", removed)
+		}
+	}
+
+	inventory, err := LoadInventory(config.Inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Engine{
+		config:    config,
+		discovery: discovery,
+		inventory: inventory,
+		logger:    logger,
+		seen:      make(map[string]net.IP),
+		busy:      make(map[string]bool),
+	}, nil
+}
+
+// Inventory
+func (engine *Engine) Inventory() *Inventory {
+	return engine.inventory
+}
+
+// Is device waiting to be provisioned
+func (engine *Engine) Unprovisioned(device sofia.DiscoveredDevice) bool {
+	if entry, ok := engine.inventory.Get(sofia.RegistryKey(device)); ok {
+		return !entry.Reached(StateDone)
+	}
+
+	if engine.config.HostName.MatchString(device.HostName) {
+		return true
+	}
+
+	for _, ip := range engine.config.DefaultIPs {
+		if ip.Equal(device.HostIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Provision devices as they are discovered until devices is closed or ctx is done
+func (engine *Engine) Run(ctx context.Context, devices <-chan sofia.DiscoveredDevice) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	slots := make(chan struct{}, engine.config.Concurrency)
+
+	for {
+		var device sofia.DiscoveredDevice
+		var ok bool
+
+		select {
+		case device, ok = <-devices:
+			if !ok {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		key := sofia.RegistryKey(device)
+
+		// Track addresses in use
+		engine.mutex.Lock()
+		engine.seen[key] = device.HostIP
+		busy := engine.busy[key]
+		engine.mutex.Unlock()
+
+		if busy || !engine.Unprovisioned(device) {
+			continue
+		}
+
+		engine.mutex.Lock()
+		engine.busy[key] = true
+		engine.mutex.Unlock()
+
+		wg.Add(1)
+		go func(device sofia.DiscoveredDevice) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if err := engine.Provision(ctx, device); err != nil {
+				engine.logger.Errorf("Provisioning %s failed [%s]", key, err.Error())
+			}
+
+			engine.mutex.Lock()
+			delete(engine.busy, key)
+			engine.mutex.Unlock()
+		}(device)
+	}
+}
+
+// Provision a device, resumes from the last step recorded in the inventory
+func (engine *Engine) Provision(ctx context.Context, device sofia.DiscoveredDevice) error {
+	key := sofia.RegistryKey(device)
+
+	entry, _ := engine.inventory.Get(key)
+	if entry.Reached(StateDone) {
+		return nil
+	}
+
+	entry.Key = key
+	entry.SerialNo = device.SerialNo
+	entry.MAC = device.MAC.String()
+	entry.HostName = device.HostName
+	entry.Version = device.Version
+
+	ctx, cancel := context.WithTimeout(ctx, engine.config.Timeout)
+	defer cancel()
+
+	logger := engine.logger.WithFields(logrus.Fields{"module": "Provision", "device": key})
+
+	// Address
+	{
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			var err error
+			if ip, err = engine.allocate(&entry); err != nil {
+				return err
+			}
+		}
+
+		if !device.HostIP.Equal(ip) {
+			logger.Infof("Assigning [%s]", ip)
+
+			var err error
+			if device, err = engine.discovery.SetNetwork(ctx, key, ip, engine.config.Mask, engine.config.Gateway, engine.credentials(&entry)); err != nil {
+				return err
+			}
+		}
+
+		if err := engine.advance(&entry, StateAddressed); err != nil {
+			return err
+		}
+	}
+
+	// Login
+	conn, session, err := engine.login(&entry)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Password
+	if !entry.Reached(StatePassword) {
+		if len(engine.config.Password) > 0 {
+			logger.Infof("Changing password of %s", engine.config.Default.User)
+
+			if err := session.ChangePassword(engine.config.Default.User, engine.config.Default.Password, engine.config.Password); err != nil {
+				return fmt.Errorf("change password [%w]", err)
+			}
+		}
+
+		if err := engine.advance(&entry, StatePassword); err != nil {
+			return err
+		}
+	}
+
+	// Template
+	if !entry.Reached(StateConfigured) {
+		if engine.config.Template != nil {
+			logger.Infof("Applying template, %d sections", len(engine.config.Template.Sections))
+
+			if err := session.ImportConfigSections(engine.config.Template); err != nil {
+				return fmt.Errorf("apply template [%w]", err)
+			}
+		}
+
+		if err := engine.advance(&entry, StateConfigured); err != nil {
+			return err
+		}
+	}
+
+	// Clock
+	if engine.config.SyncClock {
+		logger.Infof("Syncing clock")
+
+		if err := session.SetTime(time.Now()); err != nil {
+			return fmt.Errorf("sync clock [%w]", err)
+		}
+	}
+
+	if err := engine.advance(&entry, StateDone); err != nil {
+		return err
+	}
+
+	logger.Infof("Provisioned at [%s]", entry.IP)
+
+	return ctx.Err()
+}
+
+// Record a completed step
+func (engine *Engine) advance(entry *InventoryEntry, state string) error {
+	if entry.Reached(state) {
+		return nil
+	}
+
+	entry.State = state
+
+	return engine.inventory.Put(*entry)
+}
+
+// Credentials the device currently accepts
+func (engine *Engine) credentials(entry *InventoryEntry) sofia.Credentials {
+	if entry.Reached(StatePassword) && len(engine.config.Password) > 0 {
+		return sofia.Credentials{User: engine.config.Default.User, Password: engine.config.Password}
+	}
+
+	return engine.config.Default
+}
+
+// Connect and login, current credentials first then the others in case a
+// previous run was interrupted between changing and recording the password
+func (engine *Engine) login(entry *InventoryEntry) (*sofia.Device, *sofia.Session, error) {
+	current := engine.credentials(entry)
+	candidates := []sofia.Credentials{current}
+
+	if len(engine.config.Password) > 0 {
+		if current.Password == engine.config.Password {
+			candidates = append(candidates, engine.config.Default)
+		} else {
+			candidates = append(candidates, sofia.Credentials{User: engine.config.Default.User, Password: engine.config.Password})
+		}
+	}
+
+	device, err := sofia.NewDevice(entry.IP, engine.config.Port, 5, 3, engine.logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := device.Connect(); err != nil {
+		return nil, nil, err
+	}
+
+	for idx, credentials := range candidates {
+		session, err := device.NewSession(credentials.User, sofia.SofiaHash(credentials.Password))
+		if err != nil {
+			device.Close()
+			return nil, nil, err
+		}
+
+		err = session.Login()
+		if err == nil {
+			// Password was already changed
+			if idx > 0 && credentials.Password == engine.config.Password {
+				entry.State = StatePassword
+			}
+
+			return device, session, nil
+		}
+
+		session.Close()
+
+		var retErr sofia.RetError
+		if !errors.As(err, &retErr) {
+			device.Close()
+			return nil, nil, err
+		}
+	}
+
+	device.Close()
+
+	return nil, nil, ErrNotDefault
+}
+
+// Allocate a free address from the pool, recorded before re-addressing so
+// a retry reuses the address. Addresses recorded in the inventory, of
+// discovered or registered devices and of hosts answering on the network
+// are skipped. The network is probed without holding the mutex, the
+// candidate is checked again before it is recorded.
+func (engine *Engine) allocate(entry *InventoryEntry) (net.IP, error) {
+	start := binary.BigEndian.Uint32(engine.config.PoolStart.To4())
+	end := binary.BigEndian.Uint32(engine.config.PoolEnd.To4())
+
+	var live []sofia.RegistryEntry
+	if engine.config.Registry != nil {
+		live = engine.config.Registry.Snapshot()
+	}
+
+	engine.mutex.Lock()
+	seen := make(map[string]net.IP, len(engine.seen))
+	for key, ip := range engine.seen {
+		seen[key] = ip
+	}
+	engine.mutex.Unlock()
+
+	for num := start; num <= end && num >= start; num++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, num)
+
+		if engine.reserved(ip, entry.Key, seen, live) {
+			continue
+		}
+
+		if engine.config.InUse(ip) {
+			engine.logger.Infof("Address [%s] of the pool is in use, skipped", ip)
+			continue
+		}
+
+		// Taken by another allocation or discovered while probing
+		engine.mutex.Lock()
+		if engine.reserved(ip, entry.Key, engine.seen, live) {
+			engine.mutex.Unlock()
+			continue
+		}
+
+		entry.IP = ip.String()
+		err := engine.inventory.Put(*entry)
+		engine.mutex.Unlock()
+
+		return ip, err
+	}
+
+	return nil, ErrPoolExhausted
+}
+
+// Address recorded in the inventory, seen or live for a device other than key
+func (engine *Engine) reserved(ip net.IP, key string, seen map[string]net.IP, live []sofia.RegistryEntry) bool {
+	if engine.inventory.IPInUse(ip.String(), key) {
+		return true
+	}
+
+	for other, seenIP := range seen {
+		if other != key && bytes.Equal(seenIP.To4(), ip) {
+			return true
+		}
+	}
+
+	for _, device := range live {
+		if device.Key != key && bytes.Equal(device.HostIP.To4(), ip) {
+			return true
+		}
+	}
+
+	return false
+}
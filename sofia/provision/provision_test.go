@@ -0,0 +1,214 @@
+package provision
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	return logger
+}
+
+func testEngine(t *testing.T, config Config) *Engine {
+	t.Helper()
+
+	config.Mask = net.CIDRMask(24, 32)
+	config.Gateway = net.IPv4(10, 0, 0, 1)
+	config.Inventory = filepath.Join(t.TempDir(), "inventory.json")
+
+	engine, err := NewEngine(config, nil, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return engine
+}
+
+func TestStripTemplate(t *testing.T) {
+	template := &sofia.ConfigBackup{
+		Format: sofia.ConfigBackupFormat,
+		Sections: map[string]json.RawMessage{
+			"General.General":   json.RawMessage(`{"MachineName":"LOBBY"}`),
+			"NetWork.NetCommon": json.RawMessage(`{"HostIP":"0x0A01A8C0","MAC":"00:12:34:56:78:9a","HostName":"LOBBY"}`),
+			"NetWork.NetDHCP":   json.RawMessage(`[{"Enable":true}]`),
+			"NetWork.Wifi":      json.RawMessage(`{"HostIP":"0x0B01A8C0"}`),
+			"NetWork.NetNTP":    json.RawMessage(`{"Enable":true}`),
+			"Camera.Param":      json.RawMessage(`[{}]`),
+		},
+	}
+
+	stripped, removed := StripTemplate(template)
+
+	if want := []string{"NetWork.NetCommon", "NetWork.NetDHCP", "NetWork.Wifi"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+
+	for _, name := range []string{"General.General", "NetWork.NetNTP", "Camera.Param"} {
+		if _, ok := stripped.Sections[name]; !ok {
+			t.Errorf("section %s was removed", name)
+		}
+	}
+
+	if len(stripped.Sections) != 3 || stripped.Format != template.Format {
+		t.Errorf("stripped template %v", stripped)
+	}
+
+	// The template itself is untouched
+	if len(template.Sections) != 6 {
+		t.Errorf("template modified, %d sections", len(template.Sections))
+	}
+
+	// The engine never applies them
+	engine := testEngine(t, Config{
+		PoolStart: net.IPv4(10, 0, 0, 100),
+		PoolEnd:   net.IPv4(10, 0, 0, 110),
+		Template:  template,
+	})
+
+	if _, ok := engine.config.Template.Sections["NetWork.NetCommon"]; ok {
+		t.Error("engine template has NetWork.NetCommon")
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	inUse := map[string]bool{
+		"10.0.0.101": true, // Host answering on the network
+	}
+
+	engine := testEngine(t, Config{
+		PoolStart: net.IPv4(10, 0, 0, 100),
+		PoolEnd:   net.IPv4(10, 0, 0, 104),
+		InUse: func(ip net.IP) bool {
+			return inUse[ip.String()]
+		},
+	})
+
+	// Recorded in the inventory and discovered
+	if err := engine.inventory.Put(InventoryEntry{Key: "provisioned", IP: "10.0.0.100", State: StateDone}); err != nil {
+		t.Fatal(err)
+	}
+	engine.seen["other"] = net.IPv4(10, 0, 0, 102)
+
+	tests := []struct {
+		key     string
+		want    string
+		wantErr error
+	}{
+		{key: "first", want: "10.0.0.103"},
+		{key: "second", want: "10.0.0.104"},
+		{key: "third", wantErr: ErrPoolExhausted},
+	}
+
+	for _, test := range tests {
+		entry := InventoryEntry{Key: test.key}
+
+		ip, err := engine.allocate(&entry)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: err = %v, want %v", test.key, err, test.wantErr)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if ip.String() != test.want || entry.IP != test.want {
+			t.Errorf("%s: allocated %s (entry %s), want %s", test.key, ip, entry.IP, test.want)
+		}
+
+		// Recorded so a retry reuses it
+		if recorded, _ := engine.inventory.Get(test.key); recorded.IP != test.want {
+			t.Errorf("%s: inventory has %q", test.key, recorded.IP)
+		}
+	}
+}
+
+func TestAllocateConcurrent(t *testing.T) {
+	var engine *Engine
+	engine = testEngine(t, Config{
+		PoolStart: net.IPv4(10, 0, 0, 100),
+		PoolEnd:   net.IPv4(10, 0, 0, 104),
+		InUse: func(ip net.IP) bool {
+			// Probed without the mutex, discovery keeps going meanwhile
+			if !engine.mutex.TryLock() {
+				t.Errorf("%s probed with the mutex held", ip)
+			} else {
+				engine.mutex.Unlock()
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			return false
+		},
+	})
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	ips := make([]net.IP, len(keys))
+	errs := make([]error, len(keys))
+
+	var wg sync.WaitGroup
+	for idx, key := range keys {
+		wg.Add(1)
+		go func(idx int, key string) {
+			defer wg.Done()
+			ips[idx], errs[idx] = engine.allocate(&InventoryEntry{Key: key})
+		}(idx, key)
+	}
+	wg.Wait()
+
+	// Every address handed out once, the pool is one short
+	allocated := make(map[string]string)
+	exhausted := 0
+
+	for idx, key := range keys {
+		if errors.Is(errs[idx], ErrPoolExhausted) {
+			exhausted++
+			continue
+		}
+
+		if errs[idx] != nil {
+			t.Fatalf("%s: %v", key, errs[idx])
+		}
+
+		if other, ok := allocated[ips[idx].String()]; ok {
+			t.Errorf("%s allocated to %s and %s", ips[idx], other, key)
+		}
+		allocated[ips[idx].String()] = key
+	}
+
+	if len(allocated) != 5 || exhausted != 1 {
+		t.Errorf("allocated %v, %d exhausted", allocated, exhausted)
+	}
+}
+
+func TestAddressInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	if !AddressInUse(net.IPv4(127, 0, 0, 1), port) {
+		t.Error("listening host not in use")
+	}
+
+	// Refused connections come from a live host too
+	listener.Close()
+
+	if !AddressInUse(net.IPv4(127, 0, 0, 1), port) {
+		t.Error("refusing host not in use")
+	}
+}
@@ -0,0 +1,291 @@
+// Package proxy relays DVRIP between clients and a device, logging every
+// decoded message in both directions.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/pcap"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default connect timeout to the device
+const ConnectTimeout = 5 * time.Second
+
+// Relay buffer length
+const relayBufLen = 0x10000
+
+// Logging proxy
+type Proxy struct {
+	target    string          // Device address, host:port
+	dialer    sofia.Dialer    // Opens device connections
+	timeout   time.Duration   // Connect timeout
+	logger    *logrus.Entry   // Contextual logger
+	out       io.Writer       // Decoded messages
+	summary   bool            // Only summary lines
+	recorder  *pcap.Recorder  // Records relayed traffic, nil if not recording
+	mutex     sync.Mutex      // Protects the following, serializes output
+	dissector *pcap.Dissector // Decodes relayed traffic
+	listener  net.Listener    // Client listener
+	conns     map[net.Conn]bool
+	closed    bool // Closed by Close
+	wg        sync.WaitGroup
+}
+
+// Create a proxy to target (host:port), decoded messages go to stdout
+func NewProxy(target string, logger *logrus.Logger) (*Proxy, error) {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+
+	devicePort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &Proxy{
+		target:    target,
+		dialer:    sofia.TCPDialer(),
+		timeout:   ConnectTimeout,
+		out:       os.Stdout,
+		dissector: pcap.NewDissector(),
+		conns:     make(map[net.Conn]bool),
+	}
+
+	// Direction is told by the device port
+	proxy.dissector.SetPorts([]uint16{uint16(devicePort)}, []uint16{})
+
+	proxy.logger = logger.WithFields(logrus.Fields{
+		"module": "Proxy",
+		"remote": target,
+	})
+
+	return proxy, nil
+}
+
+// Connect to the device with dialer, e.g. sofia.TLSDialer
+func (proxy *Proxy) SetDialer(dialer sofia.Dialer) {
+	proxy.dialer = dialer
+}
+
+// Connect timeout to the device
+func (proxy *Proxy) SetTimeout(timeout time.Duration) {
+	proxy.timeout = timeout
+}
+
+// Write decoded messages to w, only a line per message if summary
+func (proxy *Proxy) SetOutput(w io.Writer, summary bool) {
+	proxy.mutex.Lock()
+	proxy.out = w
+	proxy.summary = summary
+	proxy.mutex.Unlock()
+}
+
+// Record relayed traffic to w as a pcap capture, replayable with tcpreplay
+// and decoded by the pcap command
+func (proxy *Proxy) Record(w io.Writer) error {
+	recorder, err := pcap.NewRecorder(w)
+	if err != nil {
+		return err
+	}
+
+	proxy.mutex.Lock()
+	proxy.recorder = recorder
+	proxy.mutex.Unlock()
+
+	return nil
+}
+
+// Relay connections accepted from listener until Close
+func (proxy *Proxy) Serve(listener net.Listener) error {
+	proxy.mutex.Lock()
+	if proxy.closed {
+		proxy.mutex.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	proxy.listener = listener
+	proxy.mutex.Unlock()
+
+	proxy.logger.Info("Relaying ", listener.Addr(), " to ", proxy.target)
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		proxy.mutex.Lock()
+		if proxy.closed {
+			proxy.mutex.Unlock()
+			client.Close()
+			return nil
+		}
+		proxy.conns[client] = true
+		proxy.wg.Add(1)
+		proxy.mutex.Unlock()
+
+		go proxy.serve(client)
+	}
+}
+
+// Stop listening and close all relayed connections
+func (proxy *Proxy) Close() error {
+	proxy.mutex.Lock()
+	proxy.closed = true
+	listener := proxy.listener
+	conns := make([]net.Conn, 0, len(proxy.conns))
+	for conn := range proxy.conns {
+		conns = append(conns, conn)
+	}
+	proxy.mutex.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	proxy.wg.Wait()
+
+	return nil
+}
+
+// Relay a client connection
+func (proxy *Proxy) serve(client net.Conn) {
+	defer proxy.wg.Done()
+	defer func() {
+		proxy.mutex.Lock()
+		delete(proxy.conns, client)
+		proxy.mutex.Unlock()
+
+		client.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxy.timeout)
+	device, err := proxy.dialer.Dial(ctx, proxy.target)
+	cancel()
+
+	if err != nil {
+		proxy.logger.Error("Unable to connect for ", client.RemoteAddr(), " [", err.Error(), "]")
+		return
+	}
+
+	proxy.mutex.Lock()
+	proxy.conns[device] = true
+	proxy.mutex.Unlock()
+
+	defer func() {
+		proxy.mutex.Lock()
+		delete(proxy.conns, device)
+		proxy.mutex.Unlock()
+
+		device.Close()
+	}()
+
+	clientAddr, deviceAddr := addrPort(client.RemoteAddr()), addrPort(device.RemoteAddr())
+	proxy.logger.Info("Client ", clientAddr, " connected")
+
+	proxy.mutex.Lock()
+	if proxy.recorder != nil {
+		if err := proxy.recorder.Open(time.Now(), clientAddr, deviceAddr); err != nil {
+			proxy.logger.Error("Unable to record [", err.Error(), "]")
+		}
+	}
+	proxy.mutex.Unlock()
+
+	// Relay both ways until either end closes
+	done := make(chan struct{}, 2)
+	go proxy.relay(client, device, clientAddr, deviceAddr, done)
+	go proxy.relay(device, client, deviceAddr, clientAddr, done)
+
+	<-done
+	client.Close()
+	device.Close()
+	<-done
+
+	proxy.mutex.Lock()
+	if proxy.recorder != nil {
+		proxy.recorder.Close(time.Now(), clientAddr, deviceAddr)
+	}
+	proxy.dissector.EndStream(clientAddr, deviceAddr)
+	proxy.mutex.Unlock()
+
+	proxy.logger.Info("Client ", clientAddr, " disconnected")
+}
+
+// Copy from src to dst, decoding what passes
+func (proxy *Proxy) relay(src net.Conn, dst net.Conn, from netip.AddrPort, to netip.AddrPort, done chan struct{}) {
+	defer func() {
+		done <- struct{}{}
+	}()
+
+	buf := make([]byte, relayBufLen)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+
+			proxy.inspect(from, to, buf[:n])
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Record and decode relayed data
+func (proxy *Proxy) inspect(from netip.AddrPort, to netip.AddrPort, data []byte) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	t := time.Now()
+
+	if proxy.recorder != nil {
+		if err := proxy.recorder.Data(t, from, to, data); err != nil {
+			proxy.logger.Error("Unable to record [", err.Error(), "]")
+		}
+	}
+
+	for _, frame := range proxy.dissector.Stream(t, from, to, data) {
+		var err error
+		if proxy.summary {
+			_, err = io.WriteString(proxy.out, frame.String()+"\n")
+		} else {
+			err = frame.Format(proxy.out)
+		}
+
+		if err != nil {
+			proxy.logger.Error("Unable to write message [", err.Error(), "]")
+		}
+	}
+}
+
+// Address and port of a connection end, unspecified if not IP
+func addrPort(addr net.Addr) netip.AddrPort {
+	if addrPort, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return addrPort
+	}
+
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
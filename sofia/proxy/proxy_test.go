@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/pcap"
+	"sofia-go/sofia/sofiatest"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Frame as clients send it, the trailer isn't counted in the data length
+func requestBytes(frame sofiatest.Frame) []byte {
+	data := frame.Data
+	frame.Data = nil
+
+	buf := frame.Bytes()
+	binary.LittleEndian.PutUint32(buf[sofia.DeviceMessageOffsetDataLen:], uint32(len(data)))
+
+	return append(append(buf, data...), 0x0A, 0x00)
+}
+
+// Read a device frame as sent, header and data
+func readRaw(r io.Reader) ([]byte, error) {
+	buf := make([]byte, sofia.DeviceMessageHeaderLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint32(buf[sofia.DeviceMessageOffsetDataLen:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return append(buf, data...), nil
+}
+
+func TestProxy(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	server := sofiatest.NewServer(sofiatest.Config{Logger: logger})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	proxy, err := NewProxy(server.Addr().String(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded, recording bytes.Buffer
+	proxy.SetOutput(&decoded, true)
+	if err := proxy.Record(&recording); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.Serve(listener)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Requests as sent by the client, responses as received
+	var requests []sofiatest.Frame
+	var responses [][]byte
+
+	roundTrip := func(req sofiatest.Frame, data interface{}) sofiatest.Frame {
+		t.Helper()
+
+		req.Data, _ = json.Marshal(data)
+		requests = append(requests, req)
+
+		if _, err := client.Write(requestBytes(req)); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := readRaw(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, raw)
+
+		res, err := sofiatest.ReadFrame(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var resData sofia.CmdResData2
+		if err := json.Unmarshal(res.Data, &resData); err != nil || resData.Ret != sofia.RetOK {
+			t.Fatalf("response [%d] %s", res.MsgID, res.Data)
+		}
+
+		return res
+	}
+
+	res := roundTrip(sofiatest.Frame{MsgID: sofia.LOGIN_REQ2, OpaqueID: 7}, sofia.LoginReqData{
+		EncryptType: "MD5",
+		LoginType:   "DVRIP-Web",
+		PassWord:    sofia.SofiaHash(""),
+		UserName:    "admin",
+	})
+	if res.MsgID != sofia.LOGIN_RSP || res.SessionID == 0 {
+		t.Fatalf("login response [%d] %s", res.MsgID, res.Data)
+	}
+
+	sessionId := res.SessionID
+	res = roundTrip(sofiatest.Frame{SessionID: sessionId, SeqNum: 1, MsgID: sofia.SYSINFO_REQ}, sofia.CmdReqData{
+		Name:      "SystemInfo",
+		SessionID: fmt.Sprintf("0x%08X", sessionId),
+	})
+	if res.MsgID != sofia.SYSINFO_RSP {
+		t.Fatalf("system info response [%d] %s", res.MsgID, res.Data)
+	}
+
+	client.Close()
+	proxy.Close()
+
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests reach the device unchanged
+	got := server.Requests()
+	if len(got) != len(requests) {
+		t.Fatalf("device got %d requests, want %d", len(got), len(requests))
+	}
+
+	for idx, req := range requests {
+		if got[idx].MsgID != req.MsgID || got[idx].SessionID != req.SessionID || got[idx].SeqNum != req.SeqNum ||
+			got[idx].OpaqueID != req.OpaqueID || !bytes.Equal(got[idx].Data, req.Data) {
+			t.Errorf("request %d: device got %+v, want %+v", idx, got[idx], req)
+		}
+	}
+
+	if lines := bytes.Count(decoded.Bytes(), []byte("\n")); lines != 2*len(requests) {
+		t.Errorf("%d decoded messages, want %d:\n%s", lines, 2*len(requests), decoded.Bytes())
+	}
+
+	// The recording holds both directions, responses as the client got them
+	reader, err := pcap.NewReader(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dissector := pcap.NewDissector()
+	dissector.SetPorts([]uint16{addrPort(server.Addr()).Port()}, []uint16{})
+
+	var toDevice, fromDevice []pcap.Frame
+	err = dissector.Dissect(reader, func(frame pcap.Frame) error {
+		switch frame.Direction {
+		case pcap.DirToDevice:
+			toDevice = append(toDevice, frame)
+		case pcap.DirFromDevice:
+			fromDevice = append(fromDevice, frame)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(toDevice) != len(requests) || len(fromDevice) != len(responses) {
+		t.Fatalf("recorded %d requests and %d responses, want %d and %d", len(toDevice), len(fromDevice), len(requests), len(responses))
+	}
+
+	for idx, req := range requests {
+		if msg := toDevice[idx].Message; msg.ID() != req.MsgID || msg.SessionID() != req.SessionID || !bytes.Equal(msg.Data(), req.Data) {
+			t.Errorf("recorded request %d: [%d] %s", idx, msg.ID(), msg.Data())
+		}
+	}
+
+	for idx, raw := range responses {
+		res, _ := sofiatest.ReadFrame(bytes.NewReader(raw))
+		if msg := fromDevice[idx].Message; msg.ID() != res.MsgID || msg.SessionID() != res.SessionID || msg.SeqNum() != res.SeqNum ||
+			!bytes.Equal(msg.Data(), res.Data) {
+			t.Errorf("recorded response %d: [%d] %s", idx, msg.ID(), msg.Data())
+		}
+	}
+
+	if stats := dissector.Stats(); stats.Gaps != 0 || stats.Skipped != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	wantSrc := netip.MustParseAddrPort(server.Addr().String())
+	if fromDevice[0].Src != wantSrc {
+		t.Errorf("responses from %v, want %v", fromDevice[0].Src, wantSrc)
+	}
+}
@@ -0,0 +1,104 @@
+package sofia
+
+import "sync/atomic"
+
+// Default session queue length
+const SessionQueueLen = 32
+
+// What the worker does when a session queue is full. The worker never waits
+// for a session, so a consumer that stops reading only loses its own messages.
+type QueuePolicy int
+
+const (
+	QueueDropOldest QueuePolicy = iota // Discard the oldest queued message to make room (default)
+	QueueDropNewest                    // Discard the message that doesn't fit
+)
+
+func (policy QueuePolicy) String() string {
+	switch policy {
+	case QueueDropOldest:
+		return "DropOldest"
+	case QueueDropNewest:
+		return "DropNewest"
+	}
+
+	return "Unknown"
+}
+
+// Session queue counters, updated atomically by the worker
+type queueCounters struct {
+	delivered uint64 // Messages queued
+	dropped   uint64 // Messages discarded by the overflow policy
+	highWater int64  // Largest queue length seen
+}
+
+// Session queue metrics
+type QueueStats struct {
+	Len       int         // Messages waiting
+	Cap       int         // Queue capacity
+	Delivered uint64      // Messages queued
+	Dropped   uint64      // Messages discarded by the overflow policy
+	HighWater int         // Largest queue length seen
+	Policy    QueuePolicy // Overflow policy
+}
+
+// Queue length and overflow policy of sessions created afterwards, length
+// 0 for the default
+func (device *Device) SetSessionQueue(length int, policy QueuePolicy) {
+	if length <= 0 {
+		length = SessionQueueLen
+	}
+
+	device.mutex.Lock()
+	device.queueLen = length
+	device.queuePolicy = policy
+	device.mutex.Unlock()
+}
+
+// Queue metrics
+func (session *Session) QueueStats() QueueStats {
+	return QueueStats{
+		Len:       len(session.rxChan),
+		Cap:       cap(session.rxChan),
+		Delivered: atomic.LoadUint64(&session.rxStats.delivered),
+		Dropped:   atomic.LoadUint64(&session.rxStats.dropped),
+		HighWater: int(atomic.LoadInt64(&session.rxStats.highWater)),
+		Policy:    session.rxPolicy,
+	}
+}
+
+// Queue a message without blocking, applying the overflow policy
+func (session *Session) enqueue(msg DeviceMessage) {
+	for {
+		select {
+		case session.rxChan <- msg:
+			atomic.AddUint64(&session.rxStats.delivered, 1)
+
+			// Another enqueue may raise it meanwhile, never lower it
+			length := int64(len(session.rxChan))
+			for {
+				highWater := atomic.LoadInt64(&session.rxStats.highWater)
+				if length <= highWater || atomic.CompareAndSwapInt64(&session.rxStats.highWater, highWater, length) {
+					break
+				}
+			}
+
+			return
+		default:
+		}
+
+		if session.rxPolicy == QueueDropNewest {
+			atomic.AddUint64(&session.rxStats.dropped, 1)
+			session.device.logger.Warn("Queue full for session ", session.sessionID(), ", dropped message [", msg.msgId, "]")
+			return
+		}
+
+		// Make room, the consumer may have done so meanwhile
+		select {
+		case old := <-session.rxChan:
+			atomic.AddUint64(&session.rxStats.dropped, 1)
+			session.device.logger.Warn("Queue full for session ", session.sessionID(), ", dropped message [", old.msgId, "]")
+		default:
+		}
+	}
+}
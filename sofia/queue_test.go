@@ -0,0 +1,84 @@
+package sofia
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Session with a queue of length, not connected
+func queueSession(length int, policy QueuePolicy) *Session {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	return &Session{
+		device:   &Device{logger: logrus.NewEntry(logger)},
+		rxChan:   make(chan DeviceMessage, length),
+		rxPolicy: policy,
+	}
+}
+
+func TestEnqueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy    QueuePolicy
+		delivered uint64
+		kept      []uint16 // Message IDs left in the queue, in order
+	}{
+		{policy: QueueDropOldest, delivered: 10, kept: []uint16{6, 7, 8, 9}},
+		{policy: QueueDropNewest, delivered: 4, kept: []uint16{0, 1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			session := queueSession(4, test.policy)
+
+			for id := uint16(0); id < 10; id++ {
+				session.enqueue(DeviceMessage{msgId: id})
+			}
+
+			stats := session.QueueStats()
+			want := QueueStats{Len: 4, Cap: 4, Delivered: test.delivered, Dropped: 6, HighWater: 4, Policy: test.policy}
+			if stats != want {
+				t.Errorf("stats %+v, want %+v", stats, want)
+			}
+
+			for _, id := range test.kept {
+				if msg := <-session.rxChan; msg.msgId != id {
+					t.Errorf("message [%d], want [%d]", msg.msgId, id)
+				}
+			}
+
+			// Draining doesn't lower the high water mark
+			session.enqueue(DeviceMessage{})
+			if stats := session.QueueStats(); stats.Len != 1 || stats.HighWater != 4 || stats.Dropped != 6 {
+				t.Errorf("stats after drain %+v", stats)
+			}
+		})
+	}
+}
+
+func TestEnqueueHighWater(t *testing.T) {
+	const workers, messages = 8, 16
+
+	session := queueSession(workers*messages, QueueDropNewest)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := 0; idx < messages; idx++ {
+				session.enqueue(DeviceMessage{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := session.QueueStats()
+	if stats.Len != workers*messages || stats.Delivered != workers*messages || stats.Dropped != 0 || stats.HighWater != workers*messages {
+		t.Errorf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,476 @@
+package sofia
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Registry event types
+type RegistryEventType int
+
+const (
+	DeviceAppeared    RegistryEventType = iota // First response from device
+	DeviceChanged                              // Device reported different settings
+	DeviceDisappeared                          // Device not heard from within expiry
+	DeviceConflict                             // New address or serial number conflict
+)
+
+func (eventType RegistryEventType) String() string {
+	switch eventType {
+	case DeviceAppeared:
+		return "Appeared"
+	case DeviceChanged:
+		return "Changed"
+	case DeviceDisappeared:
+		return "Disappeared"
+	case DeviceConflict:
+		return "Conflict"
+	}
+
+	return "Unknown"
+}
+
+// Conflict types
+type ConflictType int
+
+const (
+	ConflictIP     ConflictType = iota // Several MACs claim the same address
+	ConflictSerial                     // Several MACs report the same serial number
+	ConflictSubnet                     // Device outside the subnets of the interface it was found on
+)
+
+func (conflictType ConflictType) String() string {
+	switch conflictType {
+	case ConflictIP:
+		return "IP"
+	case ConflictSerial:
+		return "Serial"
+	case ConflictSubnet:
+		return "Subnet"
+	}
+
+	return "Unknown"
+}
+
+// Address or serial number conflict
+type Conflict struct {
+	Type      ConflictType // Conflict type
+	Value     string       // Conflicting address or serial number
+	MACs      []string     // Devices involved, ordered
+	Interface string       // Interface (ConflictSubnet only)
+}
+
+// Unique conflict id
+func (conflict Conflict) id() string {
+	return conflict.Type.String() + "|" + conflict.Value + "|" + strings.Join(conflict.MACs, ",")
+}
+
+func (conflict Conflict) String() string {
+	if conflict.Type == ConflictSubnet {
+		return fmt.Sprintf("%s conflict: %s %v not in subnets of [%s]", conflict.Type, conflict.Value, conflict.MACs, conflict.Interface)
+	}
+
+	return fmt.Sprintf("%s conflict: %s claimed by %v", conflict.Type, conflict.Value, conflict.MACs)
+}
+
+// Device known to the registry
+type RegistryEntry struct {
+	DiscoveredDevice            // Latest response
+	Key              string     // Registry key, serial number or MAC
+	FirstSeen        time.Time  // First response
+	LastSeen         time.Time  // Latest response
+	Conflicts        []Conflict // Conflicts the device is involved in
+}
+
+// Registry event
+type RegistryEvent struct {
+	Type     RegistryEventType // Event type
+	Entry    RegistryEntry     // Entry after the event
+	Previous *RegistryEntry    // Entry before the event (DeviceChanged only)
+	Changes  []string          // Changed fields (DeviceChanged only)
+	Conflict *Conflict         // New conflict (DeviceConflict only)
+}
+
+// Inventory of devices found by discovery
+type Registry struct {
+	logger    *logrus.Entry             // Contextual logger
+	discovery *Discovery                // Discovery feeding the registry
+	expiry    time.Duration             // Expire devices not heard from within
+	mutex     sync.Mutex                // Protects devices
+	devices   map[string]*RegistryEntry // Devices by key
+	conflicts map[string]Conflict       // Current conflicts by id
+	eventQ    chan RegistryEvent        // Event Q
+	dropped   uint64                    // Events dropped on a full event Q
+}
+
+// Create a new registry, devices expire after missing expiry discovery intervals
+func NewRegistry(discovery *Discovery, expiry uint32, logger *logrus.Logger) (*Registry, error) {
+	// Allocate a new registry
+	registry := new(Registry)
+
+	registry.discovery = discovery
+	registry.expiry = discovery.interval * time.Duration(expiry)
+	registry.devices = make(map[string]*RegistryEntry)
+	registry.conflicts = make(map[string]Conflict)
+
+	// Create channel
+	registry.eventQ = make(chan RegistryEvent, 100)
+
+	// Initialize logger
+	registry.logger = logger.WithFields(logrus.Fields{
+		"module": "Registry",
+	})
+
+	return registry, nil
+}
+
+// Event Q, events are dropped when it is full
+func (registry *Registry) EventQ() *chan RegistryEvent {
+	return &registry.eventQ
+}
+
+// Number of events dropped on a full event Q
+func (registry *Registry) Dropped() uint64 {
+	return atomic.LoadUint64(&registry.dropped)
+}
+
+// Current inventory, ordered by key
+func (registry *Registry) Snapshot() []RegistryEntry {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	entries := make([]RegistryEntry, 0, len(registry.devices))
+	for _, entry := range registry.devices {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+// Current conflicts
+func (registry *Registry) Conflicts() []Conflict {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	conflicts := make([]Conflict, 0, len(registry.conflicts))
+	for _, conflict := range registry.conflicts {
+		conflicts = append(conflicts, conflict)
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].id() < conflicts[j].id()
+	})
+
+	return conflicts
+}
+
+// Update registry with a discovered device
+func (registry *Registry) Update(device DiscoveredDevice, now time.Time) {
+	key := RegistryKey(device)
+	if len(key) == 0 {
+		return
+	}
+
+	// Resolved before locking, it queries the system
+	subnets := localSubnets()
+
+	var events []RegistryEvent
+	{
+		registry.mutex.Lock()
+
+		// Another live device with the same serial number is kept apart
+		if len(device.SerialNo) > 0 {
+			dupKey := key + "/" + device.MAC.String()
+
+			if _, ok := registry.devices[dupKey]; ok {
+				key = dupKey
+			} else if entry, ok := registry.devices[key]; ok && !bytes.Equal(entry.MAC, device.MAC) && now.Sub(entry.LastSeen) <= registry.expiry {
+				key = dupKey
+			}
+		}
+
+		var event *RegistryEvent
+		if entry, ok := registry.devices[key]; !ok {
+			entry = &RegistryEntry{
+				DiscoveredDevice: device,
+				Key:              key,
+				FirstSeen:        now,
+				LastSeen:         now,
+			}
+			registry.devices[key] = entry
+
+			event = &RegistryEvent{Type: DeviceAppeared, Entry: *entry}
+		} else {
+			previous := *entry
+			entry.DiscoveredDevice = device
+			entry.LastSeen = now
+
+			if changes := deviceChanges(&previous.DiscoveredDevice, &device); len(changes) > 0 {
+				event = &RegistryEvent{Type: DeviceChanged, Entry: *entry, Previous: &previous, Changes: changes}
+			}
+		}
+
+		if event != nil {
+			events = append(events, *event)
+		}
+
+		events = append(events, registry.detect(subnets)...)
+
+		registry.mutex.Unlock()
+	}
+
+	registry.publish(events)
+}
+
+// Expire devices not heard from within expiry
+func (registry *Registry) Expire(now time.Time) {
+	// Resolved before locking, it queries the system
+	subnets := localSubnets()
+
+	var events []RegistryEvent
+	{
+		registry.mutex.Lock()
+
+		for key, entry := range registry.devices {
+			if now.Sub(entry.LastSeen) > registry.expiry {
+				delete(registry.devices, key)
+				events = append(events, RegistryEvent{Type: DeviceDisappeared, Entry: *entry})
+			}
+		}
+
+		events = append(events, registry.detect(subnets)...)
+
+		registry.mutex.Unlock()
+	}
+
+	registry.publish(events)
+}
+
+// Publish events
+func (registry *Registry) publish(events []RegistryEvent) {
+	for _, event := range events {
+		switch event.Type {
+		case DeviceConflict:
+			registry.logger.Warnf("Device %s %s", event.Entry.Key, event.Conflict)
+		case DeviceDisappeared:
+			registry.logger.Infof("Device %s %s, last seen %s", event.Entry.Key, event.Type, event.Entry.LastSeen.Format(time.RFC3339))
+		default:
+			registry.logger.Infof("Device %s %s at [%s] %v", event.Entry.Key, event.Type, event.Entry.HostIP, event.Changes)
+		}
+
+		select {
+		case registry.eventQ <- event:
+		default:
+			atomic.AddUint64(&registry.dropped, 1)
+			registry.logger.Debug("Event Q full, dropped ", event.Type, " event of device ", event.Entry.Key)
+		}
+	}
+}
+
+// Recompute conflicts of all entries against the local subnets by
+// interface name, returns events for new conflicts.
+// Must be called with mutex held.
+func (registry *Registry) detect(subnets map[string][]*net.IPNet) []RegistryEvent {
+	// Group entries by address and serial number
+	byIP := make(map[string][]*RegistryEntry)
+	bySerial := make(map[string][]*RegistryEntry)
+
+	for _, entry := range registry.devices {
+		entry.Conflicts = nil
+
+		if entry.HostIP != nil {
+			byIP[entry.HostIP.String()] = append(byIP[entry.HostIP.String()], entry)
+		}
+
+		if len(entry.SerialNo) > 0 {
+			bySerial[entry.SerialNo] = append(bySerial[entry.SerialNo], entry)
+		}
+	}
+
+	conflicts := make(map[string]Conflict)
+	involved := make(map[string][]*RegistryEntry)
+
+	// Several MACs sharing a value
+	group := func(conflictType ConflictType, groups map[string][]*RegistryEntry) {
+		for value, entries := range groups {
+			macs := distinctMACs(entries)
+			if len(macs) < 2 {
+				continue
+			}
+
+			conflict := Conflict{Type: conflictType, Value: value, MACs: macs}
+			conflicts[conflict.id()] = conflict
+			involved[conflict.id()] = entries
+		}
+	}
+
+	group(ConflictIP, byIP)
+	group(ConflictSerial, bySerial)
+
+	// Outside the subnets of the receiving interface, or of every local
+	// interface when it isn't known (any interface mode)
+	for _, entry := range registry.devices {
+		if entry.HostIP == nil {
+			continue
+		}
+
+		var nets []*net.IPNet
+		if len(entry.Interface) > 0 {
+			nets = subnets[entry.Interface]
+		} else {
+			for _, ifaceNets := range subnets {
+				nets = append(nets, ifaceNets...)
+			}
+		}
+
+		if len(nets) == 0 {
+			continue
+		}
+
+		inside := false
+		for _, ipnet := range nets {
+			inside = inside || ipnet.Contains(entry.HostIP)
+		}
+
+		if !inside {
+			conflict := Conflict{Type: ConflictSubnet, Value: entry.HostIP.String(), MACs: []string{entry.MAC.String()}, Interface: entry.Interface}
+			conflicts[conflict.id()] = conflict
+			involved[conflict.id()] = []*RegistryEntry{entry}
+		}
+	}
+
+	// Attach to entries and report new ones, in a stable order
+	ids := make([]string, 0, len(conflicts))
+	for id := range conflicts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var events []RegistryEvent
+	for _, id := range ids {
+		conflict := conflicts[id]
+
+		for _, entry := range involved[id] {
+			entry.Conflicts = append(entry.Conflicts, conflict)
+		}
+
+		if _, ok := registry.conflicts[id]; !ok {
+			events = append(events, RegistryEvent{Type: DeviceConflict, Entry: *involved[id][0], Conflict: &conflict})
+		}
+	}
+
+	registry.conflicts = conflicts
+
+	return events
+}
+
+// IPv4 subnets of local interfaces by name
+func localSubnets() map[string][]*net.IPNet {
+	subnets := make(map[string][]*net.IPNet)
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return subnets
+	}
+
+	for idx := range ifaces {
+		if nets, err := interfaceNets(&ifaces[idx]); err == nil && len(nets) > 0 {
+			subnets[ifaces[idx].Name] = nets
+		}
+	}
+
+	return subnets
+}
+
+// Distinct MACs of entries, ordered
+func distinctMACs(entries []*RegistryEntry) []string {
+	set := make(map[string]bool)
+	for _, entry := range entries {
+		set[entry.MAC.String()] = true
+	}
+
+	macs := make([]string, 0, len(set))
+	for mac := range set {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	return macs
+}
+
+// Registry task
+func (registry *Registry) run() {
+	// Create a ticker
+	ticker := time.NewTicker(registry.discovery.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case device, ok := <-registry.discovery.mQ:
+			if !ok {
+				// Discovery stopped
+				close(registry.eventQ)
+				return
+			}
+			registry.Update(device, time.Now())
+		case now := <-ticker.C:
+			registry.Expire(now)
+		}
+	}
+}
+
+// Start consuming discovery results, Discovery.MQ must not be read by others.
+// The event Q is closed when discovery stops.
+func (registry *Registry) Start() {
+	go registry.run()
+}
+
+// Registry key, serial number or MAC if device has none
+func RegistryKey(device DiscoveredDevice) string {
+	if len(device.SerialNo) > 0 {
+		return device.SerialNo
+	}
+
+	return device.MAC.String()
+}
+
+// Names of changed fields
+func deviceChanges(old *DiscoveredDevice, new *DiscoveredDevice) []string {
+	var changes []string
+
+	if !old.HostIP.Equal(new.HostIP) {
+		changes = append(changes, "HostIP")
+	}
+	if old.Submask.String() != new.Submask.String() {
+		changes = append(changes, "Submask")
+	}
+	if !old.GateWay.Equal(new.GateWay) {
+		changes = append(changes, "GateWay")
+	}
+	if old.MAC.String() != new.MAC.String() {
+		changes = append(changes, "MAC")
+	}
+	if old.HostName != new.HostName {
+		changes = append(changes, "HostName")
+	}
+	if old.Version != new.Version || !old.BuildDate.Equal(new.BuildDate) {
+		changes = append(changes, "Version")
+	}
+	if old.TCPPort != new.TCPPort || old.UDPPort != new.UDPPort || old.HttpPort != new.HttpPort || old.SSLPort != new.SSLPort {
+		changes = append(changes, "Ports")
+	}
+
+	return changes
+}
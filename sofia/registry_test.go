@@ -0,0 +1,241 @@
+package sofia
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRegistrySubnetConflict(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, lab, _ := net.ParseCIDR("10.10.0.0/16")
+
+	subnets := map[string][]*net.IPNet{
+		"eth0": {lan},
+		"eth1": {lab},
+	}
+
+	tests := []struct {
+		name      string
+		iface     string
+		ip        net.IP
+		conflicts bool
+	}{
+		{name: "inside receiving interface", iface: "eth0", ip: net.IPv4(192, 168, 1, 10)},
+		{name: "outside receiving interface", iface: "eth0", ip: net.IPv4(10, 10, 0, 5), conflicts: true},
+		{name: "unknown receiving interface", iface: "eth9", ip: net.IPv4(172, 16, 0, 1)},
+		{name: "any interface, inside one", ip: net.IPv4(10, 10, 3, 4)},
+		{name: "any interface, outside all", ip: net.IPv4(192, 168, 0, 10), conflicts: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &Registry{
+				devices:   make(map[string]*RegistryEntry),
+				conflicts: make(map[string]Conflict),
+			}
+
+			mac, _ := net.ParseMAC("00:12:34:56:78:9a")
+			registry.devices["dev"] = &RegistryEntry{
+				DiscoveredDevice: DiscoveredDevice{HostIP: test.ip, MAC: mac, Interface: test.iface},
+				Key:              "dev",
+				LastSeen:         time.Now(),
+			}
+
+			events := registry.detect(subnets)
+
+			if conflicts := len(events) > 0; conflicts != test.conflicts {
+				t.Fatalf("conflict events %v, want conflict %v", events, test.conflicts)
+			}
+
+			if test.conflicts {
+				conflict := events[0].Conflict
+				if conflict.Type != ConflictSubnet || conflict.Value != test.ip.String() || conflict.Interface != test.iface {
+					t.Errorf("conflict %+v", *conflict)
+				}
+
+				// Reported once
+				if events := registry.detect(subnets); len(events) != 0 {
+					t.Errorf("conflict reported again %v", events)
+				}
+			}
+		})
+	}
+}
+
+// Registry fed by hand, discovery every second, expiry after 3 intervals
+func newTestRegistry(t *testing.T) *Registry {
+	discovery := newTestDiscovery(t, 34569)
+
+	registry, err := NewRegistry(discovery, 3, discovery.logger.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return registry
+}
+
+// Events queued so far
+func registryEvents(registry *Registry) []RegistryEvent {
+	var events []RegistryEvent
+	for {
+		select {
+		case event := <-registry.eventQ:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestRegistryEvents(t *testing.T) {
+	macA, _ := net.ParseMAC("00:12:31:0a:4d:2b")
+	macB, _ := net.ParseMAC("00:12:31:0a:4d:2c")
+
+	// No address, keeps local subnets out of the picture
+	devA := DiscoveredDevice{SerialNo: "c142f4c2ba8b3c9b", MAC: macA, HostName: "NVR"}
+	renamed := devA
+	renamed.HostName = "NVR2"
+	devB := DiscoveredDevice{MAC: macB, HostName: "IPC"}
+	clone := DiscoveredDevice{SerialNo: devA.SerialNo, MAC: macB, HostName: "IPC"}
+
+	type step struct {
+		at      time.Duration     // Since start
+		update  *DiscoveredDevice // Device to update, nil to expire
+		want    []RegistryEventType
+		changes []string // Changed fields of a DeviceChanged event
+		keys    []string // Snapshot keys after the step
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "appear, refresh, change", steps: []step{
+			{at: 0, update: &devA, want: []RegistryEventType{DeviceAppeared}, keys: []string{devA.SerialNo}},
+			{at: time.Second, update: &devA, keys: []string{devA.SerialNo}},
+			{at: 2 * time.Second, update: &renamed, want: []RegistryEventType{DeviceChanged}, changes: []string{"HostName"}, keys: []string{devA.SerialNo}},
+		}},
+		{name: "expiry after 3 intervals", steps: []step{
+			{at: 0, update: &devA, want: []RegistryEventType{DeviceAppeared}, keys: []string{devA.SerialNo}},
+			{at: 2 * time.Second, keys: []string{devA.SerialNo}},
+			{at: 3 * time.Second, keys: []string{devA.SerialNo}},
+			{at: 3*time.Second + time.Millisecond, want: []RegistryEventType{DeviceDisappeared}},
+			{at: 4 * time.Second, update: &devA, want: []RegistryEventType{DeviceAppeared}, keys: []string{devA.SerialNo}},
+		}},
+		{name: "refresh postpones expiry", steps: []step{
+			{at: 0, update: &devA, want: []RegistryEventType{DeviceAppeared}, keys: []string{devA.SerialNo}},
+			{at: 2 * time.Second, update: &devA, keys: []string{devA.SerialNo}},
+			{at: 4 * time.Second, keys: []string{devA.SerialNo}},
+			{at: 5 * time.Second, keys: []string{devA.SerialNo}},
+			{at: 5*time.Second + time.Millisecond, want: []RegistryEventType{DeviceDisappeared}},
+		}},
+		{name: "keyed by MAC without serial", steps: []step{
+			{at: 0, update: &devB, want: []RegistryEventType{DeviceAppeared}, keys: []string{macB.String()}},
+			{at: 0, update: &devA, want: []RegistryEventType{DeviceAppeared}, keys: []string{macB.String(), devA.SerialNo}},
+		}},
+		{name: "duplicate serial kept apart", steps: []step{
+			{at: 0, update: &devA, want: []RegistryEventType{DeviceAppeared}, keys: []string{devA.SerialNo}},
+			{at: time.Second, update: &clone, want: []RegistryEventType{DeviceAppeared, DeviceConflict},
+				keys: []string{devA.SerialNo, devA.SerialNo + "/" + macB.String()}},
+			{at: 2 * time.Second, update: &devA, keys: []string{devA.SerialNo, devA.SerialNo + "/" + macB.String()}},
+			{at: 2 * time.Second, update: &clone, keys: []string{devA.SerialNo, devA.SerialNo + "/" + macB.String()}},
+		}},
+		{name: "serial reused after expiry", steps: []step{
+			{at: 0, update: &devA, want: []RegistryEventType{DeviceAppeared}, keys: []string{devA.SerialNo}},
+			{at: 4 * time.Second, update: &clone, want: []RegistryEventType{DeviceChanged}, changes: []string{"MAC", "HostName"}, keys: []string{devA.SerialNo}},
+		}},
+	}
+
+	start := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+
+			for idx, step := range test.steps {
+				if step.update != nil {
+					registry.Update(*step.update, start.Add(step.at))
+				} else {
+					registry.Expire(start.Add(step.at))
+				}
+
+				events := registryEvents(registry)
+
+				var types []RegistryEventType
+				for _, event := range events {
+					types = append(types, event.Type)
+
+					if event.Type == DeviceChanged && !reflect.DeepEqual(event.Changes, step.changes) {
+						t.Errorf("step %d: changes %v, want %v", idx, event.Changes, step.changes)
+					}
+				}
+
+				if !reflect.DeepEqual(types, step.want) {
+					t.Errorf("step %d: events %v, want %v", idx, types, step.want)
+				}
+
+				var keys []string
+				for _, entry := range registry.Snapshot() {
+					keys = append(keys, entry.Key)
+				}
+
+				if !reflect.DeepEqual(keys, step.keys) {
+					t.Errorf("step %d: keys %v, want %v", idx, keys, step.keys)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	macA, _ := net.ParseMAC("00:12:31:0a:4d:2b")
+	first := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	last := first.Add(2 * time.Second)
+
+	registry.Update(DiscoveredDevice{SerialNo: "c142f4c2ba8b3c9b", MAC: macA, HostName: "NVR"}, first)
+	registry.Update(DiscoveredDevice{SerialNo: "c142f4c2ba8b3c9b", MAC: macA, HostName: "NVR2"}, last)
+
+	entries := registry.Snapshot()
+	if len(entries) != 1 {
+		t.Fatalf("entries %+v", entries)
+	}
+
+	entry := entries[0]
+	if entry.Key != "c142f4c2ba8b3c9b" || entry.HostName != "NVR2" || !entry.FirstSeen.Equal(first) || !entry.LastSeen.Equal(last) {
+		t.Errorf("entry %+v", entry)
+	}
+
+	// A copy, later updates don't show through
+	registry.Update(DiscoveredDevice{SerialNo: "c142f4c2ba8b3c9b", MAC: macA, HostName: "NVR3"}, last)
+	if entry := entries[0]; entry.HostName != "NVR2" {
+		t.Errorf("snapshot updated %+v", entry)
+	}
+}
+
+func TestRegistryEventQFull(t *testing.T) {
+	registry := newTestRegistry(t)
+	now := time.Now()
+
+	// Nobody reads the event Q, publishing must not block
+	size := cap(registry.eventQ)
+	for idx := 0; idx < size+5; idx++ {
+		mac := net.HardwareAddr{0x00, 0x12, 0x31, 0x00, byte(idx >> 8), byte(idx)}
+		registry.Update(DiscoveredDevice{MAC: mac}, now)
+	}
+
+	if dropped := registry.Dropped(); dropped != 5 {
+		t.Errorf("dropped %d, want 5", dropped)
+	}
+
+	if events := registryEvents(registry); len(events) != size {
+		t.Errorf("%d events queued, want %d", len(events), size)
+	}
+
+	if entries := registry.Snapshot(); len(entries) != size+5 {
+		t.Errorf("%d entries, want %d", len(entries), size+5)
+	}
+}
@@ -0,0 +1,299 @@
+package sofia
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Largest range accepted by Scan
+const ScanMaxHosts = 1 << 20
+
+// Errors
+var (
+	ErrNotSofia = errors.New("not a sofia device")
+)
+
+// Active TCP scanner for devices behind routers
+type Scanner struct {
+	logger      *logrus.Entry // Contextual logger
+	port        string        // DVRIP port
+	timeout     time.Duration // Connect and handshake timeout
+	concurrency int           // Hosts probed in parallel
+	credentials *Credentials  // Login to fetch details, nil to skip
+}
+
+// Create a new scanner
+func NewScanner(port uint16, timeout uint16, concurrency int, logger *logrus.Logger) (*Scanner, error) {
+	if concurrency <= 0 {
+		return nil, errors.New("concurrency must be positive")
+	}
+
+	// Allocate a new scanner
+	scanner := new(Scanner)
+
+	scanner.port = strconv.Itoa(int(port))
+	scanner.timeout = time.Second * time.Duration(timeout)
+	scanner.concurrency = concurrency
+
+	// Initialize logger
+	scanner.logger = logger.WithFields(logrus.Fields{
+		"module": "Scanner",
+		"port":   scanner.port,
+	})
+
+	return scanner, nil
+}
+
+// Login with credentials to fetch SystemInfo and network settings of found devices
+func (scanner *Scanner) SetCredentials(credentials Credentials) {
+	scanner.credentials = &credentials
+}
+
+// Scan CIDR ranges (or single addresses), found devices are sent on the
+// returned channel which is closed when the scan completes or ctx is done
+func (scanner *Scanner) Scan(ctx context.Context, ranges []string) (<-chan DiscoveredDevice, error) {
+	// Parse ranges
+	var nets []*net.IPNet
+	{
+		total := 0
+		for _, cidr := range ranges {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				ip := net.ParseIP(cidr).To4()
+				if ip == nil {
+					return nil, fmt.Errorf("invalid range %q", cidr)
+				}
+				ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+			}
+
+			if ipnet.IP.To4() == nil {
+				return nil, fmt.Errorf("range %q is not IPv4", cidr)
+			}
+
+			ones, bits := ipnet.Mask.Size()
+			if total += 1 << uint(bits-ones); total > ScanMaxHosts {
+				return nil, fmt.Errorf("ranges exceed %d hosts", ScanMaxHosts)
+			}
+
+			nets = append(nets, ipnet)
+		}
+	}
+
+	results := make(chan DiscoveredDevice)
+	hosts := make(chan net.IP)
+
+	// Workers
+	var wg sync.WaitGroup
+	for idx := 0; idx < scanner.concurrency; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for ip := range hosts {
+				device, err := scanner.Probe(ctx, ip)
+				if err != nil {
+					continue
+				}
+
+				select {
+				case results <- device:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	// Feed hosts
+	go func() {
+		defer close(results)
+		defer wg.Wait()
+		defer close(hosts)
+
+		for _, ipnet := range nets {
+			first, last := hostRange(ipnet)
+			for num := first; num <= last && num >= first; num++ {
+				ip := make(net.IP, net.IPv4len)
+				binary.BigEndian.PutUint32(ip, num)
+
+				select {
+				case hosts <- ip:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return results, nil
+}
+
+// Probe a single host, ErrNotSofia if something else answers
+func (scanner *Scanner) Probe(ctx context.Context, ip net.IP) (DiscoveredDevice, error) {
+	device := DiscoveredDevice{HostIP: ip}
+	device.TCPPort, _ = parsePort(scanner.port)
+
+	addr := net.JoinHostPort(ip.String(), scanner.port)
+
+	// Handshake
+	if err := scanner.handshake(ctx, addr); err != nil {
+		return device, err
+	}
+
+	scanner.logger.Debugf("Sofia device at [%s]", addr)
+
+	if scanner.credentials == nil {
+		return device, nil
+	}
+
+	// Details
+	if err := scanner.details(ctx, ip, &device); err != nil {
+		scanner.logger.Infof("Unable to get details of [%s] [%s]", addr, err.Error())
+	}
+
+	return device, nil
+}
+
+// Lightweight handshake, an unauthenticated request that any Sofia device
+// answers with a well formed header (usually "not logged in")
+func (scanner *Scanner) handshake(ctx context.Context, addr string) error {
+	dialer := net.Dialer{Timeout: scanner.timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(scanner.timeout))
+
+	// Send request
+	{
+		data, _ := json.Marshal(CmdReqData{Name: "SystemInfo", SessionID: "0x00000000"})
+
+		buf := new(bytes.Buffer)
+		EncodeMessage(&DeviceMessage{msgId: SYSINFO_REQ, dataLen: uint32(len(data)), data: data}, buf)
+
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	// Check response header
+	hbuf := make([]byte, DeviceMessageHeaderLen)
+	if _, err := io.ReadFull(conn, hbuf); err != nil {
+		return ErrNotSofia
+	}
+
+	if !ValidMessageHeader(hbuf) {
+		return ErrNotSofia
+	}
+
+	return nil
+}
+
+// Login and fetch system info and network settings, every request is
+// bounded by the scanner timeout and the connection dropped when ctx is done
+func (scanner *Scanner) details(ctx context.Context, ip net.IP, found *DiscoveredDevice) error {
+	device, err := NewDevice(ip.String(), scanner.port, uint16(scanner.timeout/time.Second), 1, scanner.logger.Logger)
+	if err != nil {
+		return err
+	}
+
+	if err := device.Connect(); err != nil {
+		return err
+	}
+	defer device.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			device.Fail(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	session, err := device.NewSession(scanner.credentials.User, SofiaHash(scanner.credentials.Password))
+	if err != nil {
+		return err
+	}
+	session.SetRequestTimeout(scanner.timeout)
+
+	if err := session.Login(); err != nil {
+		return err
+	}
+
+	// System info
+	info, err := session.SystemInfo()
+	if err != nil {
+		return err
+	}
+
+	found.SerialNo = info.SystemInfo.SerialNo
+	found.Version = info.SystemInfo.SoftWareVersion
+	found.BuildDate = parseDeviceTime(info.SystemInfo.BuildTime)
+	found.DeviceType = info.SystemInfo.DeviceType
+
+	// Network settings
+	value, err := session.GetConfig("NetWork.NetCommon")
+	if err != nil {
+		return err
+	}
+
+	var netCommon NetCommon
+	if err := json.Unmarshal(value, &netCommon); err != nil {
+		return err
+	}
+
+	found.HostName = netCommon.HostName
+	found.MAC, _ = net.ParseMAC(netCommon.MAC)
+	found.GateWay, _ = ParseHexIP(netCommon.GateWay)
+	if mask, err := ParseHexIP(netCommon.Submask); err == nil {
+		found.Submask = net.IPMask(mask)
+	}
+	found.UDPPort = netCommon.UDPPort
+	found.HttpPort = netCommon.HttpPort
+	found.SSLPort = netCommon.SSLPort
+	found.TCPMaxConn = netCommon.TCPMaxConn
+	found.MaxBps = netCommon.MaxBps
+	found.MonMode = netCommon.MonMode
+	found.TransferPlan = netCommon.TransferPlan
+	found.UseHSDownLoad = netCommon.UseHSDownLoad
+
+	return nil
+}
+
+// First and last host address of a subnet, without network and broadcast
+// addresses
+func hostRange(ipnet *net.IPNet) (uint32, uint32) {
+	ones, bits := ipnet.Mask.Size()
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	count := uint32(1) << uint(bits-ones)
+
+	first, last := base, base+count-1
+	if count > 2 {
+		first, last = first+1, last-1
+	}
+
+	return first, last
+}
+
+// Parse a port number
+func parsePort(port string) (uint16, error) {
+	num, err := strconv.ParseUint(port, 10, 16)
+
+	return uint16(num), err
+}
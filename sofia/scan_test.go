@@ -0,0 +1,90 @@
+package sofia_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+func TestScanUnansweredRequest(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+
+	// Accepts the connection and the login, never answers the config request
+	server.InjectFault(sofiatest.FaultOn(sofia.CONFIG_GET_REQ, sofiatest.Fault{Drop: true}))
+
+	_, port, _ := net.SplitHostPort(server.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	scanner, err := sofia.NewScanner(uint16(portNum), 1, 4, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner.SetCredentials(sofia.Credentials{User: "admin"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	results, err := scanner.Scan(ctx, []string{"127.0.0.1/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []sofia.DiscoveredDevice
+	for device := range results {
+		found = append(found, device)
+	}
+
+	if ctx.Err() != nil {
+		t.Fatalf("scan didn't finish in %s", time.Since(start))
+	}
+
+	if len(found) != 1 {
+		t.Fatalf("found %d devices, want 1", len(found))
+	}
+
+	// System info was answered, the network settings weren't
+	if found[0].SerialNo != "0123456789abcdef" || len(found[0].HostName) != 0 {
+		t.Errorf("serial %q, host name %q", found[0].SerialNo, found[0].HostName)
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	scanner, err := sofia.NewScanner(34567, 1, 4, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Half a million hosts, addresses are generated as workers take them
+	ctx, cancel := context.WithCancel(context.Background())
+
+	results, err := scanner.Scan(ctx, []string{"192.0.2.0/24", "10.0.0.0/13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for range results {
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan didn't stop after cancel")
+	}
+
+	if _, err := scanner.Scan(context.Background(), []string{"10.0.0.0/8"}); err == nil {
+		t.Error("range larger than ScanMaxHosts accepted")
+	}
+}
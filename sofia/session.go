@@ -2,7 +2,10 @@ package sofia
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,15 +13,55 @@ import (
  *
  */
 type Session struct {
-	id         byte               // Session id as received from device
+	rxStats    queueCounters      // Queue counters (first for 64-bit alignment)
+	id         byte               // Session id as received from device, written with the device mutex and stateMutex held
 	idStr      string             // Session id as string
-	opaqueId   uint8              // Opaque id (used as a correlation id)
-	seqNum     uint8              // Sequence number
+	opaqueId   uint8              // Opaque id (used as a correlation id), written like id
+	seqNum     uint32             // Sequence number, accessed atomically
 	kaInterval uint32             // Keepalive interval
+	channelNum int                // Number of channels
+	extraChan  int                // Number of extra (digital) channels
+	titleEnc   int                // Channel title encoding, learned from ChannelTitles
 	user       string             // Username
 	password   string             // Password
-	rxChan     chan DeviceMessage // Channel for receiving messages
+	rxChan     chan DeviceMessage // Channel for receiving messages, bounded
+	rxPolicy   QueuePolicy        // Overflow policy of rxChan
 	device     *Device            // Device instance
+	kaStop     chan struct{}      // Closed to stop the keepalive task
+	kaMsgId    uint16             // Keepalive message ID the device answers, 0 until detected
+	kaMaxMiss  int                // Consecutive missed keepalives before the session is dead
+	kaStats    KeepAliveStats     // Keepalive health
+	kaMutex    sync.Mutex         // Protects kaMsgId and kaStats
+	restore    []RestoreFunc      // Run after the session is logged in again
+	reqTimeout time.Duration      // Time allowed for a response to a request, 0 for ever
+	resetting  bool               // Connection lost, waiting for the supervisor to login again
+	closed     bool               // Closed by Close
+	stateMutex sync.RWMutex       // Protects idStr, kaInterval, channelNum, extraChan, titleEnc, kaStop, reqTimeout, resetting and closed
+	busy       chan struct{}      // Holds a token while a request is in progress, serializes requests
+}
+
+// Time allowed for the device to answer a login, logout or request
+const (
+	LoginTimeout       = 15 * time.Second
+	LogoutTimeout      = 5 * time.Second
+	CloseLogoutTimeout = time.Second // Logout while the device is closing
+	RequestTimeout     = 15 * time.Second
+)
+
+// Errors
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrNotLoggedIn   = errors.New("session not logged in")
+	ErrSessionBusy   = errors.New("session busy with another request")
+)
+
+// Restores session state (alarm subscriptions, streams) after a reconnect
+type RestoreFunc func(session *Session) error
+
+// Login credentials
+type Credentials struct {
+	User     string // Username
+	Password string // Password (plain text)
 }
 
 /*
@@ -34,6 +77,9 @@ func NewSession(device *Device, localId uint8, user string, password string) *Se
 		session.opaqueId = localId
 		session.seqNum = 0
 		session.kaInterval = 0
+		session.kaMaxMiss = KeepAliveMaxMisses
+		session.reqTimeout = RequestTimeout
+		session.busy = make(chan struct{}, 1)
 	}
 
 	// Save username and password
@@ -49,7 +95,13 @@ func NewSession(device *Device, localId uint8, user string, password string) *Se
 
 	// Initialize worker message bus
 	{
-		session.rxChan = make(chan DeviceMessage)
+		length := device.queueLen
+		if length <= 0 {
+			length = SessionQueueLen
+		}
+
+		session.rxChan = make(chan DeviceMessage, length)
+		session.rxPolicy = device.queuePolicy
 	}
 
 	// Save device context
@@ -60,45 +112,227 @@ func NewSession(device *Device, localId uint8, user string, password string) *Se
 	return session
 }
 
+// Session id string of the current login, empty when not logged in. The
+// supervisor changes it on relogin.
+func (session *Session) sessionID() string {
+	session.stateMutex.RLock()
+	defer session.stateMutex.RUnlock()
+
+	return session.idStr
+}
+
 /*
  *
  */
 func DeleteSession(session *Session) {
-	// Close channel
-	close(session.rxChan)
+	session.Close()
 }
 
-// Keepalive task
-func (session *Session) keepAliveTask() {
-	session.device.logger.Info("Starting KA task for session ", session.idStr)
-
-	// Create a ticker
-	ticker := time.NewTicker(time.Second * time.Duration(session.kaInterval))
+// Time allowed for the device to answer a request, RequestTimeout by default,
+// 0 to wait for ever. Login and logout have their own timeouts.
+func (session *Session) SetRequestTimeout(timeout time.Duration) {
+	session.stateMutex.Lock()
+	session.reqTimeout = timeout
+	session.stateMutex.Unlock()
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			// Send a keep alive message
-			if err := session.KeepAlive(); err != nil {
-				return
-			}
-		}
-	}
+// Register a function run after the session is logged in again by a
+// supervised device, in registration order
+func (session *Session) OnRestore(fn RestoreFunc) {
+	session.restore = append(session.restore, fn)
 }
 
 // Build message
 func (session *Session) BuildMessage(msgId uint16, data []byte) DeviceMessage {
+	session.stateMutex.RLock()
+	defer session.stateMutex.RUnlock()
+
 	return DeviceMessage{
 		msgId:     msgId,
 		opaqueId:  session.opaqueId,
 		version:   0,
 		sessionId: session.id,
-		seqNum:    session.seqNum,
+		seqNum:    uint8(atomic.LoadUint32(&session.seqNum)),
 		dataLen:   uint32(len(data)),
 		data:      data,
 	}
 }
 
+// Send a request and wait for the response
+func (session *Session) request(msgId uint16, data interface{}) (DeviceMessage, error) {
+	// Marshall data as JSON
+	mdata, err := json.Marshal(data)
+	if err != nil {
+		return DeviceMessage{}, err
+	}
+
+	return session.requestRaw(msgId, mdata)
+}
+
+// Send a request with raw payload and wait for the response, which carries
+// the request ID plus one. Late responses of other requests are discarded.
+func (session *Session) requestRaw(msgId uint16, data []byte) (DeviceMessage, error) {
+	session.stateMutex.RLock()
+	timeout := session.reqTimeout
+	session.stateMutex.RUnlock()
+
+	return session.exchange(msgId, data, timeout, func(resId uint16) bool {
+		return resId == msgId+1
+	})
+}
+
+// Send a request and wait up to timeout (0 for ever) for a response accepted
+// by accept (nil for any). Requests of a session are serialized so the
+// keepalive task and callers don't read each other's responses.
+func (session *Session) exchange(msgId uint16, data []byte, timeout time.Duration, accept func(msgId uint16) bool) (DeviceMessage, error) {
+	if err := session.acquire(0); err != nil {
+		return DeviceMessage{}, err
+	}
+	defer session.release()
+
+	return session.roundTrip(msgId, data, timeout, accept)
+}
+
+// Wait up to wait (0 for ever) for the request in progress to complete and
+// hold the session for a request, ErrSessionBusy if it didn't complete
+func (session *Session) acquire(wait time.Duration) error {
+	if wait <= 0 {
+		session.busy <- struct{}{}
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case session.busy <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrSessionBusy
+	}
+}
+
+// Release the session held by acquire
+func (session *Session) release() {
+	<-session.busy
+}
+
+// Send a request and wait for its response, the session must be held
+func (session *Session) roundTrip(msgId uint16, data []byte, timeout time.Duration, accept func(msgId uint16) bool) (DeviceMessage, error) {
+	session.stateMutex.RLock()
+	closed := session.closed
+	session.stateMutex.RUnlock()
+
+	if closed {
+		return DeviceMessage{}, ErrSessionClosed
+	}
+
+	// A closing device only lets logouts through
+	closing := session.device.closing
+	if msgId == LOGOUT_REQ {
+		closing = nil
+	}
+
+	select {
+	case <-closing:
+		return DeviceMessage{}, ErrDeviceClosed
+	default:
+	}
+
+	// The device never answers requests of a session it doesn't know, only
+	// a login may be sent before the session is logged in
+	if msgId != LOGIN_REQ2 {
+		if err := session.loggedIn(); err != nil {
+			return DeviceMessage{}, err
+		}
+	}
+
+	// Discard responses that arrived after their request timed out
+	for drained := false; !drained; {
+		select {
+		case msg := <-session.rxChan:
+			session.device.logger.Debug("Discarded stale message [", msg.msgId, "]")
+		default:
+			drained = true
+		}
+	}
+
+	// Build message
+	msg := session.BuildMessage(msgId, data)
+
+	// Send message to device
+	lost, err := session.device.send(&msg)
+	if err != nil {
+		return DeviceMessage{}, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// Receive message from device
+	for {
+		select {
+		case resMsg := <-session.rxChan:
+			if accept == nil || accept(resMsg.msgId) {
+				return resMsg, nil
+			}
+			session.device.logger.Debug("Discarded unexpected message [", resMsg.msgId, "]")
+		case <-lost:
+			return DeviceMessage{}, ErrNotConnected
+		case <-closing:
+			return DeviceMessage{}, ErrDeviceClosed
+		case <-expired:
+			return DeviceMessage{}, ErrTimeout
+		}
+	}
+}
+
+// Nil if requests may be sent, ErrNotConnected while the supervisor logs in
+// again after a reconnect, ErrNotLoggedIn before Login
+func (session *Session) loggedIn() error {
+	session.stateMutex.RLock()
+	defer session.stateMutex.RUnlock()
+
+	if session.resetting {
+		return ErrNotConnected
+	}
+
+	if len(session.idStr) == 0 {
+		return ErrNotLoggedIn
+	}
+
+	return nil
+}
+
+// Send a request, check the return code and unmarshall the response into res
+func (session *Session) command(msgId uint16, data interface{}, res interface{}) error {
+	resMsg, err := session.request(msgId, data)
+	if err != nil {
+		return err
+	}
+
+	// Check return code
+	var resData CmdResData2
+	if err := json.Unmarshal(resMsg.data, &resData); err != nil {
+		return err
+	}
+
+	if err := CheckRet(resData.Ret); err != nil {
+		return err
+	}
+
+	// Unmarshall response data
+	if res != nil {
+		return json.Unmarshal(resMsg.data, res)
+	}
+
+	return nil
+}
+
 // Login to device
 func (session *Session) Login() error {
 	// Data for login
@@ -109,17 +343,21 @@ func (session *Session) Login() error {
 		UserName:    session.user,
 	}
 
+	// Local id may have been reclaimed
+	if err := session.device.pendingLogin(session); err != nil {
+		return err
+	}
+
 	// Marshall data as JSON
 	mdata, _ := json.Marshal(data)
 
-	// Build message
-	msg := session.BuildMessage(LOGIN_REQ2, mdata)
-
-	// Send message to device
-	session.device.SendMessage(&msg)
-
-	// Receive message from device
-	resMsg := <-session.rxChan
+	// Send message to device and receive response
+	resMsg, err := session.exchange(LOGIN_REQ2, mdata, LoginTimeout, func(resId uint16) bool {
+		return resId == LOGIN_RSP
+	})
+	if err != nil {
+		return err
+	}
 
 	// Unmarshall response data
 	var resData LoginResData
@@ -128,45 +366,115 @@ func (session *Session) Login() error {
 		return err
 	}
 
+	if err := CheckRet(resData.Ret); err != nil {
+		session.device.logger.Errorf("Login failed for session 0x%X [%s]", resMsg.sessionId, err.Error())
+
+		// Not logged in, another Login registers again
+		session.device.DeleteSession(session)
+		return err
+	}
+
+	session.stateMutex.Lock()
 	session.kaInterval = resData.AliveInterval
 	session.idStr = resData.SessionID
+	session.channelNum = resData.ChannelNum
+	session.extraChan = resData.ExtraChannel
+	session.stateMutex.Unlock()
 	fmt.Printf("Login success for session %s\n", resData.SessionID)
 
 	// Start KA task
-	go session.keepAliveTask()
+	session.startKeepAlive()
 
 	return nil
 }
 
-// Session keep-alive
-func (session *Session) KeepAlive() error {
-	// Data for keepalive
-	data := KeepAliveReqData{
-		Name:      "KeepAlive",
-		SessionID: session.idStr,
-	}
+// Logout from device, stops the keepalive task
+func (session *Session) Logout() error {
+	session.stopKeepAlive()
 
-	// Marshall data as JSON
-	mdata, _ := json.Marshal(data)
+	if err := session.acquire(0); err != nil {
+		return err
+	}
+	defer session.release()
 
-	// Build message
-	msg := session.BuildMessage(KEEPALIVE_REQ, mdata)
+	return session.logout(LogoutTimeout)
+}
 
-	// Send message to device
-	if err := session.device.SendMessage(&msg); err != nil {
+// Logout waiting up to timeout for the response, the session must be held
+func (session *Session) logout(timeout time.Duration) error {
+	// Data for logout
+	data, _ := json.Marshal(CmdReqData{
+		Name:      "",
+		SessionID: session.sessionID(),
+	})
+
+	// Send message to device and receive response
+	resMsg, err := session.roundTrip(LOGOUT_REQ, data, timeout, func(resId uint16) bool {
+		return resId == LOGOUT_RSP
+	})
+	if err != nil {
 		return err
 	}
 
-	// Receive message from device
-	resMsg := <-session.rxChan
-
 	// Unmarshall response data
-	var resData KeepAliveResData
+	var resData CmdResData
 	if err := json.Unmarshal(resMsg.data, &resData); err != nil {
 		return err
 	}
 
-	return nil
+	return CheckRet(resData.Ret)
+}
+
+// Logout if logged in and remove session from device, the session can't be
+// used afterwards
+func (session *Session) Close() error {
+	session.stateMutex.RLock()
+	closed := session.closed
+	session.stateMutex.RUnlock()
+
+	if closed {
+		return nil
+	}
+
+	var err error
+	if len(session.sessionID()) > 0 {
+		err = session.Logout()
+	}
+
+	session.stopKeepAlive()
+
+	session.stateMutex.Lock()
+	session.closed = true
+	session.stateMutex.Unlock()
+
+	session.device.DeleteSession(session)
+
+	return err
+}
+
+// Close the session of a closing device. Pending requests already failed,
+// a session still busy with one isn't logged out and the logout is bounded
+// by CloseLogoutTimeout.
+func (session *Session) abandon() {
+	session.stopKeepAlive()
+
+	select {
+	case session.busy <- struct{}{}:
+		if len(session.sessionID()) > 0 {
+			if err := session.logout(CloseLogoutTimeout); err != nil {
+				session.device.logger.Debug("Unable to logout session ", session.sessionID(), " [", err.Error(), "]")
+			}
+		}
+		session.release()
+	default:
+		session.device.logger.Debug("Session ", session.sessionID(), " busy, not logged out")
+	}
+
+	session.stateMutex.Lock()
+	session.closed = true
+	session.stateMutex.Unlock()
+
+	session.device.DeleteSession(session)
 }
 
 // System Info
@@ -174,22 +482,16 @@ func (session *Session) SysInfo() error {
 	// Data for sysinfo
 	data := CmdReqData{
 		Name:      "SystemInfo",
-		SessionID: session.idStr,
+		SessionID: session.sessionID(),
 	}
 
-	// Marshall data as JSON
-	mdata, _ := json.Marshal(data)
-
-	// Build message
-	msg := session.BuildMessage(SYSINFO_REQ, mdata)
-
-	// Send message to device
-	session.device.SendMessage(&msg)
-
-	// Receive message from device
-	resMsg := <-session.rxChan
+	// Send message to device and receive response
+	resMsg, err := session.request(SYSINFO_REQ, data)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("[%s] SysInfo %d bytes\n", session.idStr, resMsg.dataLen)
+	fmt.Printf("[%s] SysInfo %d bytes\n", session.sessionID(), resMsg.dataLen)
 
 	var x map[string]interface{}
 	json.Unmarshal(resMsg.data, &x)
@@ -203,22 +505,16 @@ func (session *Session) SysAbilities() error {
 	// Data for sysinfo
 	data := CmdReqData{
 		Name:      "SystemFunction",
-		SessionID: session.idStr,
+		SessionID: session.sessionID(),
 	}
 
-	// Marshall data as JSON
-	mdata, _ := json.Marshal(data)
-
-	// Build message
-	msg := session.BuildMessage(ABILITY_REQ, mdata)
-
-	// Send message to device
-	session.device.SendMessage(&msg)
-
-	// Receive message from device
-	resMsg := <-session.rxChan
+	// Send message to device and receive response
+	resMsg, err := session.request(ABILITY_REQ, data)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("[%s] System Abilities %d bytes\n", session.idStr, resMsg.dataLen)
+	fmt.Printf("[%s] System Abilities %d bytes\n", session.sessionID(), resMsg.dataLen)
 
 	var x map[string]interface{}
 	json.Unmarshal(resMsg.data, &x)
@@ -232,22 +528,16 @@ func (session *Session) SysOEMInfo() error {
 	// Data for sysinfo
 	data := CmdReqData{
 		Name:      "OEMInfo",
-		SessionID: session.idStr,
+		SessionID: session.sessionID(),
 	}
 
-	// Marshall data as JSON
-	mdata, _ := json.Marshal(data)
-
-	// Build message
-	msg := session.BuildMessage(SYSINFO_REQ, mdata)
-
-	// Send message to device
-	session.device.SendMessage(&msg)
-
-	// Receive message from device
-	resMsg := <-session.rxChan
+	// Send message to device and receive response
+	resMsg, err := session.request(SYSINFO_REQ, data)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("[%s] System OEM info %d bytes\n", session.idStr, resMsg.dataLen)
+	fmt.Printf("[%s] System OEM info %d bytes\n", session.sessionID(), resMsg.dataLen)
 
 	var x map[string]interface{}
 	json.Unmarshal(resMsg.data, &x)
@@ -260,22 +550,16 @@ func (session *Session) SysOEMInfo() error {
 func (session *Session) SysAuthorityList() error {
 	// Data for sysinfo
 	data := CmdReqData2{
-		SessionID: session.idStr,
+		SessionID: session.sessionID(),
 	}
 
-	// Marshall data as JSON
-	mdata, _ := json.Marshal(data)
-
-	// Build message
-	msg := session.BuildMessage(FULLAUTHORITYLIST_GET, mdata)
-
-	// Send message to device
-	session.device.SendMessage(&msg)
-
-	// Receive message from device
-	resMsg := <-session.rxChan
+	// Send message to device and receive response
+	resMsg, err := session.request(FULLAUTHORITYLIST_GET, data)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("[%s] Full authorities list %d bytes\n", session.idStr, resMsg.dataLen)
+	fmt.Printf("[%s] Full authorities list %d bytes\n", session.sessionID(), resMsg.dataLen)
 
 	/*
 		var x map[string]interface{}
@@ -289,3 +573,19 @@ func (session *Session) SysAuthorityList() error {
 
 	return nil
 }
+
+// System info (typed)
+func (session *Session) SystemInfo() (SystemInfo, error) {
+	var info SystemInfo
+	err := session.command(SYSINFO_REQ, CmdReqData{Name: "SystemInfo", SessionID: session.sessionID()}, &info)
+
+	return info, err
+}
+
+// System OEM info (typed)
+func (session *Session) OEMInfo() (OEMInfo, error) {
+	var info OEMInfo
+	err := session.command(SYSINFO_REQ, CmdReqData{Name: "OEMInfo", SessionID: session.sessionID()}, &info)
+
+	return info, err
+}
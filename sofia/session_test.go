@@ -0,0 +1,116 @@
+package sofia_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+// Run with -race, sessions of one device login, send requests and logout
+// concurrently while the worker maps their responses
+func TestConcurrentSessions(t *testing.T) {
+	const sessions = 8
+	const requests = 10
+
+	server := startServer(t, sofiatest.Config{})
+	device := connectDevice(t, server, nil, nil)
+
+	errs := make(chan error, sessions)
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < sessions; idx++ {
+		session := newSession(t, device, "admin", "")
+		session.SetRequestTimeout(5 * time.Second)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer session.Close()
+
+			if err := session.Login(); err != nil {
+				errs <- err
+				return
+			}
+
+			for req := 0; req < requests; req++ {
+				info, err := session.SystemInfo()
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if info.SystemInfo.SerialNo != "0123456789abcdef" {
+					t.Errorf("serial %q", info.SystemInfo.SerialNo)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if logins := countRequests(server, sofia.LOGIN_REQ2); logins != sessions {
+		t.Errorf("%d logins, want %d", logins, sessions)
+	}
+}
+
+// Run with -race, the supervisor resets and logs in again sessions that are
+// sending requests
+func TestConcurrentSessionsReconnect(t *testing.T) {
+	const sessions = 8
+
+	server := startServer(t, sofiatest.Config{})
+
+	device, _ := supervisedSession(t, server, sofia.ReconnectPolicy{MinDelay: 10 * time.Millisecond, Factor: 1})
+
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < sessions; idx++ {
+		session := loginSession(t, device)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// Fails while the session is reset
+				session.SystemInfo()
+			}
+		}()
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		time.Sleep(50 * time.Millisecond)
+		server.DisconnectAll()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests blocked after reconnects")
+	}
+}
@@ -0,0 +1,188 @@
+package sofiatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+
+	"sofia-go/sofia"
+)
+
+// Answer IPSEARCH_REQ and IP_SET_REQ on a UDP address, e.g. "127.0.0.1:0" or
+// ":34569". Responses go to the sender and use the NetWork.NetCommon fixture,
+// which IP_SET_REQ updates. Like a device, IP_SET_REQ for another MAC is
+// ignored.
+func (server *Server) StartDiscovery(address string) error {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return err
+	}
+
+	server.mutex.Lock()
+	server.udp = conn
+	server.mutex.Unlock()
+
+	server.wg.Add(1)
+	go server.discovery(conn)
+
+	return nil
+}
+
+// Discovery socket address
+func (server *Server) DiscoveryAddr() *net.UDPAddr {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.udp == nil {
+		return nil
+	}
+
+	return server.udp.LocalAddr().(*net.UDPAddr)
+}
+
+// Discovery task
+func (server *Server) discovery(conn *net.UDPConn) {
+	defer server.wg.Done()
+
+	buf := make([]byte, 1500)
+
+	for {
+		rlen, raddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		req, err := readFrame(bytes.NewReader(buf[:rlen]))
+		if err != nil {
+			server.logger.Debug("Malformed discovery request from [", raddr, "]")
+			continue
+		}
+
+		server.mutex.Lock()
+		server.requests = append(server.requests, req)
+		faults := server.faults
+		server.mutex.Unlock()
+
+		var fault Fault
+		for _, fn := range faults {
+			if fault = fn(req); fault.Drop || fault.Raw != nil {
+				break
+			}
+		}
+
+		if fault.Drop {
+			continue
+		}
+
+		if fault.Raw != nil {
+			conn.WriteToUDP(fault.Raw, raddr)
+			continue
+		}
+
+		var res Frame
+		switch req.MsgID {
+		case sofia.IPSEARCH_REQ:
+			res = server.ipSearch()
+		case sofia.IP_SET_REQ:
+			var ok bool
+			if res, ok = server.ipSet(req); !ok {
+				continue
+			}
+		default:
+			continue
+		}
+
+		conn.WriteToUDP(res.Bytes(), raddr)
+	}
+}
+
+// IPSEARCH_RSP
+func (server *Server) ipSearch() Frame {
+	netCommon, _ := server.Fixture("NetWork.NetCommon")
+
+	mdata, _ := json.Marshal(map[string]interface{}{
+		"Name":              "NetWork.NetCommon",
+		"NetWork.NetCommon": netCommon,
+		"Ret":               sofia.RetOK,
+		"SessionID":         "0x00000000",
+	})
+
+	return Frame{MsgID: sofia.IPSEARCH_RSP, Data: mdata}
+}
+
+// IP_SET_RSP, applies addresses of the request when credentials match. False
+// when the request targets another MAC.
+func (server *Server) ipSet(req Frame) (Frame, bool) {
+	ret := uint32(sofia.RetOK)
+
+	var reqData struct {
+		NetCommon map[string]json.RawMessage `json:"NetWork.NetCommon"`
+		Password  string
+		UserName  string
+	}
+
+	switch {
+	case json.Unmarshal(req.Data, &reqData) != nil:
+		ret = sofia.RetIllegalRequest
+	case !server.targetMAC(reqData.NetCommon["MAC"]):
+		return Frame{}, false
+	case reqData.UserName != server.config.User:
+		ret = sofia.RetUserNotExist
+	case reqData.Password != sofia.SofiaHash(server.config.Password):
+		ret = sofia.RetBadPassword
+	}
+
+	if ret == sofia.RetOK {
+		var netCommon map[string]json.RawMessage
+		fixture, _ := server.Fixture("NetWork.NetCommon")
+		json.Unmarshal(fixture, &netCommon)
+
+		if netCommon == nil {
+			netCommon = make(map[string]json.RawMessage)
+		}
+
+		for _, key := range []string{"HostIP", "Submask", "GateWay"} {
+			if value, ok := reqData.NetCommon[key]; ok {
+				netCommon[key] = value
+			}
+		}
+
+		fixture, _ = json.Marshal(netCommon)
+		server.SetFixture("NetWork.NetCommon", fixture)
+	}
+
+	mdata, _ := json.Marshal(map[string]interface{}{
+		"Name":      "NetWork.NetCommon",
+		"Ret":       ret,
+		"SessionID": "0x00000000",
+	})
+
+	return Frame{MsgID: sofia.IP_SET_RSP, Data: mdata}, true
+}
+
+// Is mac (a JSON string) the MAC of the NetWork.NetCommon fixture
+func (server *Server) targetMAC(mac json.RawMessage) bool {
+	var fixture struct {
+		MAC string
+	}
+
+	netCommon, _ := server.Fixture("NetWork.NetCommon")
+	json.Unmarshal(netCommon, &fixture)
+
+	var target string
+	json.Unmarshal(mac, &target)
+
+	own, err := net.ParseMAC(fixture.MAC)
+	if err != nil {
+		return false
+	}
+
+	other, err := net.ParseMAC(target)
+
+	return err == nil && bytes.Equal(own, other)
+}
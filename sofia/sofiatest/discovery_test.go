@@ -0,0 +1,101 @@
+package sofiatest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+)
+
+func TestIPSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		mac     string
+		ret     uint32
+		answer  bool
+		applied bool
+	}{
+		{name: "target MAC", mac: "00:12:41:6a:6b:6c", ret: sofia.RetOK, answer: true, applied: true},
+		{name: "target MAC, other case", mac: "00:12:41:6A:6B:6C", ret: sofia.RetOK, answer: true, applied: true},
+		{name: "other MAC", mac: "00:12:41:00:00:01"},
+		{name: "no MAC"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer(Config{})
+			defer server.Close()
+
+			if err := server.StartDiscovery("127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := net.DialUDP("udp4", nil, server.DiscoveryAddr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			netCommon := map[string]string{"HostIP": "0x6401A8C0"}
+			if len(test.mac) > 0 {
+				netCommon["MAC"] = test.mac
+			}
+
+			mdata, _ := json.Marshal(map[string]interface{}{
+				"Name":              "NetWork.NetCommon",
+				"NetWork.NetCommon": netCommon,
+				"Password":          sofia.SofiaHash(""),
+				"UserName":          "admin",
+			})
+
+			if _, err := conn.Write(requestBytes(Frame{MsgID: sofia.IP_SET_REQ, Data: mdata})); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+			buf := make([]byte, 1500)
+			rlen, err := conn.Read(buf)
+			if answered := err == nil; answered != test.answer {
+				t.Fatalf("answered %v [%v], want %v", answered, err, test.answer)
+			}
+
+			if test.answer {
+				res, err := ReadFrame(bytes.NewReader(buf[:rlen]))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var resData sofia.CmdResData2
+				json.Unmarshal(res.Data, &resData)
+
+				if res.MsgID != sofia.IP_SET_RSP || resData.Ret != test.ret {
+					t.Errorf("response [%d] Ret %d", res.MsgID, resData.Ret)
+				}
+			}
+
+			var fixture struct{ HostIP string }
+			value, _ := server.Fixture("NetWork.NetCommon")
+			json.Unmarshal(value, &fixture)
+
+			if applied := fixture.HostIP == "0x6401A8C0"; applied != test.applied {
+				t.Errorf("host IP %s", fixture.HostIP)
+			}
+		})
+	}
+}
+
+// Encode a request as clients do, the trailer isn't counted in the data length
+func requestBytes(frame Frame) []byte {
+	data := frame.Data
+	frame.Data = nil
+
+	buf := frame.Bytes()
+	binary.LittleEndian.PutUint32(buf[sofia.DeviceMessageOffsetDataLen:], uint32(len(data)))
+
+	return append(append(buf, data...), 0x0A, 0x00)
+}
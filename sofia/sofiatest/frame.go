@@ -0,0 +1,124 @@
+package sofiatest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"sofia-go/sofia"
+)
+
+// Errors
+var (
+	ErrBadFrame = errors.New("sofiatest: malformed frame")
+)
+
+// DVRIP frame as seen by the device, unlike sofia.DeviceMessage the login
+// correlation id is kept for every message
+type Frame struct {
+	Version   byte   // Version, usually 0
+	SessionID byte   // Session ID
+	SeqNum    byte   // Sequence number
+	OpaqueID  byte   // Login correlation id (first byte of unknown field 2)
+	MsgID     uint16 // Message ID
+	Data      []byte // Payload, without trailer
+}
+
+// Read a frame sent by a device, JSON payloads carry a trailer counted in
+// the data length
+func ReadFrame(r io.Reader) (Frame, error) {
+	frame, err := readFrame(r)
+	if err != nil {
+		return frame, err
+	}
+
+	frame.Data = sofia.TrimMessagePayload(frame.MsgID, frame.Data)
+
+	return frame, nil
+}
+
+// Read a frame sent by a client, always followed by a trailer not counted in
+// the data length
+func ReadRequest(r io.Reader) (Frame, error) {
+	frame, err := readFrame(r)
+	if err != nil {
+		return frame, err
+	}
+
+	trailer := make([]byte, sofia.DeviceMessageTrailerLen)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return frame, err
+	}
+
+	return frame, nil
+}
+
+// Read header and data
+func readFrame(r io.Reader) (Frame, error) {
+	var frame Frame
+
+	hbuf := make([]byte, sofia.DeviceMessageHeaderLen)
+	if _, err := io.ReadFull(r, hbuf); err != nil {
+		return frame, err
+	}
+
+	if !sofia.ValidMessageHeader(hbuf) {
+		return frame, ErrBadFrame
+	}
+
+	frame.Version = hbuf[sofia.DeviceMessageOffsetVersion]
+	frame.SessionID = hbuf[sofia.DeviceMessageOffsetSessionId]
+	frame.SeqNum = hbuf[sofia.DeviceMessageOffsetSeqNum]
+	frame.OpaqueID = hbuf[sofia.DeviceMessageOffsetOpaqueId]
+	frame.MsgID = binary.LittleEndian.Uint16(hbuf[sofia.DeviceMessageOffsetMsgId:])
+
+	frame.Data = make([]byte, binary.LittleEndian.Uint32(hbuf[sofia.DeviceMessageOffsetDataLen:]))
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		return frame, err
+	}
+
+	return frame, nil
+}
+
+// Encode a frame as sent by devices, JSON payloads get a trailer counted in
+// the data length
+func (frame Frame) Bytes() []byte {
+	data := frame.Data
+	if frame.MsgID != sofia.MONITOR_DATA && len(data) > 0 && (data[0] == '{' || data[0] == '[') {
+		data = append(append([]byte{}, data...), 0x0A, 0x00)
+	}
+
+	buf := make([]byte, sofia.DeviceMessageHeaderLen, sofia.DeviceMessageHeaderLen+len(data))
+	buf[0] = 0xFF
+	buf[sofia.DeviceMessageOffsetVersion] = frame.Version
+	buf[sofia.DeviceMessageOffsetSessionId] = frame.SessionID
+	buf[sofia.DeviceMessageOffsetSeqNum] = frame.SeqNum
+	buf[sofia.DeviceMessageOffsetOpaqueId] = frame.OpaqueID
+	binary.LittleEndian.PutUint16(buf[sofia.DeviceMessageOffsetMsgId:], frame.MsgID)
+	binary.LittleEndian.PutUint32(buf[sofia.DeviceMessageOffsetDataLen:], uint32(len(data)))
+
+	return append(buf, data...)
+}
+
+// Frame with an invalid header flag
+func MalformedFrame() []byte {
+	buf := Frame{MsgID: sofia.SYSINFO_RSP}.Bytes()
+	buf[0] = 0xFE
+
+	return buf
+}
+
+// Frame header announcing more data than any device sends
+func OversizedFrame() []byte {
+	buf := Frame{MsgID: sofia.SYSINFO_RSP}.Bytes()
+	binary.LittleEndian.PutUint32(buf[sofia.DeviceMessageOffsetDataLen:], sofia.DeviceMessageMaxDataLen+1)
+
+	return buf
+}
+
+// Frame cut short after its header
+func TruncatedFrame() []byte {
+	buf := Frame{MsgID: sofia.SYSINFO_RSP, Data: []byte(`{"Ret":100}`)}.Bytes()
+
+	return buf[:sofia.DeviceMessageHeaderLen+4]
+}
@@ -0,0 +1,194 @@
+package sofiatest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sofia-go/sofia"
+)
+
+// Media stream bytes per MONITOR_DATA message at most
+const MediaChunkLen = 8192
+
+// Video defaults
+const (
+	VideoWidth  = 1280
+	VideoHeight = 720
+	VideoFPS    = 25
+)
+
+// Errors
+var (
+	ErrNoVideoFrames = errors.New("sofiatest: no video frames in stream")
+)
+
+// Video streamed to monitor claims
+type Video struct {
+	Codec  byte // sofia.MediaH264 or sofia.MediaH265
+	Width  int  // Width announced in I-frames, default VideoWidth, at most 2040
+	Height int  // Height announced in I-frames, default VideoHeight, at most 2040
+	FPS    int  // Frame rate of metadata and pacing, default VideoFPS
+
+	frames []videoFrame // Access units
+}
+
+// Access unit of an elementary stream
+type videoFrame struct {
+	key  bool   // Starts a group of pictures (IDR, parameter sets)
+	data []byte // NAL units with 4 byte start codes
+}
+
+// Video from an H.264 or H.265 Annex B elementary stream
+func NewVideo(codec byte, stream []byte) (*Video, error) {
+	if codec != sofia.MediaH264 && codec != sofia.MediaH265 {
+		return nil, fmt.Errorf("sofiatest: unsupported codec %d", codec)
+	}
+
+	frames := splitAccessUnits(codec, stream)
+	if len(frames) == 0 {
+		return nil, ErrNoVideoFrames
+	}
+
+	return &Video{
+		Codec:  codec,
+		Width:  VideoWidth,
+		Height: VideoHeight,
+		FPS:    VideoFPS,
+		frames: frames,
+	}, nil
+}
+
+// Video from an elementary stream file, the codec is told by the extension:
+// .h264, .264 or .avc for H.264, .h265, .265 or .hevc for H.265
+func LoadVideo(file string) (*Video, error) {
+	var codec byte
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".h264", ".264", ".avc":
+		codec = sofia.MediaH264
+	case ".h265", ".265", ".hevc":
+		codec = sofia.MediaH265
+	default:
+		return nil, fmt.Errorf("sofiatest: unknown codec of %s", file)
+	}
+
+	stream, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewVideo(codec, stream)
+}
+
+// Number of access units
+func (video *Video) Frames() int {
+	return len(video.frames)
+}
+
+// Media frame of access unit i
+func (video *Video) mediaFrame(i int, t time.Time) sofia.MediaFrame {
+	frame := video.frames[i]
+
+	if !frame.key {
+		return sofia.MediaFrame{Type: sofia.MediaPFrame, Data: frame.data}
+	}
+
+	return sofia.MediaFrame{
+		Type:   sofia.MediaIFrame,
+		Media:  video.Codec,
+		FPS:    byte(video.FPS),
+		Width:  video.Width,
+		Height: video.Height,
+		Time:   t,
+		Data:   frame.data,
+	}
+}
+
+// Check the metadata fits media frame headers
+func (video *Video) Validate() error {
+	switch {
+	case len(video.frames) == 0:
+		return ErrNoVideoFrames
+	case video.Width <= 0 || video.Width > 255*8 || video.Height <= 0 || video.Height > 255*8:
+		return fmt.Errorf("sofiatest: unsupported resolution %dx%d", video.Width, video.Height)
+	case video.FPS <= 0 || video.FPS > 255:
+		return fmt.Errorf("sofiatest: unsupported frame rate %d", video.FPS)
+	}
+
+	return nil
+}
+
+// Split an Annex B stream into NAL units, without start codes
+func splitNALUnits(stream []byte) [][]byte {
+	var units [][]byte
+
+	start := -1
+	for i := 0; i+3 <= len(stream); {
+		if stream[i] != 0 || stream[i+1] != 0 || stream[i+2] != 1 {
+			i++
+			continue
+		}
+
+		if start >= 0 {
+			units = append(units, bytes.TrimRight(stream[start:i], "\x00"))
+		}
+
+		i += 3
+		start = i
+	}
+
+	if start >= 0 && start < len(stream) {
+		units = append(units, stream[start:])
+	}
+
+	return units
+}
+
+// Group NAL units into access units. A frame starts with parameter sets,
+// delimiters or prefix SEI following a picture, or with the first slice of
+// the next picture.
+func splitAccessUnits(codec byte, stream []byte) []videoFrame {
+	var frames []videoFrame
+	var frame videoFrame
+	var vcl bool
+
+	for _, unit := range splitNALUnits(stream) {
+		if len(unit) < 3 {
+			continue
+		}
+
+		var isVcl, isKey, first, prefix bool
+		if codec == sofia.MediaH264 {
+			nalType := unit[0] & 0x1F
+			isVcl = nalType >= 1 && nalType <= 5
+			isKey = nalType == 5 || nalType == 7
+			first = isVcl && unit[1]&0x80 != 0 // first_mb_in_slice is 0
+			prefix = nalType == 6 || (nalType >= 7 && nalType <= 9) || (nalType >= 14 && nalType <= 18)
+		} else {
+			nalType := unit[0] >> 1 & 0x3F
+			isVcl = nalType <= 31
+			isKey = (nalType >= 16 && nalType <= 23) || nalType == 32
+			first = isVcl && unit[2]&0x80 != 0 // first_slice_segment_in_pic_flag
+			prefix = (nalType >= 32 && nalType <= 35) || nalType == 39 || (nalType >= 41 && nalType <= 44) || (nalType >= 48 && nalType <= 55)
+		}
+
+		if vcl && (prefix || first) {
+			frames = append(frames, frame)
+			frame, vcl = videoFrame{}, false
+		}
+
+		frame.key = frame.key || isKey
+		frame.data = append(append(frame.data, 0, 0, 0, 1), unit...)
+		vcl = vcl || isVcl
+	}
+
+	if vcl {
+		frames = append(frames, frame)
+	}
+
+	return frames
+}
@@ -0,0 +1,162 @@
+package sofiatest
+
+import (
+	"encoding/json"
+	"time"
+
+	"sofia-go/sofia"
+)
+
+// OPMonitor request, sent as MONITOR_CLAIM and MONITOR_REQ
+type monitorReqData struct {
+	Name      string
+	SessionID string
+	OPMonitor struct {
+		Action    string // Claim, Start or Stop
+		Parameter struct {
+			Channel    int
+			CombinMode string
+			StreamType string // Main or Extra1
+			TransMode  string
+		}
+	}
+}
+
+/*
+ * Clients claim a monitor with MONITOR_CLAIM, usually on a second connection
+ * carrying the session id of their login, then start it with MONITOR_REQ on
+ * the login connection. Media frames follow as MONITOR_DATA on the claiming
+ * connection until stopped or either connection closes.
+ */
+func (conn *Conn) monitor(req Frame, res map[string]interface{}) error {
+	server := conn.server
+
+	var reqData monitorReqData
+	if err := json.Unmarshal(req.Data, &reqData); err != nil {
+		res["Ret"] = sofia.RetIllegalRequest
+		return conn.Reply(req, res)
+	}
+
+	video := server.config.Video
+	channel := reqData.OPMonitor.Parameter.Channel
+
+	switch {
+	case video == nil:
+		res["Ret"] = sofia.RetUnsupported
+
+	case video.Validate() != nil:
+		server.logger.Error("Unable to stream [", video.Validate().Error(), "]")
+		res["Ret"] = sofia.RetUnsupported
+
+	case channel < 0 || channel >= server.config.ChannelNum:
+		res["Ret"] = sofia.RetIllegalRequest
+
+	case req.MsgID == sofia.MONITOR_CLAIM:
+		server.mutex.Lock()
+		server.claims[req.SessionID] = conn
+		server.mutex.Unlock()
+
+	case reqData.OPMonitor.Action == "Start":
+		// Respond before the first media frame
+		if err := conn.Reply(req, res); err != nil {
+			return err
+		}
+
+		server.startStream(conn, req.SessionID, video)
+		return nil
+
+	case reqData.OPMonitor.Action == "Stop":
+		server.stopStream(req.SessionID)
+
+	default:
+		res["Ret"] = sofia.RetIllegalRequest
+	}
+
+	return conn.Reply(req, res)
+}
+
+// Stream video to the connection claimed by session, conn if none
+func (server *Server) startStream(conn *Conn, sessionId byte, video *Video) {
+	server.stopStream(sessionId)
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if claim := server.claims[sessionId]; claim != nil && server.conns[claim] {
+		conn = claim
+	}
+
+	stop := make(chan struct{})
+	server.streams[sessionId] = stop
+
+	server.wg.Add(1)
+	go server.stream(conn, sessionId, video, stop)
+}
+
+// Stop the stream of session
+func (server *Server) stopStream(sessionId byte) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if stop := server.streams[sessionId]; stop != nil {
+		close(stop)
+		delete(server.streams, sessionId)
+	}
+}
+
+// Streams running
+func (server *Server) Streams() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return len(server.streams)
+}
+
+// Stream task, sends access units at the video frame rate, looping
+func (server *Server) stream(conn *Conn, sessionId byte, video *Video, stop chan struct{}) {
+	defer server.wg.Done()
+	defer func() {
+		server.mutex.Lock()
+		if server.streams[sessionId] == stop {
+			delete(server.streams, sessionId)
+		}
+		server.mutex.Unlock()
+	}()
+
+	server.logger.Debug("Streaming ", video.Frames(), " frames to session ", sessionString(sessionId))
+
+	ticker := time.NewTicker(time.Second / time.Duration(video.FPS))
+	defer ticker.Stop()
+
+	var seqNum byte
+	for i := 0; ; i = (i + 1) % video.Frames() {
+		// Split the media frame into messages
+		buf := video.mediaFrame(i, time.Now()).Bytes()
+		for len(buf) > 0 {
+			chunk := buf
+			if len(chunk) > MediaChunkLen {
+				chunk = chunk[:MediaChunkLen]
+			}
+
+			err := conn.Send(Frame{
+				SessionID: sessionId,
+				SeqNum:    seqNum,
+				MsgID:     sofia.MONITOR_DATA,
+				Data:      chunk,
+			})
+			if err != nil {
+				server.logger.Debug("Stream stopped [", err.Error(), "]")
+				return
+			}
+
+			seqNum++
+			buf = buf[len(chunk):]
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
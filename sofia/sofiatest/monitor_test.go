@@ -0,0 +1,202 @@
+package sofiatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+)
+
+// NAL unit with a start code, payload bytes never form a start code
+func nalUnit(header []byte, length int, seed byte) []byte {
+	unit := append([]byte{0, 0, 0, 1}, header...)
+	for i := 0; i < length; i++ {
+		unit = append(unit, byte(i+int(seed))%250+1)
+	}
+
+	return unit
+}
+
+// H.264 stream: SPS, PPS and an IDR slice larger than a message, then P slices
+func testStream() []byte {
+	var stream []byte
+
+	stream = append(stream, nalUnit([]byte{0x67, 0x42, 0x00, 0x1F}, 8, 1)...)
+	stream = append(stream, nalUnit([]byte{0x68, 0xCE}, 4, 2)...)
+	stream = append(stream, nalUnit([]byte{0x65, 0x88}, 2*MediaChunkLen+100, 3)...)
+
+	for idx := 0; idx < 3; idx++ {
+		stream = append(stream, nalUnit([]byte{0x41, 0x9A}, 500*(idx+1), byte(10+idx))...)
+	}
+
+	return stream
+}
+
+// Send a request as clients do and read the response, which must succeed
+func roundTrip(t *testing.T, conn net.Conn, req Frame, data interface{}) Frame {
+	t.Helper()
+
+	req.Data, _ = json.Marshal(data)
+	if _, err := conn.Write(requestBytes(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resData sofia.CmdResData2
+	if err := json.Unmarshal(res.Data, &resData); err != nil || resData.Ret != sofia.RetOK {
+		t.Fatalf("response [%d] %s", res.MsgID, res.Data)
+	}
+
+	return res
+}
+
+func TestMonitorStream(t *testing.T) {
+	video, err := NewVideo(sofia.MediaH264, testStream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	video.FPS = 100
+
+	if video.Frames() != 4 {
+		t.Fatalf("%d access units, want 4", video.Frames())
+	}
+
+	server := NewServer(Config{Video: video})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		return conn
+	}
+
+	// Login
+	login := dial()
+	defer login.Close()
+
+	res := roundTrip(t, login, Frame{MsgID: sofia.LOGIN_REQ2}, sofia.LoginReqData{
+		EncryptType: "MD5",
+		LoginType:   "DVRIP-Web",
+		PassWord:    sofia.SofiaHash(""),
+		UserName:    "admin",
+	})
+	if res.MsgID != sofia.LOGIN_RSP || res.SessionID == 0 {
+		t.Fatalf("login response [%d] %s", res.MsgID, res.Data)
+	}
+	sessionId := res.SessionID
+
+	// Claim on a connection of its own and start on the login connection
+	monitor := func(action string) monitorReqData {
+		var data monitorReqData
+		data.Name = "OPMonitor"
+		data.SessionID = sessionString(sessionId)
+		data.OPMonitor.Action = action
+		data.OPMonitor.Parameter.CombinMode = "NONE"
+		data.OPMonitor.Parameter.StreamType = "Main"
+		data.OPMonitor.Parameter.TransMode = "TCP"
+
+		return data
+	}
+
+	claim := dial()
+	defer claim.Close()
+
+	if res := roundTrip(t, claim, Frame{SessionID: sessionId, MsgID: sofia.MONITOR_CLAIM}, monitor("Claim")); res.MsgID != sofia.MONITOR_CLAIM_RSP {
+		t.Fatalf("claim response [%d] %s", res.MsgID, res.Data)
+	}
+
+	if res := roundTrip(t, login, Frame{SessionID: sessionId, MsgID: sofia.MONITOR_REQ}, monitor("Start")); res.MsgID != sofia.MONITOR_REQ+1 {
+		t.Fatalf("start response [%d] %s", res.MsgID, res.Data)
+	}
+
+	// Two loops of the video, every media frame starts a message and ends
+	// with one
+	var pending []byte
+	var seqNum byte
+
+	for count := 0; count < 2*video.Frames(); {
+		msg, err := ReadFrame(claim)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.MsgID != sofia.MONITOR_DATA || msg.SessionID != sessionId {
+			t.Fatalf("message [%d] of session %d", msg.MsgID, msg.SessionID)
+		}
+
+		if len(msg.Data) == 0 || len(msg.Data) > MediaChunkLen {
+			t.Fatalf("message of %d bytes", len(msg.Data))
+		}
+
+		if msg.SeqNum != seqNum {
+			t.Errorf("sequence number %d, want %d", msg.SeqNum, seqNum)
+		}
+		seqNum = msg.SeqNum + 1
+
+		if len(pending) == 0 && sofia.MediaHeaderLen(msg.Data) == 0 {
+			t.Fatalf("media frame %d doesn't start a message", count)
+		}
+
+		pending = append(pending, msg.Data...)
+
+		hdr, length, err := sofia.DecodeMediaHeader(pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		total := sofia.MediaHeaderLen(pending) + int(length)
+		if len(pending) < total {
+			continue
+		}
+
+		if len(pending) > total {
+			t.Fatalf("media frame %d ends inside a message", count)
+		}
+
+		frame, err := sofia.ReadMediaFrame(bytes.NewReader(pending))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := video.frames[count%video.Frames()]
+		if !bytes.Equal(frame.Data, want.data) {
+			t.Errorf("media frame %d payload differs, %d bytes, want %d", count, len(frame.Data), len(want.data))
+		}
+
+		if want.key {
+			if hdr.Type != sofia.MediaIFrame || frame.Media != sofia.MediaH264 || frame.FPS != 100 || frame.Width != VideoWidth || frame.Height != VideoHeight {
+				t.Errorf("media frame %d %+v", count, hdr)
+			}
+		} else if hdr.Type != sofia.MediaPFrame {
+			t.Errorf("media frame %d type %s", count, sofia.MediaTypeName(hdr.Type))
+		}
+
+		pending = nil
+		count++
+	}
+
+	// Stopped on request
+	if res := roundTrip(t, login, Frame{SessionID: sessionId, MsgID: sofia.MONITOR_REQ}, monitor("Stop")); res.MsgID != sofia.MONITOR_REQ+1 {
+		t.Fatalf("stop response [%d] %s", res.MsgID, res.Data)
+	}
+
+	for deadline := time.Now().Add(time.Second); server.Streams() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stream still running")
+		}
+	}
+}
@@ -0,0 +1,612 @@
+// Package sofiatest provides a fake Sofia device speaking DVRIP on a local
+// listener, for testing clients without cameras.
+package sofiatest
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"sofia-go/sofia"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed fixtures/*.json
+var fixtureFiles embed.FS
+
+// Fake device configuration
+type Config struct {
+	User          string                     // Accepted user, default admin
+	Password      string                     // Accepted password (plain text), default empty
+	LoginRet      uint32                     // Forced login return code, 0 to check credentials
+	AliveInterval uint32                     // Keepalive interval announced at login, default 20
+	KeepAliveID   uint16                     // Keepalive message ID answered, default sofia.KEEPALIVE_REQ
+	ChannelNum    int                        // Channels announced at login, default 1
+	Fixtures      map[string]json.RawMessage // Responses by command name, default DefaultFixtures
+	Video         *Video                     // Streamed to monitor claims, nil to refuse them
+	Logger        *logrus.Logger             // Logger, default discards
+}
+
+// Fault injected instead of the normal handling of a request
+type Fault struct {
+	Delay      time.Duration // Delay the response
+	Drop       bool          // Don't respond
+	Disconnect bool          // Close the connection instead of responding
+	Raw        []byte        // Send instead of the response, e.g. MalformedFrame()
+}
+
+// Returns the fault for a request, zero Fault for none
+type FaultFunc func(req Frame) Fault
+
+// Fault for every request with message ID msgId
+func FaultOn(msgId uint16, fault Fault) FaultFunc {
+	return func(req Frame) Fault {
+		if req.MsgID == msgId {
+			return fault
+		}
+
+		return Fault{}
+	}
+}
+
+// Handles a request, replacing the built in handling
+type Handler func(conn *Conn, req Frame) error
+
+// Fake device
+type Server struct {
+	config   Config                     // Configuration
+	logger   *logrus.Entry              // Contextual logger
+	listener net.Listener               // TCP listener
+	udp      *net.UDPConn               // Discovery socket
+	mutex    sync.Mutex                 // Protects the following
+	conns    map[*Conn]bool             // Open connections
+	handlers map[uint16]Handler         // Custom handlers by message ID
+	faults   []FaultFunc                // Injected faults
+	requests []Frame                    // Received requests
+	nextId   byte                       // Next session id
+	fixtures map[string]json.RawMessage // Responses by command name
+	claims   map[byte]*Conn             // Monitor claims by session id
+	streams  map[byte]chan struct{}     // Running streams by session id, closed to stop
+	wg       sync.WaitGroup             // Connection tasks
+}
+
+// Client connection
+type Conn struct {
+	server   *Server         // Server
+	conn     net.Conn        // Transport connection
+	txMutex  sync.Mutex      // Serializes writes
+	sessions map[byte]string // Logged in sessions, id to user
+}
+
+// Default fixtures: SystemInfo, SystemFunction, OEMInfo, AuthorityList,
+// StorageInfo and NetWork.NetCommon of a single channel IPC with an SD card
+func DefaultFixtures() map[string]json.RawMessage {
+	fixtures, _ := loadFixtures(fixtureFiles, "fixtures")
+
+	return fixtures
+}
+
+// Load fixtures from a directory, one <command name>.json per response
+func LoadFixtures(dir string) (map[string]json.RawMessage, error) {
+	return loadFixtures(os.DirFS(dir), ".")
+}
+
+func loadFixtures(fsys fs.FS, dir string) (map[string]json.RawMessage, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := make(map[string]json.RawMessage)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("sofiatest: invalid JSON in %s", entry.Name())
+		}
+
+		fixtures[strings.TrimSuffix(entry.Name(), ".json")] = json.RawMessage(data)
+	}
+
+	return fixtures, nil
+}
+
+// Create a fake device
+func NewServer(config Config) *Server {
+	// Defaults
+	{
+		if len(config.User) == 0 {
+			config.User = "admin"
+		}
+
+		if config.AliveInterval == 0 {
+			config.AliveInterval = 20
+		}
+
+		if config.KeepAliveID == 0 {
+			config.KeepAliveID = sofia.KEEPALIVE_REQ
+		}
+
+		if config.ChannelNum == 0 {
+			config.ChannelNum = 1
+		}
+
+		if config.Fixtures == nil {
+			config.Fixtures = DefaultFixtures()
+		}
+
+		if config.Logger == nil {
+			config.Logger = logrus.New()
+			config.Logger.SetOutput(io.Discard)
+		}
+	}
+
+	server := &Server{
+		config:   config,
+		conns:    make(map[*Conn]bool),
+		handlers: make(map[uint16]Handler),
+		nextId:   1,
+		fixtures: make(map[string]json.RawMessage),
+		claims:   make(map[byte]*Conn),
+		streams:  make(map[byte]chan struct{}),
+	}
+
+	for name, fixture := range config.Fixtures {
+		server.fixtures[name] = fixture
+	}
+
+	server.logger = config.Logger.WithFields(logrus.Fields{
+		"module": "FakeDevice",
+	})
+
+	return server
+}
+
+// Listen on a random local port
+func (server *Server) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	server.mutex.Lock()
+	server.listener = listener
+	server.mutex.Unlock()
+
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		server.accept(listener)
+	}()
+
+	return nil
+}
+
+// Accept connections from listener (e.g. a TLS listener) until it is closed
+func (server *Server) Serve(listener net.Listener) error {
+	server.mutex.Lock()
+	server.listener = listener
+	server.mutex.Unlock()
+
+	return server.accept(listener)
+}
+
+// Accept task
+func (server *Server) accept(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		server.ServeConn(conn)
+	}
+}
+
+// Serve an established connection
+func (server *Server) ServeConn(transport net.Conn) {
+	conn := &Conn{
+		server:   server,
+		conn:     transport,
+		sessions: make(map[byte]string),
+	}
+
+	server.mutex.Lock()
+	server.conns[conn] = true
+	server.mutex.Unlock()
+
+	server.wg.Add(1)
+	go conn.serve()
+}
+
+// Client end of an in-memory connection to the server
+func (server *Server) Pipe() net.Conn {
+	client, device := net.Pipe()
+	server.ServeConn(device)
+
+	return client
+}
+
+// Listener address
+func (server *Server) Addr() net.Addr {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.listener == nil {
+		return nil
+	}
+
+	return server.listener.Addr()
+}
+
+// Listener host and port, as taken by sofia.NewDevice
+func (server *Server) HostPort() (string, string) {
+	addr := server.Addr()
+	if addr == nil {
+		return "", ""
+	}
+
+	host, port, _ := net.SplitHostPort(addr.String())
+
+	return host, port
+}
+
+// Stop listening and close all connections
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	listener, udp := server.listener, server.udp
+	server.mutex.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	if udp != nil {
+		udp.Close()
+	}
+
+	server.DisconnectAll()
+	server.wg.Wait()
+
+	return nil
+}
+
+// Close all client connections, as a device reboot would
+func (server *Server) DisconnectAll() {
+	server.mutex.Lock()
+	conns := make([]*Conn, 0, len(server.conns))
+	for conn := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Replace the handling of msgId
+func (server *Server) Handle(msgId uint16, handler Handler) {
+	server.mutex.Lock()
+	server.handlers[msgId] = handler
+	server.mutex.Unlock()
+}
+
+// Inject faults, checked in order for every request
+func (server *Server) InjectFault(fn FaultFunc) {
+	server.mutex.Lock()
+	server.faults = append(server.faults, fn)
+	server.mutex.Unlock()
+}
+
+// Remove injected faults
+func (server *Server) ClearFaults() {
+	server.mutex.Lock()
+	server.faults = nil
+	server.mutex.Unlock()
+}
+
+// Set the response of a command, e.g. SetFixture("SystemInfo", ...)
+func (server *Server) SetFixture(name string, fixture json.RawMessage) {
+	server.mutex.Lock()
+	server.fixtures[name] = fixture
+	server.mutex.Unlock()
+}
+
+// Response of a command
+func (server *Server) Fixture(name string) (json.RawMessage, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	fixture, ok := server.fixtures[name]
+
+	return fixture, ok
+}
+
+// Requests received so far, in order
+func (server *Server) Requests() []Frame {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return append([]Frame(nil), server.requests...)
+}
+
+// Connection task
+func (conn *Conn) serve() {
+	server := conn.server
+
+	defer server.wg.Done()
+	defer func() {
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		for sessionId, claim := range server.claims {
+			if claim == conn {
+				delete(server.claims, sessionId)
+			}
+		}
+		server.mutex.Unlock()
+
+		conn.conn.Close()
+
+		// Streams of sessions logged in here
+		for sessionId := range conn.sessions {
+			server.stopStream(sessionId)
+		}
+	}()
+
+	for {
+		req, err := ReadRequest(conn.conn)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				server.logger.Debug("Connection closed [", err.Error(), "]")
+			}
+			return
+		}
+
+		server.logger.Debug("Rx request [", req.MsgID, "] ", string(req.Data))
+
+		server.mutex.Lock()
+		server.requests = append(server.requests, req)
+		faults := server.faults
+		handler := server.handlers[req.MsgID]
+		server.mutex.Unlock()
+
+		// Faults
+		var fault Fault
+		for _, fn := range faults {
+			if fault = fn(req); fault.Delay > 0 || fault.Drop || fault.Disconnect || fault.Raw != nil {
+				break
+			}
+		}
+
+		if fault.Delay > 0 {
+			time.Sleep(fault.Delay)
+		}
+
+		if fault.Disconnect {
+			return
+		}
+
+		if fault.Drop {
+			continue
+		}
+
+		if fault.Raw != nil {
+			conn.write(fault.Raw)
+			continue
+		}
+
+		if handler == nil {
+			handler = handle
+		}
+
+		if err := handler(conn, req); err != nil {
+			server.logger.Debug("Handler failed [", err.Error(), "]")
+			return
+		}
+	}
+}
+
+// Send a frame
+func (conn *Conn) Send(frame Frame) error {
+	return conn.write(frame.Bytes())
+}
+
+// Send a JSON response to req
+func (conn *Conn) Reply(req Frame, data interface{}) error {
+	mdata, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return conn.Send(Frame{
+		SessionID: req.SessionID,
+		SeqNum:    req.SeqNum,
+		MsgID:     req.MsgID + 1,
+		Data:      mdata,
+	})
+}
+
+// Is session logged in on this connection
+func (conn *Conn) LoggedIn(sessionId byte) bool {
+	conn.server.mutex.Lock()
+	defer conn.server.mutex.Unlock()
+
+	_, ok := conn.sessions[sessionId]
+
+	return ok
+}
+
+// Is session logged in on any connection
+func (server *Server) LoggedIn(sessionId byte) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for conn := range server.conns {
+		if _, ok := conn.sessions[sessionId]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close the connection
+func (conn *Conn) Close() error {
+	return conn.conn.Close()
+}
+
+// Write raw bytes
+func (conn *Conn) write(buf []byte) error {
+	conn.txMutex.Lock()
+	defer conn.txMutex.Unlock()
+
+	_, err := conn.conn.Write(buf)
+
+	return err
+}
+
+// Session id as string
+func sessionString(sessionId byte) string {
+	return fmt.Sprintf("0x%08X", sessionId)
+}
+
+// Built in handling
+func handle(conn *Conn, req Frame) error {
+	server := conn.server
+
+	// Login
+	if req.MsgID == sofia.LOGIN_REQ2 {
+		return conn.login(req)
+	}
+
+	var reqData sofia.CmdReqData
+	json.Unmarshal(req.Data, &reqData)
+
+	res := map[string]interface{}{
+		"Name":      reqData.Name,
+		"SessionID": sessionString(req.SessionID),
+	}
+
+	// Monitors are claimed on connections of their own
+	if !conn.LoggedIn(req.SessionID) && (req.MsgID != sofia.MONITOR_CLAIM || !server.LoggedIn(req.SessionID)) {
+		res["Ret"] = sofia.RetNotLoggedIn
+		return conn.Reply(req, res)
+	}
+
+	res["Ret"] = sofia.RetOK
+
+	switch req.MsgID {
+	case server.config.KeepAliveID:
+		// Keepalive
+
+	case sofia.LOGOUT_REQ:
+		server.stopStream(req.SessionID)
+
+		server.mutex.Lock()
+		delete(conn.sessions, req.SessionID)
+		server.mutex.Unlock()
+
+	case sofia.SYSINFO_REQ, sofia.ABILITY_REQ, sofia.CONFIG_GET_REQ:
+		if fixture, ok := server.Fixture(reqData.Name); ok {
+			res[reqData.Name] = fixture
+		} else {
+			res["Ret"] = sofia.RetUnsupported
+		}
+
+	case sofia.CONFIG_SET_REQ:
+		var setData map[string]json.RawMessage
+		json.Unmarshal(req.Data, &setData)
+
+		if fixture, ok := setData[reqData.Name]; ok {
+			server.SetFixture(reqData.Name, fixture)
+		} else {
+			res["Ret"] = sofia.RetIllegalRequest
+		}
+
+	case sofia.MONITOR_CLAIM, sofia.MONITOR_REQ:
+		return conn.monitor(req, res)
+
+	case sofia.FULLAUTHORITYLIST_GET:
+		if fixture, ok := server.Fixture("AuthorityList"); ok {
+			res["AuthorityList"] = fixture
+		} else {
+			res["Ret"] = sofia.RetUnsupported
+		}
+
+	case sofia.KEEPALIVE_REQ, sofia.KEEPALIVE_REQ_ALT:
+		// Keepalive this firmware doesn't know
+		return nil
+
+	default:
+		res["Ret"] = sofia.RetUnsupported
+	}
+
+	return conn.Reply(req, res)
+}
+
+// Login
+func (conn *Conn) login(req Frame) error {
+	server := conn.server
+
+	var reqData sofia.LoginReqData
+	if err := json.Unmarshal(req.Data, &reqData); err != nil {
+		return err
+	}
+
+	ret := server.config.LoginRet
+	if ret == 0 {
+		switch {
+		case reqData.UserName != server.config.User:
+			ret = sofia.RetUserNotExist
+		case reqData.PassWord != sofia.SofiaHash(server.config.Password):
+			ret = sofia.RetBadPassword
+		default:
+			ret = sofia.RetOK
+		}
+	}
+
+	var sessionId byte
+	if sofia.CheckRet(ret) == nil {
+		server.mutex.Lock()
+		sessionId = server.nextId
+		if server.nextId++; server.nextId == 0 {
+			server.nextId = 1
+		}
+		conn.sessions[sessionId] = reqData.UserName
+		server.mutex.Unlock()
+	}
+
+	mdata, _ := json.Marshal(map[string]interface{}{
+		"AliveInterval": server.config.AliveInterval,
+		"ChannelNum":    server.config.ChannelNum,
+		"DeviceType ":   "IPC",
+		"ExtraChannel":  0,
+		"Ret":           ret,
+		"SessionID":     sessionString(sessionId),
+	})
+
+	return conn.Send(Frame{
+		SessionID: sessionId,
+		OpaqueID:  req.OpaqueID,
+		MsgID:     sofia.LOGIN_RSP,
+		Data:      mdata,
+	})
+}
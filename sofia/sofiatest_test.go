@@ -0,0 +1,393 @@
+package sofia_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   sofiatest.Config
+		user     string
+		password string
+		wantErr  error
+	}{
+		{name: "default credentials", user: "admin"},
+		{name: "password", config: sofiatest.Config{Password: "secret"}, user: "admin", password: "secret"},
+		{name: "bad password", config: sofiatest.Config{Password: "secret"}, user: "admin", password: "guess", wantErr: sofia.RetError(sofia.RetBadPassword)},
+		{name: "unknown user", user: "guest", wantErr: sofia.RetError(sofia.RetUserNotExist)},
+		{name: "forced return code", config: sofiatest.Config{LoginRet: sofia.RetNotLoggedIn}, user: "admin", wantErr: sofia.RetError(sofia.RetNotLoggedIn)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startServer(t, test.config)
+			session := newSession(t, connectDevice(t, server, nil, nil), test.user, test.password)
+
+			err := session.Login()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("login [%v], want %v", err, test.wantErr)
+			}
+
+			// Logged in sessions answer requests, others are refused locally
+			_, err = session.SystemInfo()
+			if test.wantErr == nil && err != nil {
+				t.Errorf("request after login [%v]", err)
+			} else if test.wantErr != nil && !errors.Is(err, sofia.ErrNotLoggedIn) {
+				t.Errorf("request after failed login [%v], want %v", err, sofia.ErrNotLoggedIn)
+			}
+
+			// A failed login can be retried
+			if test.wantErr != nil {
+				if err := session.Login(); !errors.Is(err, test.wantErr) {
+					t.Errorf("second login [%v], want %v", err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepAliveMsgID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   uint16
+	}{
+		{name: "standard", id: sofia.KEEPALIVE_REQ},
+		{name: "alternate", id: sofia.KEEPALIVE_REQ_ALT},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startServer(t, sofiatest.Config{KeepAliveID: test.id, AliveInterval: 1})
+			session := loginSession(t, connectDevice(t, server, nil, nil))
+
+			// Both IDs are tried in turn until one is answered
+			deadline := time.Now().Add(5 * time.Second)
+			for session.KeepAliveStats().MsgID == 0 && time.Now().Before(deadline) {
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			stats := session.KeepAliveStats()
+			if stats.MsgID != test.id || stats.Misses != 0 || stats.LastSeen.IsZero() {
+				t.Errorf("stats %+v, want message ID %d", stats, test.id)
+			}
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+	session := loginSession(t, connectDevice(t, server, nil, nil))
+
+	// Round trip
+	value := json.RawMessage(`{"Enable":true,"Server":{"Name":"pool.ntp.org"}}`)
+	if err := session.SetConfig("NetWork.NetNTP", value); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := session.GetConfig("NetWork.NetNTP")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(compact(t, got), compact(t, value)) {
+		t.Errorf("config %s, want %s", got, value)
+	}
+
+	// Unknown sections
+	var retErr sofia.RetError
+	if _, err := session.GetConfig("Unknown.Section"); !errors.As(err, &retErr) {
+		t.Errorf("unknown section [%v]", err)
+	}
+
+	// Bulk export isn't supported, sections are exported instead
+	var backup bytes.Buffer
+	if err := session.ExportConfig(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported sofia.ConfigBackup
+	if err := json.Unmarshal(backup.Bytes(), &exported); err != nil || exported.Format != sofia.ConfigBackupFormat {
+		t.Fatalf("export [%v] %s", err, backup.Bytes())
+	}
+
+	if _, ok := exported.Sections["NetWork.NetNTP"]; !ok {
+		t.Errorf("exported sections %v", exported.Sections)
+	}
+
+	// Restored on another device
+	other := startServer(t, sofiatest.Config{})
+	otherSession := loginSession(t, connectDevice(t, other, nil, nil))
+
+	if err := otherSession.ImportConfig(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored, _ := other.Fixture("NetWork.NetNTP"); !bytes.Equal(compact(t, restored), compact(t, value)) {
+		t.Errorf("restored %s, want %s", restored, value)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		fault     sofiatest.Fault
+		wantErr   error
+		wantStop  error // Reason the device stops, nil if it keeps running
+		connected bool
+	}{
+		{name: "delayed", fault: sofiatest.Fault{Delay: 100 * time.Millisecond}, connected: true},
+		{name: "too late", fault: sofiatest.Fault{Delay: 2 * time.Second}, wantErr: sofia.ErrTimeout, connected: true},
+		{name: "dropped", fault: sofiatest.Fault{Drop: true}, wantErr: sofia.ErrTimeout, connected: true},
+		{name: "disconnect", fault: sofiatest.Fault{Disconnect: true}, wantErr: sofia.ErrNotConnected},
+		{name: "malformed", fault: sofiatest.Fault{Raw: sofiatest.MalformedFrame()}, wantErr: sofia.ErrNotConnected, wantStop: sofia.ErrBadHeader},
+		{name: "oversized", fault: sofiatest.Fault{Raw: sofiatest.OversizedFrame()}, wantErr: sofia.ErrNotConnected, wantStop: sofia.ErrBadHeader},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startServer(t, sofiatest.Config{})
+			device := connectDevice(t, server, nil, nil)
+			session := loginSession(t, device)
+
+			server.InjectFault(sofiatest.FaultOn(sofia.SYSINFO_REQ, test.fault))
+
+			if _, err := session.SystemInfo(); !errors.Is(err, test.wantErr) {
+				t.Fatalf("request [%v], want %v", err, test.wantErr)
+			}
+
+			if connected := device.State() == sofia.DeviceConnected; connected != test.connected {
+				t.Errorf("state %s", device.State())
+			}
+
+			if test.wantStop != nil {
+				select {
+				case err := <-*device.WorkerChan():
+					if !errors.Is(err, test.wantStop) {
+						t.Errorf("stopped [%v], want %v", err, test.wantStop)
+					}
+				case <-time.After(time.Second):
+					t.Error("device didn't stop")
+				}
+			}
+
+			// Requests go through again once the fault is cleared and a
+			// late response arrived
+			server.ClearFaults()
+			time.Sleep(test.fault.Delay)
+
+			if test.connected {
+				if _, err := session.SystemInfo(); err != nil {
+					t.Errorf("request after fault [%v]", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSetEncodeConfig(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+	server.SetFixture("EncodeCapability", json.RawMessage(`{
+		"EncodeInfo": [
+			{"CompressionMask": "0x00000180", "Enable": true, "HaveAudio": true, "ResolutionMask": "0x01004800", "StreamType": "MainStream"},
+			{"CompressionMask": "0x00000080", "Enable": true, "HaveAudio": true, "ResolutionMask": "0x00000009", "StreamType": "ExtraStream"}
+		],
+		"MaxBitrate": 8192,
+		"MaxEncodePower": 62208000
+	}`))
+	server.SetFixture("AVEnc.SmartH264.[0]", json.RawMessage(`{"SmartH264": false, "SmartLevel": 2}`))
+
+	session := loginSession(t, connectDevice(t, server, nil, nil))
+
+	config := sofia.EncodeConfig{
+		MainFormat: sofia.StreamFormat{
+			VideoEnable: true,
+			Video:       sofia.VideoFormat{BitRate: 4096, BitRateControl: sofia.BitRateVBR, Compression: sofia.CodecH265Plus, FPS: 25, GOP: 2, Quality: 4, Resolution: "1080P"},
+		},
+		ExtraFormat: sofia.StreamFormat{
+			VideoEnable: true,
+			Video:       sofia.VideoFormat{BitRate: 512, BitRateControl: sofia.BitRateCBR, Compression: sofia.CodecH264, FPS: 15, GOP: 2, Quality: 3, Resolution: "CIF"},
+		},
+	}
+
+	if err := session.SetEncodeConfig([]sofia.EncodeConfig{config}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Smart encoding fields this library doesn't know are kept
+	smart, _ := server.Fixture("AVEnc.SmartH264.[0]")
+	if want := `{"SmartH264":true,"SmartLevel":2}`; !bytes.Equal(compact(t, smart), []byte(want)) {
+		t.Errorf("smart encoding %s, want %s", smart, want)
+	}
+
+	got, err := session.EncodeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0] != config {
+		t.Errorf("encode config %+v, want %+v", got, config)
+	}
+
+	// 4K at 30 fps is beyond the encode power, nothing is written
+	config.MainFormat.Video.Resolution = "4K"
+	config.MainFormat.Video.FPS = 30
+
+	if err := session.SetEncodeConfig([]sofia.EncodeConfig{config}); err == nil || !strings.Contains(err.Error(), "encode power") {
+		t.Errorf("4K at 30 fps [%v]", err)
+	}
+}
+
+func compact(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// Discovery probing a fake device by unicast, started with ctx
+func startDiscovery(t *testing.T, ctx context.Context) *sofia.Discovery {
+	server := startServer(t, sofiatest.Config{})
+	if err := server.StartDiscovery("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any free port, the device answers the sender
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	discovery, err := sofia.NewDiscovery(uint16(port), 1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(discovery.Stop)
+
+	if err := discovery.SetProbeHosts([]string{server.DiscoveryAddr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := discovery.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return discovery
+}
+
+// Wait for the message Q to close, draining it
+func waitClosed(t *testing.T, mQ chan sofia.DiscoveredDevice) {
+	timeout := time.After(2 * time.Second)
+
+	for {
+		select {
+		case _, ok := <-mQ:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("message Q not closed")
+		}
+	}
+}
+
+func TestDiscoveryLifecycle(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(discovery *sofia.Discovery, cancel context.CancelFunc)
+	}{
+		{name: "context cancelled", stop: func(discovery *sofia.Discovery, cancel context.CancelFunc) {
+			cancel()
+		}},
+		{name: "stop", stop: func(discovery *sofia.Discovery, cancel context.CancelFunc) {
+			discovery.Stop()
+		}},
+		{name: "stop twice", stop: func(discovery *sofia.Discovery, cancel context.CancelFunc) {
+			discovery.Stop()
+			discovery.Stop()
+		}},
+		{name: "stop then close", stop: func(discovery *sofia.Discovery, cancel context.CancelFunc) {
+			discovery.Stop()
+			if err := discovery.Close(); err != nil {
+				t.Error(err)
+			}
+		}},
+		{name: "stop then cancel", stop: func(discovery *sofia.Discovery, cancel context.CancelFunc) {
+			discovery.Stop()
+			cancel()
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			discovery := startDiscovery(t, ctx)
+
+			// Running, the device answers the unicast probe
+			select {
+			case device := <-*discovery.MQ():
+				if device.SerialNo != "0123456789abcdef" || device.HostIP.String() != "192.168.1.10" {
+					t.Errorf("device %+v", device)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("device not discovered")
+			}
+
+			if err := discovery.Start(ctx); !errors.Is(err, sofia.ErrDiscoveryStarted) {
+				t.Errorf("start while running [%v]", err)
+			}
+
+			test.stop(discovery, cancel)
+
+			waitClosed(t, *discovery.MQ())
+
+			if _, ok := <-*discovery.FrameQ(); ok {
+				t.Error("frame Q not closed")
+			}
+
+			if err := discovery.Start(context.Background()); !errors.Is(err, sofia.ErrDiscoveryStopped) {
+				t.Errorf("start after stop [%v]", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryStopped(t *testing.T) {
+	// Context done before Start
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	discovery := startDiscovery(t, ctx)
+	waitClosed(t, *discovery.MQ())
+
+	// Stop before Start
+	discovery, err := sofia.NewDiscovery(34569, 1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discovery.Stop()
+	waitClosed(t, *discovery.MQ())
+
+	if err := discovery.Start(context.Background()); !errors.Is(err, sofia.ErrDiscoveryStopped) {
+		t.Errorf("start after stop [%v]", err)
+	}
+}
@@ -0,0 +1,200 @@
+package sofia
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+StorageInfo as returned by SYSINFO_REQ, sizes are hex strings in MB
+{
+	"Name" : "StorageInfo",
+	"StorageInfo" : [
+		{
+			"PartNumber" : 1,
+			"Partition" : [
+				{
+					"DirverType" : 0,
+					"IsCurrent" : true,
+					"LogicSerialNo" : 0,
+					"NewEndTime" : "2022-08-20 11:02:13",
+					"NewStartTime" : "2022-08-12 09:15:40",
+					"OldEndTime" : "2022-08-12 09:15:40",
+					"OldStartTime" : "2022-08-12 09:15:40",
+					"RemainSpace" : "0x00003A7B",
+					"Status" : 0,
+					"TotalSpace" : "0x0000EE6A"
+				}
+			],
+			"PlysicalNo" : 0
+		}
+	],
+	"Ret" : 100,
+	"SessionID" : "0x0000000B"
+}
+*/
+
+// Partition driver types
+const (
+	StorageReadWrite = 0 // Read/write
+	StorageReadOnly  = 1 // Read only
+	StorageEvent     = 2 // Event recording
+	StorageRedundant = 3 // Redundant
+	StorageSnapshot  = 4 // Snapshots
+)
+
+// Partition status, anything else is an error reported by the device
+const StorageStatusOK = 0
+
+// Hex encoded number, e.g. "0x0000EE6A"
+type HexUint32 uint32
+
+func (value *HexUint32) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		// Plain number
+		var num uint32
+		if err := json.Unmarshal(data, &num); err != nil {
+			return err
+		}
+
+		*value = HexUint32(num)
+		return nil
+	}
+
+	num, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(str), "0x"), 16, 32)
+	if err != nil {
+		return err
+	}
+
+	*value = HexUint32(num)
+	return nil
+}
+
+// Storage info (wire format)
+type StorageInfoData struct {
+	Name        string
+	Ret         uint32
+	SessionID   string
+	StorageInfo []struct {
+		PartNumber int
+		PlysicalNo int
+		Partition  []struct {
+			DirverType    int
+			IsCurrent     bool
+			LogicSerialNo int
+			NewEndTime    string
+			NewStartTime  string
+			OldEndTime    string
+			OldStartTime  string
+			RemainSpace   HexUint32
+			Status        int
+			TotalSpace    HexUint32
+		}
+	}
+}
+
+// Storage partition
+type StoragePartition struct {
+	Partition   int       // Partition number on disk
+	Logical     int       // Logical serial number
+	Type        int       // Driver type, one of Storage*
+	Current     bool      // Currently recording to this partition
+	TotalMB     uint64    // Capacity
+	FreeMB      uint64    // Free space
+	Status      int       // Status, StorageStatusOK if healthy
+	RecordStart time.Time // Oldest record, zero if none
+	RecordEnd   time.Time // Newest record, zero if none
+}
+
+// Healthy partition
+func (part StoragePartition) OK() bool {
+	return part.Status == StorageStatusOK
+}
+
+// Storage disk (HDD/SD)
+type StorageDisk struct {
+	Disk       int                // Physical disk number
+	TotalMB    uint64             // Capacity, sum of partitions
+	FreeMB     uint64             // Free space, sum of partitions
+	Partitions []StoragePartition // Partitions
+}
+
+// Healthy disk, all partitions OK
+func (disk StorageDisk) OK() bool {
+	for _, part := range disk.Partitions {
+		if !part.OK() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Storage management request
+type StorageManagerReqData struct {
+	Name             string
+	SessionID        string
+	OPStorageManager struct {
+		Action   string // Clear, Partition, Recover, SetType
+		SerialNo int    // Disk number
+		PartNo   int    // Partition number
+		Type     string // Data, Snapshot
+	}
+}
+
+// Storage status of all disks
+func (session *Session) StorageInfo() ([]StorageDisk, error) {
+	var resData StorageInfoData
+	if err := session.command(SYSINFO_REQ, CmdReqData{Name: "StorageInfo", SessionID: session.sessionID()}, &resData); err != nil {
+		return nil, err
+	}
+
+	disks := make([]StorageDisk, 0, len(resData.StorageInfo))
+	for _, info := range resData.StorageInfo {
+		disk := StorageDisk{Disk: info.PlysicalNo}
+
+		for idx, part := range info.Partition {
+			spart := StoragePartition{
+				Partition: idx,
+				Logical:   part.LogicSerialNo,
+				Type:      part.DirverType,
+				Current:   part.IsCurrent,
+				TotalMB:   uint64(part.TotalSpace),
+				FreeMB:    uint64(part.RemainSpace),
+				Status:    part.Status,
+			}
+
+			// Record range spans both old and new segments
+			spart.RecordStart = parseDeviceTime(part.OldStartTime)
+			if spart.RecordStart.IsZero() {
+				spart.RecordStart = parseDeviceTime(part.NewStartTime)
+			}
+			spart.RecordEnd = parseDeviceTime(part.NewEndTime)
+
+			disk.TotalMB += spart.TotalMB
+			disk.FreeMB += spart.FreeMB
+			disk.Partitions = append(disk.Partitions, spart)
+		}
+
+		disks = append(disks, disk)
+	}
+
+	return disks, nil
+}
+
+// Format (clear) a partition of a disk, all recordings are lost
+func (session *Session) FormatStorage(disk int, partition int) error {
+	data := StorageManagerReqData{
+		Name:      "OPStorageManager",
+		SessionID: session.sessionID(),
+	}
+	data.OPStorageManager.Action = "Clear"
+	data.OPStorageManager.SerialNo = disk
+	data.OPStorageManager.PartNo = partition
+	data.OPStorageManager.Type = "Data"
+
+	return session.command(DISKMANAGER_REQ, data, nil)
+}
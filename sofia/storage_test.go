@@ -0,0 +1,141 @@
+package sofia_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+func TestHexUint32(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    sofia.HexUint32
+		wantErr bool
+	}{
+		{json: `"0x0000EE6A"`, want: 0xEE6A},
+		{json: `"0X0000ee6a"`, want: 0xEE6A},
+		{json: `"EE6A"`, want: 0xEE6A},
+		{json: `"0xFFFFFFFF"`, want: 0xFFFFFFFF},
+		{json: `4096`, want: 4096},
+		{json: `0`, want: 0},
+		{json: `"0x100000000"`, wantErr: true}, // Out of range
+		{json: `"0xZZ"`, wantErr: true},
+		{json: `""`, wantErr: true},
+		{json: `-1`, wantErr: true},
+		{json: `true`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		var got sofia.HexUint32
+		err := json.Unmarshal([]byte(test.json), &got)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error %v", test.json, err)
+			continue
+		}
+
+		if !test.wantErr && got != test.want {
+			t.Errorf("%s: %#x, want %#x", test.json, uint32(got), uint32(test.want))
+		}
+	}
+}
+
+func TestStorageInfo(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+	session := loginSession(t, connectDevice(t, server, nil, nil))
+
+	disks, err := session.StorageInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(disks) != 1 || len(disks[0].Partitions) != 2 {
+		t.Fatalf("disks %+v", disks)
+	}
+
+	disk := disks[0]
+	if disk.TotalMB != 0xEE6A+4096 || disk.FreeMB != 0x3A7B+2048 || !disk.OK() {
+		t.Errorf("disk %+v", disk)
+	}
+
+	// Records span the old and new segments
+	local := func(s string) time.Time {
+		t, _ := time.ParseInLocation(sofia.DeviceTimeLayout, s, time.Local)
+		return t
+	}
+
+	part := disk.Partitions[0]
+	if part.Type != sofia.StorageReadWrite || !part.Current || part.TotalMB != 0xEE6A || part.FreeMB != 0x3A7B ||
+		!part.RecordStart.Equal(local("2022-08-01 00:00:05")) || !part.RecordEnd.Equal(local("2022-08-20 11:02:13")) {
+		t.Errorf("partition 0 %+v", part)
+	}
+
+	// No records, decimal sizes
+	part = disk.Partitions[1]
+	if part.Partition != 1 || part.Logical != 1 || part.Type != sofia.StorageSnapshot || part.TotalMB != 4096 || part.FreeMB != 2048 ||
+		!part.RecordStart.IsZero() || !part.RecordEnd.IsZero() {
+		t.Errorf("partition 1 %+v", part)
+	}
+
+	// Failed partition
+	server.SetFixture("StorageInfo", json.RawMessage(`[{"PlysicalNo":1,"Partition":[{"Status":3,"TotalSpace":"0x10","RemainSpace":"0x0"}]}]`))
+
+	if disks, err = session.StorageInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(disks) != 1 || disks[0].Disk != 1 || disks[0].OK() || disks[0].Partitions[0].Status != 3 {
+		t.Errorf("disks %+v", disks)
+	}
+}
+
+func TestFormatStorage(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+	server.Handle(sofia.DISKMANAGER_REQ, func(conn *sofiatest.Conn, req sofiatest.Frame) error {
+		return conn.Reply(req, map[string]interface{}{"Name": "OPStorageManager", "Ret": sofia.RetOK})
+	})
+
+	session := loginSession(t, connectDevice(t, server, nil, nil))
+
+	if err := session.FormatStorage(0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var reqs []sofiatest.Frame
+	for _, req := range server.Requests() {
+		if req.MsgID == sofia.DISKMANAGER_REQ {
+			reqs = append(reqs, req)
+		}
+	}
+
+	if len(reqs) != 1 {
+		t.Fatalf("%d DISKMANAGER_REQ, want 1", len(reqs))
+	}
+
+	var got sofia.StorageManagerReqData
+	if err := json.Unmarshal(reqs[0].Data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := sofia.StorageManagerReqData{Name: "OPStorageManager", SessionID: "0x00000001"}
+	want.OPStorageManager.Action = "Clear"
+	want.OPStorageManager.SerialNo = 0
+	want.OPStorageManager.PartNo = 1
+	want.OPStorageManager.Type = "Data"
+
+	if got != want {
+		t.Errorf("request %+v, want %+v", got, want)
+	}
+
+	// Refused by the device
+	server.Handle(sofia.DISKMANAGER_REQ, func(conn *sofiatest.Conn, req sofiatest.Frame) error {
+		return conn.Reply(req, map[string]interface{}{"Name": "OPStorageManager", "Ret": sofia.RetNoPermission})
+	})
+
+	if err := session.FormatStorage(0, 1); err == nil {
+		t.Error("refused format succeeded")
+	}
+}
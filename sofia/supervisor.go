@@ -0,0 +1,229 @@
+package sofia
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Device connection states
+type DeviceState int
+
+const (
+	DeviceDisconnected DeviceState = iota // Not connected
+	DeviceConnecting                      // Initial connect in progress
+	DeviceConnected                       // Connected
+	DeviceReconnecting                    // Connection lost, reconnect in progress
+)
+
+func (state DeviceState) String() string {
+	switch state {
+	case DeviceDisconnected:
+		return "Disconnected"
+	case DeviceConnecting:
+		return "Connecting"
+	case DeviceConnected:
+		return "Connected"
+	case DeviceReconnecting:
+		return "Reconnecting"
+	}
+
+	return "Unknown"
+}
+
+// Errors
+var (
+	ErrReconnectFailed = errors.New("reconnect attempts exhausted")
+)
+
+// Connection state change
+type DeviceStateEvent struct {
+	State   DeviceState // New state
+	Err     error       // Cause, if any
+	Attempt int         // Reconnect attempt (DeviceReconnecting only)
+	Time    time.Time   // Time of change
+}
+
+// Reconnect policy, exponential backoff with jitter
+type ReconnectPolicy struct {
+	MinDelay    time.Duration // Delay before first attempt
+	MaxDelay    time.Duration // Delay cap
+	Factor      float64       // Delay multiplier per attempt
+	Jitter      float64       // Random fraction of the delay added or removed, 0 to 1
+	MaxAttempts int           // Give up after, 0 for never
+}
+
+// Default reconnect policy, 1s doubling up to 1 min, never gives up
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		MinDelay: time.Second,
+		MaxDelay: time.Minute,
+		Factor:   2,
+		Jitter:   0.2,
+	}
+}
+
+// Delay before attempt (1-based)
+func (policy ReconnectPolicy) Delay(attempt int) time.Duration {
+	delay := float64(policy.MinDelay)
+	for idx := 1; idx < attempt && delay < float64(policy.MaxDelay); idx++ {
+		delay *= policy.Factor
+	}
+
+	if policy.MaxDelay > 0 && delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// Reconnect automatically when the connection is lost and login the
+// sessions again. Sessions run their OnRestore functions once logged in.
+func (device *Device) Supervise(policy ReconnectPolicy) {
+	device.mutex.Lock()
+	device.policy = &policy
+	device.mutex.Unlock()
+}
+
+// Connection state
+func (device *Device) State() DeviceState {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.state
+}
+
+// State Q, events are dropped when it is full
+func (device *Device) StateQ() *chan DeviceStateEvent {
+	return &device.stateQ
+}
+
+// Change connection state
+func (device *Device) setState(state DeviceState, err error, attempt int) {
+	device.mutex.Lock()
+	device.state = state
+	device.mutex.Unlock()
+
+	event := DeviceStateEvent{State: state, Err: err, Attempt: attempt, Time: time.Now()}
+
+	select {
+	case device.stateQ <- event:
+	default:
+		device.logger.Debug("State Q full, dropped ", state)
+	}
+}
+
+// Reconnect task
+func (device *Device) reconnect(policy ReconnectPolicy) {
+	var err error
+
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		device.setState(DeviceReconnecting, err, attempt)
+
+		// Close interrupts the wait
+		timer := time.NewTimer(policy.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-device.closing:
+			timer.Stop()
+			return
+		}
+
+		// No longer supervised
+		device.mutex.Lock()
+		supervised := device.policy != nil
+		device.mutex.Unlock()
+
+		if !supervised {
+			return
+		}
+
+		var transport net.Conn
+		if transport, err = device.dial(); err != nil {
+			device.logger.Debug("Unable to reconnect, try ", err.Error(), attempt)
+			continue
+		}
+
+		device.logger.Info("Reconnected in try ", attempt)
+
+		sessions := device.resetSessions()
+
+		if device.attach(transport) != nil {
+			return
+		}
+
+		for _, session := range sessions {
+			session.relogin()
+		}
+
+		return
+	}
+
+	device.logger.Error("Giving up reconnecting")
+	device.setState(DeviceDisconnected, ErrReconnectFailed, 0)
+	device.stop(ErrReconnectFailed)
+}
+
+// Take logged in sessions back to temporary sessions with new local ids,
+// the device assigns new session ids on login. Requests fail with
+// ErrNotConnected until the session is logged in again.
+func (device *Device) resetSessions() []*Session {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var sessions []*Session
+
+	for idx, session := range device.sessions {
+		if session == nil {
+			continue
+		}
+
+		device.sessions[idx] = nil
+
+		if err := device.register(session); err != nil {
+			device.logger.Error("No free local ID for session ", session.sessionID())
+			continue
+		}
+
+		session.stopKeepAlive()
+		atomic.StoreUint32(&session.seqNum, 0)
+
+		session.stateMutex.Lock()
+		session.id = 0
+		session.idStr = ""
+		session.resetting = true
+		session.stateMutex.Unlock()
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// Login again and restore session state
+func (session *Session) relogin() {
+	logger := session.device.logger
+
+	err := session.Login()
+
+	session.stateMutex.Lock()
+	session.resetting = false
+	session.stateMutex.Unlock()
+
+	if err != nil {
+		logger.Error("Unable to login again [", err.Error(), "]")
+		return
+	}
+
+	for _, fn := range session.restore {
+		if err := fn(session); err != nil {
+			logger.Error("Unable to restore session ", session.sessionID(), " [", err.Error(), "]")
+		}
+	}
+}
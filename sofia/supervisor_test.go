@@ -0,0 +1,106 @@
+package sofia_test
+
+import (
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+// Supervised device logged in to a fake device
+func supervisedSession(t *testing.T, server *sofiatest.Server, policy sofia.ReconnectPolicy) (*sofia.Device, *sofia.Session) {
+	t.Helper()
+
+	device := connectDevice(t, server, nil, func(device *sofia.Device) {
+		device.Supervise(policy)
+	})
+
+	return device, loginSession(t, device)
+}
+
+// Wait for a connection state
+func waitState(t *testing.T, device *sofia.Device, state sofia.DeviceState) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-*device.StateQ():
+			if event.State == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %s state, device is %s", state, device.State())
+		}
+	}
+}
+
+func TestSupervisorRelogin(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+
+	device, session := supervisedSession(t, server, sofia.ReconnectPolicy{MinDelay: 50 * time.Millisecond, Factor: 1})
+
+	if _, err := session.SystemInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests sent while the session is reset never reach the device
+	// under the old session id, they fail until the relogin
+	server.DisconnectAll()
+	waitState(t, device, sofia.DeviceReconnecting)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		start := time.Now()
+
+		_, err := session.SystemInfo()
+		if err == nil {
+			break
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("request blocked for %s [%v]", elapsed, err)
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("not logged in again [%v]", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorCloseDuringBackoff(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+
+	device, _ := supervisedSession(t, server, sofia.ReconnectPolicy{MinDelay: time.Minute, Factor: 1})
+
+	server.DisconnectAll()
+	waitState(t, device, sofia.DeviceReconnecting)
+
+	done := make(chan struct{})
+	go func() {
+		device.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for the reconnect delay")
+	}
+
+	if err := <-*device.WorkerChan(); err != nil {
+		t.Errorf("device stopped with %v, want nil", err)
+	}
+}
+
+func TestSessionNotLoggedIn(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+	session := newSession(t, connectDevice(t, server, nil, nil), "admin", "")
+
+	if _, err := session.SystemInfo(); err != sofia.ErrNotLoggedIn {
+		t.Errorf("request before login [%v], want %v", err, sofia.ErrNotLoggedIn)
+	}
+}
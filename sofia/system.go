@@ -0,0 +1,57 @@
+package sofia
+
+import (
+	"errors"
+	"time"
+)
+
+// Password change request data
+type ModifyPasswordReqData struct {
+	EncryptType string // Always MD5
+	NewPassWord string // New password (hashed)
+	PassWord    string // Current password (hashed)
+	SessionID   string // Session ID
+	UserName    string // User
+}
+
+// Device time
+func (session *Session) Time() (time.Time, error) {
+	var resData struct {
+		OPTimeQuery string
+	}
+
+	if err := session.command(TIMEQUERY_REQ, CmdReqData{Name: "OPTimeQuery", SessionID: session.sessionID()}, &resData); err != nil {
+		return time.Time{}, err
+	}
+
+	t := parseDeviceTime(resData.OPTimeQuery)
+	if t.IsZero() {
+		return t, errors.New("invalid device time " + resData.OPTimeQuery)
+	}
+
+	return t, nil
+}
+
+// Set device time, devices keep local time
+func (session *Session) SetTime(t time.Time) error {
+	data := map[string]string{
+		"Name":          "OPTimeSetting",
+		"OPTimeSetting": t.Local().Format(DeviceTimeLayout),
+		"SessionID":     session.sessionID(),
+	}
+
+	return session.command(SYSMANAGER_REQ, data, nil)
+}
+
+// Change password of a user, passwords are plain text
+func (session *Session) ChangePassword(user string, oldPassword string, newPassword string) error {
+	data := ModifyPasswordReqData{
+		EncryptType: "MD5",
+		NewPassWord: SofiaHash(newPassword),
+		PassWord:    SofiaHash(oldPassword),
+		SessionID:   session.sessionID(),
+		UserName:    user,
+	}
+
+	return session.command(MODIFYPASSWORD_REQ, data, nil)
+}
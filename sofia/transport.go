@@ -0,0 +1,176 @@
+package sofia
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Errors
+var (
+	ErrConnAdopted = errors.New("adopted connection already used")
+	ErrPinMismatch = errors.New("certificate doesn't match pin")
+)
+
+// Opens transport connections to devices
+type Dialer interface {
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+// Dialer function
+type DialFunc func(ctx context.Context, address string) (net.Conn, error)
+
+func (fn DialFunc) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return fn(ctx, address)
+}
+
+// Device option
+type DeviceOption func(device *Device) error
+
+// Connect with dialer instead of plain TCP
+func WithDialer(dialer Dialer) DeviceOption {
+	return func(device *Device) error {
+		device.dialer = dialer
+		return nil
+	}
+}
+
+// Connect with TLS wrapped DVRIP, usually on the SSL port reported by discovery
+func WithTLS(config TLSConfig) DeviceOption {
+	return func(device *Device) error {
+		dialer, err := TLSDialer(config)
+		if err != nil {
+			return err
+		}
+
+		device.dialer = dialer
+		return nil
+	}
+}
+
+// Use an established connection (net.Pipe, a proxied stream). It can't be
+// dialed again, so reconnecting a supervised device fails.
+func WithConn(conn net.Conn) DeviceOption {
+	return func(device *Device) error {
+		device.dialer = ConnDialer(conn)
+		return nil
+	}
+}
+
+// Plain TCP dialer
+func TCPDialer() Dialer {
+	return DialFunc(func(ctx context.Context, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	})
+}
+
+// Dialer returning conn once
+func ConnDialer(conn net.Conn) Dialer {
+	var once sync.Once
+
+	return DialFunc(func(ctx context.Context, address string) (net.Conn, error) {
+		err := ErrConnAdopted
+		once.Do(func() {
+			err = nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	})
+}
+
+// TLS settings. Cameras mostly use self-signed certificates, either trust
+// the CA that signed them or pin the certificate itself.
+type TLSConfig struct {
+	CAFile     string         // PEM file of CAs to trust, empty for the system roots
+	CAs        *x509.CertPool // CAs to trust, overrides CAFile
+	ServerName string         // Name to verify instead of the host
+	Pin        string         // SHA-256 of the device certificate (hex, colons allowed), skips CA verification
+	Config     *tls.Config    // Base configuration, cloned
+}
+
+// TLS dialer
+func TLSDialer(config TLSConfig) (Dialer, error) {
+	tlsConfig := &tls.Config{}
+	if config.Config != nil {
+		tlsConfig = config.Config.Clone()
+	}
+
+	if len(config.ServerName) > 0 {
+		tlsConfig.ServerName = config.ServerName
+	}
+
+	// Trusted CAs
+	if config.CAs != nil {
+		tlsConfig.RootCAs = config.CAs
+	} else if len(config.CAFile) > 0 {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	// Pinned certificate, the chain and name are not verified
+	if len(config.Pin) > 0 {
+		pin, err := hex.DecodeString(strings.ReplaceAll(config.Pin, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 pin %q", config.Pin)
+		}
+
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrPinMismatch
+			}
+
+			if sum := sha256.Sum256(rawCerts[0]); !bytes.Equal(sum[:], pin) {
+				return ErrPinMismatch
+			}
+
+			return nil
+		}
+	}
+
+	return DialFunc(func(ctx context.Context, address string) (net.Conn, error) {
+		dialer := tls.Dialer{Config: tlsConfig}
+		return dialer.DialContext(ctx, "tcp", address)
+	}), nil
+}
+
+// Dial the device within the connect timeout
+func (device *Device) dial() (net.Conn, error) {
+	ctx := context.Background()
+	if device.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, device.connectTimeout)
+		defer cancel()
+	}
+
+	return device.dialer.Dial(ctx, net.JoinHostPort(device.host, device.port))
+}
+
+// Fingerprint of a certificate as used by TLSConfig.Pin
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,182 @@
+package sofia_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"sofia-go/sofia"
+	"sofia-go/sofia/sofiatest"
+)
+
+// Self-signed certificate for 127.0.0.1, like the ones cameras ship with
+func selfSigned(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "NVR"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// Fake device serving DVRIP over TLS, returns its host and port
+func startTLSServer(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closed here too in case Serve hasn't taken it yet
+	server := sofiatest.NewServer(sofiatest.Config{})
+	t.Cleanup(func() {
+		server.Close()
+		listener.Close()
+	})
+
+	go server.Serve(tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	return host, port
+}
+
+func TestTLS(t *testing.T) {
+	cert, parsed := selfSigned(t)
+	_, other := selfSigned(t)
+
+	pin := sofia.CertificatePin(parsed)
+
+	// Colon separated upper case, as shown by browsers
+	var pairs []string
+	for idx := 0; idx < len(pin); idx += 2 {
+		pairs = append(pairs, strings.ToUpper(pin[idx:idx+2]))
+	}
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(parsed)
+
+	untrusted := x509.NewCertPool()
+	untrusted.AddCert(other)
+
+	tests := []struct {
+		name    string
+		config  sofia.TLSConfig
+		wantErr error // nil for any error when fail is set
+		fail    bool
+	}{
+		{name: "pin", config: sofia.TLSConfig{Pin: pin}},
+		{name: "pin with colons", config: sofia.TLSConfig{Pin: strings.Join(pairs, ":")}},
+		{name: "pin mismatch", config: sofia.TLSConfig{Pin: sofia.CertificatePin(other)}, wantErr: sofia.ErrPinMismatch, fail: true},
+		{name: "CA pool", config: sofia.TLSConfig{CAs: trusted}},
+		{name: "CA pool, server name", config: sofia.TLSConfig{CAs: trusted, ServerName: "127.0.0.1"}},
+		{name: "untrusted CA", config: sofia.TLSConfig{CAs: untrusted}, fail: true},
+		{name: "wrong server name", config: sofia.TLSConfig{CAs: trusted, ServerName: "nvr.example"}, fail: true},
+		{name: "pin overrides CA pool", config: sofia.TLSConfig{CAs: untrusted, Pin: pin}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, port := startTLSServer(t, cert)
+
+			device, err := sofia.NewDevice(host, port, 1, 1, testLogger(), sofia.WithTLS(test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer device.Close()
+
+			err = device.Connect()
+			if failed := err != nil; failed != test.fail {
+				t.Fatalf("connect [%v], want failure %v", err, test.fail)
+			}
+
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("connect [%v], want %v", err, test.wantErr)
+			}
+
+			if test.fail {
+				return
+			}
+
+			// DVRIP runs over the TLS connection
+			session := loginSession(t, device)
+			if _, err := session.StorageInfo(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTLSBadPin(t *testing.T) {
+	for _, pin := range []string{"00", "not hex", strings.Repeat("0", 63)} {
+		if _, err := sofia.NewDevice("127.0.0.1", "34567", 1, 1, testLogger(), sofia.WithTLS(sofia.TLSConfig{Pin: pin})); err == nil {
+			t.Errorf("%q: no error", pin)
+		}
+	}
+}
+
+func TestWithConn(t *testing.T) {
+	server := startServer(t, sofiatest.Config{})
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Host and port are never dialed
+	device, err := sofia.NewDevice("adopted", "0", 1, 1, testLogger(), sofia.WithConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err := device.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	session := loginSession(t, device)
+	if _, err := session.StorageInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once lost the connection can't be dialed again
+	server.DisconnectAll()
+
+	if err := device.Connect(); !errors.Is(err, sofia.ErrConnAdopted) {
+		t.Errorf("reconnect [%v], want %v", err, sofia.ErrConnAdopted)
+	}
+}
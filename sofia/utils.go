@@ -1,8 +1,15 @@
 package sofia
 
-// Sequence
+import (
+	"crypto/md5"
+	"sync"
+	"time"
+)
+
+// Sequence of login correlation ids 1..size, 0 is never allocated
 type Sequence struct {
-	pool []bool // Raw indices
+	mutex sync.Mutex  // Protects pool
+	pool  []time.Time // Allocation time of id idx+1, zero if free
 }
 
 // Create new sequence
@@ -11,21 +18,28 @@ func NewSequence(size uint8) *Sequence {
 	seq := new(Sequence)
 
 	// Make pool
-	seq.pool = make([]bool, size)
+	seq.pool = make([]time.Time, size)
 
 	return seq
 }
 
 // Delete a sequence
 func DeleteSequence(seq *Sequence) {
-	// GC
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+
+	// Release all indices, GC does the rest
+	seq.pool = nil
 }
 
-// Get index
+// Get index, 0 if all are taken
 func (seq *Sequence) GetIndex() uint8 {
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+
 	for idx := 0; idx < len(seq.pool); idx++ {
-		if !seq.pool[idx] {
-			seq.pool[idx] = true
+		if seq.pool[idx].IsZero() {
+			seq.pool[idx] = time.Now()
 			return uint8(idx + 1)
 		}
 	}
@@ -35,7 +49,50 @@ func (seq *Sequence) GetIndex() uint8 {
 
 // Free index
 func (seq *Sequence) FreeIndex(idx uint8) {
-	if idx != 0 {
-		seq.pool[idx-1] = false
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+
+	if idx != 0 && int(idx) <= len(seq.pool) {
+		seq.pool[idx-1] = time.Time{}
+	}
+}
+
+// Restart the age of a taken index
+func (seq *Sequence) Touch(idx uint8) {
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+
+	if idx != 0 && int(idx) <= len(seq.pool) && !seq.pool[idx-1].IsZero() {
+		seq.pool[idx-1] = time.Now()
+	}
+}
+
+// Free indices taken for longer than maxAge, returns them
+func (seq *Sequence) Reclaim(maxAge time.Duration) []uint8 {
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+
+	var reclaimed []uint8
+	for idx, taken := range seq.pool {
+		if !taken.IsZero() && time.Since(taken) > maxAge {
+			seq.pool[idx] = time.Time{}
+			reclaimed = append(reclaimed, uint8(idx+1))
+		}
+	}
+
+	return reclaimed
+}
+
+// Sofia password hash, MD5 folded into 8 alphanumeric characters
+func SofiaHash(password string) string {
+	const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	digest := md5.Sum([]byte(password))
+
+	hash := make([]byte, 8)
+	for idx := range hash {
+		hash[idx] = chars[(int(digest[2*idx])+int(digest[2*idx+1]))%len(chars)]
 	}
+
+	return string(hash)
 }
@@ -0,0 +1,131 @@
+package sofia
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Pretend index idx was taken age ago
+func ageIndex(seq *Sequence, idx uint8, age time.Duration) {
+	seq.mutex.Lock()
+	seq.pool[idx-1] = time.Now().Add(-age)
+	seq.mutex.Unlock()
+}
+
+func TestSequence(t *testing.T) {
+	seq := NewSequence(3)
+
+	for want := uint8(1); want <= 3; want++ {
+		if idx := seq.GetIndex(); idx != want {
+			t.Fatalf("index %d, want %d", idx, want)
+		}
+	}
+
+	if idx := seq.GetIndex(); idx != 0 {
+		t.Fatalf("index %d from an exhausted sequence", idx)
+	}
+
+	// Lowest free index first
+	seq.FreeIndex(2)
+	seq.FreeIndex(0) // Never allocated, ignored
+	seq.FreeIndex(4) // Out of range, ignored
+	if idx := seq.GetIndex(); idx != 2 {
+		t.Errorf("index %d after free, want 2", idx)
+	}
+
+	// Only indices older than maxAge, touched ones are young again
+	ageIndex(seq, 1, time.Minute)
+	ageIndex(seq, 3, time.Minute)
+	seq.Touch(3)
+
+	if reclaimed := seq.Reclaim(30 * time.Second); len(reclaimed) != 1 || reclaimed[0] != 1 {
+		t.Errorf("reclaimed %v, want [1]", reclaimed)
+	}
+
+	if idx := seq.GetIndex(); idx != 1 {
+		t.Errorf("index %d after reclaim, want 1", idx)
+	}
+
+	// Touching a free index doesn't take it
+	seq.FreeIndex(1)
+	seq.Touch(1)
+	if idx := seq.GetIndex(); idx != 1 {
+		t.Errorf("touched free index, got %d", idx)
+	}
+}
+
+func TestPendingLoginReclaim(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	device, err := NewDevice("127.0.0.1", "34567", 1, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every local ID taken by a pending login
+	var sessions []*Session
+	for {
+		session, err := device.NewSession("admin", "")
+		if errors.Is(err, ErrTooManyLogins) {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	if len(sessions) != 0xFF {
+		t.Fatalf("%d sessions before ErrTooManyLogins, want 255", len(sessions))
+	}
+
+	// A login in progress keeps its ID
+	abandoned, touched := sessions[0], sessions[1]
+	ageIndex(device.sequence, abandoned.opaqueId, PendingLoginTimeout+time.Second)
+	ageIndex(device.sequence, touched.opaqueId, PendingLoginTimeout+time.Second)
+
+	if err := device.pendingLogin(touched); err != nil || touched.opaqueId != 2 {
+		t.Fatalf("touched session ID %d [%v]", touched.opaqueId, err)
+	}
+
+	// The abandoned login's ID goes to a new session
+	session, err := device.NewSession("admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.opaqueId != 1 || abandoned.opaqueId != 0 || device.tmpSessions[1] != session {
+		t.Errorf("new session ID %d, abandoned session ID %d", session.opaqueId, abandoned.opaqueId)
+	}
+
+	if _, err := device.NewSession("admin", ""); !errors.Is(err, ErrTooManyLogins) {
+		t.Errorf("new session [%v], want %v", err, ErrTooManyLogins)
+	}
+
+	// The abandoned session registers again when it logs in, once an ID is free
+	if err := device.pendingLogin(abandoned); !errors.Is(err, ErrTooManyLogins) {
+		t.Errorf("login of abandoned session [%v], want %v", err, ErrTooManyLogins)
+	}
+
+	device.DeleteSession(sessions[100])
+
+	if err := device.pendingLogin(abandoned); err != nil {
+		t.Fatal(err)
+	}
+
+	if abandoned.opaqueId != 101 || device.tmpSessions[101] != abandoned {
+		t.Errorf("abandoned session registered as %d", abandoned.opaqueId)
+	}
+
+	// Its old ID still belongs to the new session
+	if device.tmpSessions[1] != session {
+		t.Error("new session lost its ID")
+	}
+}